@@ -0,0 +1,175 @@
+package locket
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+/*
+Admin requests to a RegistryHandler are signed, like client fetches, with an
+ed25519 admin key rather than authenticated by a static token:
+  - the signature covers the method, path, a hash of the body, a timestamp
+    and a nonce (see adminMessage), so a captured request cannot be altered,
+    and can be replayed neither after MaxClockSkew nor within it
+  - each admin key has a role: read to list entries, write to change them
+  - admin keys can sign through any Signer, so may stay in an ssh-agent
+
+The static X-Auth-Token remains as a legacy mode, only if
+RegistryHandler.Token is set.
+*/
+
+// AdminRole is what an admin key may do through a RegistryHandler.
+type AdminRole string
+
+const (
+	AdminRead  AdminRole = "read"  // list entries
+	AdminWrite AdminRole = "write" // list and change entries and keys
+)
+
+// headers of a signed admin request
+const (
+	adminKeyIDHeader     = "X-Admin-Key-ID"
+	adminTimestampHeader = "X-Admin-Timestamp"
+	adminNonceHeader     = "X-Admin-Nonce"
+	adminSignatureHeader = "X-Admin-Signature"
+)
+
+// AdminKey is an admin's public key and role, as listed in an admins file.
+type AdminKey struct {
+	Name   string    `yaml:"name"   json:"name"`
+	Role   AdminRole `yaml:"role"   json:"role"`
+	KeyPub string    `yaml:"keypub" json:"keypub"` // ed25519, as for RegEntry.KeyPub
+}
+
+// AdminAuth authenticates signed admin requests, see RegistryHandler.
+type AdminAuth struct {
+	keys map[string]adminKey // by key ID
+	seen *nonceCache
+}
+
+// adminKey is a parsed AdminKey.
+type adminKey struct {
+	AdminKey
+	key VerifyKey
+}
+
+// errAdminAuth is returned for any request failing authentication,
+// without saying why.
+var errAdminAuth = errors.New("admin authentication failed")
+
+// LoadAdminKeys reads a YAML list of AdminKey.
+func LoadAdminKeys(path string) ([]AdminKey, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read file: %w", err)
+	}
+	var keys []AdminKey
+	if err := yaml.Unmarshal(b, &keys); err != nil {
+		return nil, fmt.Errorf("unmarshal: %w", err)
+	}
+	return keys, nil
+}
+
+// NewAdminAuth returns an AdminAuth accepting requests signed by keys.
+// Close it to stop its replay-cache sweeper.
+func NewAdminAuth(keys []AdminKey) (*AdminAuth, error) {
+	a := &AdminAuth{keys: make(map[string]adminKey, len(keys))}
+	for i, k := range keys {
+		if k.Role != AdminRead && k.Role != AdminWrite {
+			return nil, fmt.Errorf("admin %d (%q): role %q, want %q or %q", i, k.Name, k.Role, AdminRead, AdminWrite)
+		}
+		key, err := ParseVerifyKey(k.KeyPub)
+		if err != nil {
+			return nil, fmt.Errorf("admin %d (%q): %w", i, k.Name, err)
+		}
+		if _, ok := a.keys[key.ID()]; ok {
+			return nil, fmt.Errorf("admin %d (%q): duplicate key %s", i, k.Name, key.ID())
+		}
+		a.keys[key.ID()] = adminKey{AdminKey: k, key: key}
+	}
+	a.seen = newNonceCache(Defaults.MaxClockSkew)
+	return a, nil
+}
+
+// Close stops the replay-cache sweeper.
+func (a *AdminAuth) Close() {
+	a.seen.close()
+}
+
+// authenticate returns the admin that signed r, whose body is body.
+func (a *AdminAuth) authenticate(r *http.Request, body []byte, now time.Time) (AdminKey, error) {
+	keyID := r.Header.Get(adminKeyIDHeader)
+	nonce := r.Header.Get(adminNonceHeader)
+	ts, err := strconv.ParseInt(r.Header.Get(adminTimestampHeader), 10, 64)
+	if err != nil || nonce == "" {
+		return AdminKey{}, fmt.Errorf("%w: malformed headers", errAdminAuth)
+	}
+	sig, err := base64.StdEncoding.DecodeString(r.Header.Get(adminSignatureHeader))
+	if err != nil {
+		return AdminKey{}, fmt.Errorf("%w: malformed signature", errAdminAuth)
+	}
+	admin, ok := a.keys[keyID]
+	if !ok {
+		return AdminKey{}, fmt.Errorf("%w: unknown key %s", errAdminAuth, keyID)
+	}
+	if skew := now.Sub(time.Unix(ts, 0)).Abs(); skew > Defaults.MaxClockSkew {
+		return AdminKey{}, fmt.Errorf("%w: clock skew %s", errAdminAuth, skew)
+	}
+	msg := adminMessage(keyID, r.Method, r.URL.RequestURI(), body, ts, nonce)
+	if !admin.key.Verify([]byte(msg), sig) {
+		return AdminKey{}, fmt.Errorf("%w: bad signature by %s", errAdminAuth, keyID)
+	}
+	// only after verifying, so forged requests cannot burn nonces
+	if a.seen.observe(keyID+" "+nonce, time.Unix(ts, 0).Add(Defaults.MaxClockSkew)) {
+		return AdminKey{}, fmt.Errorf("%w: replayed nonce", errAdminAuth)
+	}
+	return admin.AdminKey, nil
+}
+
+// allows reports whether role permits method.
+func (role AdminRole) allows(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead:
+		return role == AdminRead || role == AdminWrite
+	default:
+		return role == AdminWrite
+	}
+}
+
+// adminMessage builds the canonical string an admin signs for a request:
+// the signing key ID, method, path with query, SHA-256 of the body,
+// timestamp and nonce, as requestMessage does for client fetches.
+func adminMessage(keyID, method, uri string, body []byte, timestamp int64, nonce string) string {
+	sum := sha256.Sum256(body)
+	return fmt.Sprintf("admin-v1\n%s\n%s\n%s\n%s\n%d\n%s",
+		keyID, method, uri, hex.EncodeToString(sum[:]), timestamp, nonce,
+	)
+}
+
+// signAdminRequest signs req, whose body is body, with signer.
+func signAdminRequest(req *http.Request, body []byte, signer Signer) error {
+	nonce, err := newNonce()
+	if err != nil {
+		return err
+	}
+	keyID := signer.Public().ID()
+	ts := time.Now().Unix()
+	sig, err := signer.Sign([]byte(adminMessage(keyID, req.Method, req.URL.RequestURI(), body, ts, nonce)))
+	if err != nil {
+		return fmt.Errorf("sign: %w", err)
+	}
+	req.Header.Set(adminKeyIDHeader, keyID)
+	req.Header.Set(adminTimestampHeader, strconv.FormatInt(ts, 10))
+	req.Header.Set(adminNonceHeader, nonce)
+	req.Header.Set(adminSignatureHeader, base64.StdEncoding.EncodeToString(sig))
+	return nil
+}
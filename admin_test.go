@@ -0,0 +1,123 @@
+package locket
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// newTestAdminHandler serves a FileRegistry to a write admin and a read
+// admin, returning their signers.
+func newTestAdminHandler(t *testing.T, token string) (*httptest.Server, *SigningKey, *SigningKey) {
+	t.Helper()
+	writer, reader := newTestOperator(t), newTestOperator(t)
+	admins, err := NewAdminAuth([]AdminKey{
+		{Name: "alice", Role: AdminWrite, KeyPub: writer.Public().PEM()},
+		{Name: "monitoring", Role: AdminRead, KeyPub: reader.Public().PEM()},
+	})
+	require.NoError(t, err)
+	t.Cleanup(admins.Close)
+	reg := FileRegistry{Path: filepath.Join(t.TempDir(), "registry.yml")}
+	require.NoError(t, reg.write(nil))
+	ts := httptest.NewServer(RegistryHandler{Registry: reg, Admins: admins, Token: token})
+	t.Cleanup(ts.Close)
+	return ts, writer, reader
+}
+
+func TestRegistryHandlerAdminRoles(t *testing.T) {
+	ts, writer, reader := newTestAdminHandler(t, "")
+	admin := RemoteRegistry{URL: ts.URL, Signer: writer}
+	require.NoError(t, admin.Upsert(RegEntry{Name: "svc", KeyPub: testPub1}))
+	require.NoError(t, admin.AddKey("svc", RegKey{KeyPub: testPub2}))
+
+	monitor := RemoteRegistry{URL: ts.URL, Signer: reader}
+	entries, err := monitor.Entries()
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	require.ErrorContains(t, monitor.Upsert(RegEntry{Name: "other", KeyPub: testPub3}), "403")
+	require.ErrorContains(t, monitor.Delete("svc"), "403")
+
+	// the long-poll query is signed too
+	_, etag, err := admin.fetchChanged(context.Background(), http.DefaultClient, "", time.Second)
+	require.NoError(t, err)
+	require.NotEmpty(t, etag)
+
+	_, err = RemoteRegistry{URL: ts.URL}.Entries()
+	require.ErrorContains(t, err, "401", "unsigned")
+	_, err = RemoteRegistry{URL: ts.URL, Token: "guess"}.Entries()
+	require.ErrorContains(t, err, "401", "no legacy token configured")
+	_, err = RemoteRegistry{URL: ts.URL, Signer: newTestOperator(t)}.Entries()
+	require.ErrorContains(t, err, "401", "unknown admin")
+}
+
+func TestRegistryHandlerAdminSignature(t *testing.T) {
+	ts, writer, _ := newTestAdminHandler(t, "")
+	body := []byte(`{"name":"svc"}`)
+	signed := func(t *testing.T) *http.Request {
+		req, err := http.NewRequest(http.MethodPost, ts.URL+PathRegistry, bytes.NewReader(body))
+		require.NoError(t, err)
+		require.NoError(t, signAdminRequest(req, body, writer))
+		return req
+	}
+	send := func(t *testing.T, req *http.Request, body []byte) int {
+		req.Body = io.NopCloser(bytes.NewReader(body))
+		req.ContentLength = int64(len(body))
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	req := signed(t)
+	require.Equal(t, http.StatusNoContent, send(t, req, body))
+	require.Equal(t, http.StatusUnauthorized, send(t, req, body), "replayed")
+
+	req = signed(t)
+	require.Equal(t, http.StatusUnauthorized, send(t, req, []byte(`{"name":"evil"}`)), "body altered")
+
+	req = signed(t)
+	req.Method = http.MethodDelete
+	require.Equal(t, http.StatusUnauthorized, send(t, req, body), "method altered")
+
+	req = signed(t)
+	stale := time.Now().Add(-time.Hour).Unix()
+	req.Header.Set(adminTimestampHeader, strconv.FormatInt(stale, 10))
+	require.Equal(t, http.StatusUnauthorized, send(t, req, body), "stale")
+}
+
+func TestRegistryHandlerLegacyToken(t *testing.T) {
+	ts, writer, _ := newTestAdminHandler(t, "tok")
+	_, err := RemoteRegistry{URL: ts.URL, Token: "tok"}.Entries()
+	require.NoError(t, err)
+	_, err = RemoteRegistry{URL: ts.URL, Signer: writer}.Entries()
+	require.NoError(t, err)
+	_, err = RemoteRegistry{URL: ts.URL, Token: "wrong"}.Entries()
+	require.ErrorContains(t, err, "401")
+}
+
+func TestNewAdminAuth(t *testing.T) {
+	keys, err := LoadAdminKeys(filepath.Join("example", "admins.yml"))
+	require.NoError(t, err)
+	admins, err := NewAdminAuth(keys)
+	require.NoError(t, err)
+	admins.Close()
+
+	bad := append([]AdminKey(nil), keys...)
+	bad[0].Role = "root"
+	_, err = NewAdminAuth(bad)
+	require.ErrorContains(t, err, "role")
+	bad = append([]AdminKey(nil), keys...)
+	bad[0].KeyPub = "asdfasdf"
+	_, err = NewAdminAuth(bad)
+	require.Error(t, err)
+	_, err = NewAdminAuth(append(keys, keys[0]))
+	require.ErrorContains(t, err, "duplicate")
+}
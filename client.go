@@ -2,33 +2,59 @@ package locket
 
 import (
 	"bytes"
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"io"
 	"net/http"
+	"os"
+	"strings"
 	"time"
 )
 
 // Client makes requests to a locket server, and must know the server address.
-// serverPubkey is the server's encryption public key, and will be fetched
+// serverKey is the server's encryption public key, and will be fetched
 // on creation of NewClient().
-// Rsa and Ed25519 key pairs are also generated on creation of NewClient().
+// An RSA key pair for responses is generated on creation of NewClient(),
+// and all keys are parsed once there rather than on every request.
 type Client struct {
-	serverAddress     string // server URL
-	serverPubkey      string // server encryption public key
-	keyRsaPublic      string // encryption public key
-	keyRsaPrivate     string // encryption private key
-	keyEd25519Public  string // signing public key
-	keyEd25519Private string // signing private key
+	serverAddress string         // server URL
+	serverKey     *encryptionKey // server encryption public key
+	key           *decryptionKey // response encryption key pair
+	signer        Signer         // request signing key
+	token         TokenSource    // request JWT, in place of signer (see WithOIDC)
+}
+
+// TokenSource returns a current JWT identifying the client to a server in
+// OIDC mode. It is called for every request, so it may return a refreshed
+// token each time. A token should carry a "cnf" claim binding it to the
+// client, see KeyThumbprint; one that does not is bound to the first Client
+// it is sent by, see WithOIDC, so tokens must not be shared between clients.
+type TokenSource func() (string, error)
+
+// TokenFile returns a TokenSource reading a JWT from path on every request,
+// as with a projected service account token that the platform rotates.
+func TokenFile(path string) TokenSource {
+	return func() (string, error) {
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return "", fmt.Errorf("read token file: %w", err)
+		}
+		return strings.TrimSpace(string(b)), nil
+	}
 }
 
 // kvRequest is the request format for the client to send to the server.
 type kvRequest struct {
-	Payload          string `json:"payload"`       // key for which cilent requests a value
-	PayloadSignature string `json:"signature"`     // ed25519 signature over requestMessage()
-	ClientPubKey     string `json:"client_pubkey"` // public key used to encrypt the response
-	Timestamp        int64  `json:"timestamp"`     // unix seconds, signed to bound replay
-	Nonce            string `json:"nonce"`         // single-use random value, signed to block replay
+	Version          int    `json:"version"`         // protocolVersion the request was built for
+	KeyID            string `json:"key_id"`          // ID of the registered key that signed the request
+	ServerKeyID      string `json:"server_key_id"`   // ID of the server key the payload is encrypted to
+	Payload          string `json:"payload"`         // key for which cilent requests a value
+	PayloadSignature string `json:"signature"`       // ed25519 signature over requestMessage()
+	ClientPubKey     string `json:"client_pubkey"`   // public key used to encrypt the response
+	Timestamp        int64  `json:"timestamp"`       // unix seconds, signed to bound replay
+	Nonce            string `json:"nonce"`           // single-use random value, signed to block replay
+	Token            string `json:"token,omitempty"` // JWT, in place of KeyID and signature in OIDC mode
 }
 
 // NewClient creates a new client, fetches the server's encryption public key,
@@ -39,22 +65,58 @@ type kvRequest struct {
 // be made available to the server to facilitate authentication.
 // see: FileRegistry.Register() for details
 func NewClient(serverURL, keyPub, keyPriv string) (*Client, error) {
-	rsaPublic, rsaPrivate, err := newPairRSA(Defaults.BitsizeRSA)
+	signingKey, err := ParseSigningKey(keyPriv)
 	if err != nil {
-		return nil, fmt.Errorf("generate key pair (RSA): %w", err)
+		return nil, fmt.Errorf("parse signing private key: %w", err)
+	}
+	signingPub, err := ParseVerifyKey(keyPub)
+	if err != nil {
+		return nil, fmt.Errorf("parse signing public key: %w", err)
 	}
-	client := Client{
-		serverAddress:     serverURL,
-		keyRsaPublic:      rsaPublic,
-		keyRsaPrivate:     rsaPrivate,
-		keyEd25519Public:  keyPub,
-		keyEd25519Private: keyPriv,
+	if signingPub.ID() != signingKey.Public().ID() {
+		return nil, fmt.Errorf("signing public key does not match private key")
 	}
-	client.serverAddress = serverURL
-	client.keyEd25519Public = keyPub
-	client.keyEd25519Private = keyPriv
+	return NewClientWithSigner(serverURL, signingKey)
+}
+
+// NewClientWithSigner creates a new client like NewClient, signing requests
+// with signer, so the private signing key need not be held by the client
+// (e.g. an AgentSigner). The signer's public key must be in the registry.
+func NewClientWithSigner(serverURL string, signer Signer) (*Client, error) {
+	if signer == nil {
+		return nil, fmt.Errorf("signer must not be nil")
+	}
+	return newClient(Client{serverAddress: serverURL, signer: signer})
+}
+
+// NewClientWithToken creates a new client like NewClient, authenticating
+// requests with a JWT from token rather than a signing key, for servers in
+// OIDC mode (see WithOIDC).
+func NewClientWithToken(serverURL string, token TokenSource) (*Client, error) {
+	if token == nil {
+		return nil, fmt.Errorf("token source must not be nil")
+	}
+	return newClient(Client{serverAddress: serverURL, token: token})
+}
+
+// KeyThumbprint returns the JWK thumbprint (RFC 7638) of the key responses
+// are encrypted to, for the "jkt" member of a token's "cnf" claim, binding
+// the token to this client in OIDC mode (see WithOIDC). The key is
+// generated with the client, so a TokenSource requesting bound tokens
+// calls this on the client it was passed to.
+func (c *Client) KeyThumbprint() string {
+	return jwkThumbprint(c.key.Public().public)
+}
+
+// newClient generates the response key pair and fetches the server key.
+func newClient(client Client) (*Client, error) {
+	key, err := newDecryptionKey(Defaults.BitsizeRSA)
+	if err != nil {
+		return nil, fmt.Errorf("generate key pair (RSA): %w", err)
+	}
+	client.key = key
 	err = client.fetchServerPubkey()
-	if err != nil || client.serverPubkey == "" {
+	if err != nil || client.serverKey == nil {
 		return nil, fmt.Errorf("failed to fetch server pubkey: %w", err)
 	}
 	return &client, nil
@@ -79,7 +141,15 @@ func (c *Client) fetchServerPubkey() error {
 	if err != nil {
 		return fmt.Errorf("read body: %w", err)
 	}
-	c.serverPubkey = string(b)
+	// the key only changes when the server restarts; skip re-parsing it
+	if c.serverKey != nil && c.serverKey.PEM() == string(b) {
+		return nil
+	}
+	serverKey, err := parseEncryptionKey(string(b))
+	if err != nil {
+		return fmt.Errorf("parse server pubkey: %w", err)
+	}
+	c.serverKey = serverKey
 	return nil
 }
 
@@ -93,7 +163,7 @@ func (c *Client) FetchSecret(name string) (string, error) {
 		return "", fmt.Errorf("fetch server pubkey: %w", err)
 	}
 	var request kvRequest
-	cypher, err := encryptRSA(c.serverPubkey, name)
+	cypher, err := c.serverKey.Encrypt([]byte(name))
 	if err != nil {
 		return "", fmt.Errorf("encrypt: %w", err)
 	}
@@ -102,26 +172,39 @@ func (c *Client) FetchSecret(name string) (string, error) {
 	if err != nil {
 		return "", fmt.Errorf("generate nonce: %w", err)
 	}
-	request.Payload = cypher
-	request.ClientPubKey = c.keyRsaPublic
+	request.Version = protocolVersion
+	request.ServerKeyID = c.serverKey.ID()
+	request.Payload = base64.StdEncoding.EncodeToString(cypher)
+	request.ClientPubKey = c.key.Public().PEM()
 	request.Timestamp = ts
 	request.Nonce = nonce
-	sig, err := signEd25519(
-		c.keyEd25519Private,
-		requestMessage(name, c.keyRsaPublic, ts, nonce),
-	)
-	if err != nil {
-		return "", fmt.Errorf("sign: %w", err)
+	if c.token != nil {
+		request.Token, err = c.token()
+		if err != nil {
+			return "", fmt.Errorf("token: %w", err)
+		}
+	} else {
+		request.KeyID = c.signer.Public().ID()
+		sig, err := c.signer.Sign([]byte(requestMessage(
+			request.KeyID, request.ServerKeyID, request.Payload,
+			request.ClientPubKey, ts, nonce,
+		)))
+		if err != nil {
+			return "", fmt.Errorf("sign: %w", err)
+		}
+		request.PayloadSignature = base64.StdEncoding.EncodeToString(sig)
 	}
-	request.PayloadSignature = sig
 	jsonRequest, err := json.Marshal(request)
 	if err != nil {
 		return "", fmt.Errorf("marshal: %w", err)
 	}
 
+	// not the request itself, which may carry a bearer token
 	log.Debug("sending request",
 		"name", name,
-		"payload", string(jsonRequest),
+		"key_id", request.KeyID,
+		"server_key_id", request.ServerKeyID,
+		"nonce", request.Nonce,
 		"url", c.serverAddress,
 	)
 	req, err := http.NewRequest(
@@ -146,10 +229,14 @@ func (c *Client) FetchSecret(name string) (string, error) {
 	if err != nil {
 		return "", fmt.Errorf("decode response: %w", err)
 	}
-	plaintext, err := decryptRSA(c.keyRsaPrivate, response.Payload)
+	ciphertext, err := base64.StdEncoding.DecodeString(response.Payload)
+	if err != nil {
+		return "", fmt.Errorf("decode payload: %w", err)
+	}
+	plaintext, err := c.key.Decrypt(ciphertext)
 	if err != nil {
 		return "", fmt.Errorf("decrypt: %w", err)
 	}
 	log.Debug("fetched secret", "name", name)
-	return plaintext, nil
+	return string(plaintext), nil
 }
@@ -0,0 +1,212 @@
+// Command locket manages locket registries.
+//
+//	locket registry export [-o yaml|json|table] [-l selector] <registry>
+//	locket registry import [-dry-run] [-prune] [-o yaml|json|table] <source> <registry>
+//	locket registry diff [-o yaml|json|table] [-l selector] <from> <to>
+//
+// A registry is one of:
+//   - http://... or https://...: a RemoteRegistry; requests are signed with
+//     the admin key at -admin-key or $LOCKET_ADMIN_KEY, or authenticated
+//     with the legacy $LOCKET_REGISTRY_TOKEN
+//   - dir:<path>: a DirRegistry
+//   - sqlite:<dsn>: an SQLRegistry
+//   - any other path: a FileRegistry, which also reads exported JSON
+//
+// The source of an import may also be "-", reading YAML or JSON from
+// stdin. Import keeps entries missing from the source unless -prune.
+// Diff exits 1 if the registries differ. Export and diff take only the
+// entries whose labels match -l, see locket.LabelSelector.
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/grackleclub/locket"
+	"gopkg.in/yaml.v3"
+)
+
+const usage = `usage:
+  locket registry export [-o yaml|json|table] [-l selector] <registry>
+  locket registry import [-dry-run] [-prune] [-o yaml|json|table] <source> <registry>
+  locket registry diff [-o yaml|json|table] [-l selector] <from> <to>
+`
+
+// errDiffer makes diff exit 1, like diff(1).
+var errDiffer = errors.New("registries differ")
+
+func main() {
+	err := run(os.Args[1:], os.Stdin, os.Stdout)
+	switch {
+	case err == nil:
+	case errors.Is(err, errDiffer):
+		os.Exit(1)
+	case errors.Is(err, flag.ErrHelp):
+		os.Exit(2)
+	default:
+		fmt.Fprintln(os.Stderr, "locket:", err)
+		os.Exit(1)
+	}
+}
+
+// run runs the command given by args.
+func run(args []string, stdin io.Reader, stdout io.Writer) error {
+	if len(args) < 2 || args[0] != "registry" {
+		fmt.Fprint(os.Stderr, usage)
+		return flag.ErrHelp
+	}
+	cmd, args := args[1], args[2:]
+	fs := flag.NewFlagSet("locket registry "+cmd, flag.ContinueOnError)
+	fs.Usage = func() { fmt.Fprint(fs.Output(), usage) }
+	format := fs.String("o", "", "output format: yaml, json or table (default yaml for export, table otherwise)")
+	adminKey := fs.String("admin-key", os.Getenv("LOCKET_ADMIN_KEY"), "admin private key signing requests to a remote registry")
+	var opts locket.SyncOptions
+	var selector string
+	if cmd == "import" {
+		fs.BoolVar(&opts.DryRun, "dry-run", false, "show the changes without making them")
+		fs.BoolVar(&opts.Prune, "prune", false, "delete entries missing from the source")
+	} else {
+		fs.StringVar(&selector, "l", "", "label selector, e.g. team=payments,!legacy")
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	sel, err := locket.ParseLabelSelector(selector)
+	if err != nil {
+		return err
+	}
+	open := func(spec string) (locket.Registry, func(), error) {
+		return openRegistry(spec, *adminKey)
+	}
+
+	switch cmd {
+	case "export":
+		if fs.NArg() != 1 {
+			fs.Usage()
+			return flag.ErrHelp
+		}
+		reg, closeReg, err := open(fs.Arg(0))
+		if err != nil {
+			return err
+		}
+		defer closeReg()
+		return locket.ExportRegistry(stdout, reg, outputFormat(*format, locket.FormatYAML), sel)
+
+	case "import":
+		if fs.NArg() != 2 {
+			fs.Usage()
+			return flag.ErrHelp
+		}
+		entries, err := readSource(fs.Arg(0), stdin, open)
+		if err != nil {
+			return err
+		}
+		dst, closeDst, err := open(fs.Arg(1))
+		if err != nil {
+			return err
+		}
+		defer closeDst()
+		diff, err := locket.ImportRegistry(dst, entries, opts)
+		if werr := diff.Write(stdout, outputFormat(*format, locket.FormatTable)); werr != nil && err == nil {
+			err = werr
+		}
+		return err
+
+	case "diff":
+		if fs.NArg() != 2 {
+			fs.Usage()
+			return flag.ErrHelp
+		}
+		var sides [2][]locket.RegEntry
+		for i := range sides {
+			reg, closeReg, err := open(fs.Arg(i))
+			if err != nil {
+				return err
+			}
+			entries, err := reg.Entries()
+			closeReg()
+			if err != nil {
+				return fmt.Errorf("read %s: %w", fs.Arg(i), err)
+			}
+			sides[i] = locket.FilterEntries(entries, sel)
+		}
+		diff := locket.DiffEntries(sides[0], sides[1])
+		if err := diff.Write(stdout, outputFormat(*format, locket.FormatTable)); err != nil {
+			return err
+		}
+		if !diff.Empty() {
+			return errDiffer
+		}
+		return nil
+
+	default:
+		fmt.Fprint(os.Stderr, usage)
+		return flag.ErrHelp
+	}
+}
+
+// outputFormat returns the format flag, or def if unset.
+func outputFormat(flag string, def locket.RegistryFormat) locket.RegistryFormat {
+	if flag == "" {
+		return def
+	}
+	return locket.RegistryFormat(flag)
+}
+
+// readSource reads the entries to import: from stdin for "-", otherwise
+// from the registry spec.
+func readSource(spec string, stdin io.Reader, open func(string) (locket.Registry, func(), error)) ([]locket.RegEntry, error) {
+	if spec == "-" {
+		b, err := io.ReadAll(stdin)
+		if err != nil {
+			return nil, fmt.Errorf("read stdin: %w", err)
+		}
+		var entries []locket.RegEntry
+		if err := yaml.Unmarshal(b, &entries); err != nil {
+			return nil, fmt.Errorf("unmarshal stdin: %w", err)
+		}
+		return entries, nil
+	}
+	reg, closeReg, err := open(spec)
+	if err != nil {
+		return nil, err
+	}
+	defer closeReg()
+	entries, err := reg.Entries()
+	if err != nil {
+		return nil, fmt.Errorf("read %s: %w", spec, err)
+	}
+	return entries, nil
+}
+
+// openRegistry opens the registry given by spec, see the package doc,
+// returning a function to close it.
+func openRegistry(spec, adminKey string) (locket.Registry, func(), error) {
+	noop := func() {}
+	switch {
+	case strings.HasPrefix(spec, "http://"), strings.HasPrefix(spec, "https://"):
+		reg := locket.RemoteRegistry{URL: spec, Token: os.Getenv("LOCKET_REGISTRY_TOKEN")}
+		if adminKey != "" {
+			signer, err := locket.NewFileSigner(adminKey)
+			if err != nil {
+				return nil, nil, fmt.Errorf("admin key: %w", err)
+			}
+			reg.Signer = signer
+		}
+		return reg, noop, nil
+	case strings.HasPrefix(spec, "dir:"):
+		return locket.DirRegistry{Path: strings.TrimPrefix(spec, "dir:")}, noop, nil
+	case strings.HasPrefix(spec, "sqlite:"):
+		reg, err := locket.OpenSQLRegistry(strings.TrimPrefix(spec, "sqlite:"))
+		if err != nil {
+			return nil, nil, err
+		}
+		return reg, func() { reg.Close() }, nil
+	default:
+		return locket.FileRegistry{Path: spec}, noop, nil
+	}
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"bytes"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/grackleclub/locket"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRegistryCommands(t *testing.T) {
+	pub1, _, err := locket.NewPairEd25519()
+	require.NoError(t, err)
+	pub2, _, err := locket.NewPairEd25519()
+	require.NoError(t, err)
+	file := filepath.Join(t.TempDir(), "registry.yml")
+	require.NoError(t, locket.FileRegistry{Path: file}.Upsert(locket.RegEntry{Name: "svc", KeyPub: pub1}))
+	dir := t.TempDir()
+	require.NoError(t, locket.DirRegistry{Path: dir}.Upsert(locket.RegEntry{Name: "extra", KeyPub: pub2}))
+
+	var out bytes.Buffer
+	require.ErrorIs(t, run([]string{"registry", "diff", "dir:" + dir, file}, nil, &out), errDiffer)
+	require.Contains(t, out.String(), "entry removed")
+
+	out.Reset()
+	require.NoError(t, run([]string{"registry", "import", "-dry-run", "-prune", file, "dir:" + dir}, nil, &out))
+	require.Contains(t, out.String(), "extra")
+	entries, err := locket.DirRegistry{Path: dir}.Entries()
+	require.NoError(t, err)
+	require.Len(t, entries, 1, "dry run")
+
+	out.Reset()
+	require.NoError(t, run([]string{"registry", "export", "-o", "json", file}, nil, &out))
+	exported := out.String()
+	require.NoError(t, run([]string{"registry", "import", "-prune", "-o", "yaml", "-", "dir:" + dir}, strings.NewReader(exported), &out))
+	out.Reset()
+	require.NoError(t, run([]string{"registry", "diff", file, "dir:" + dir}, nil, &out))
+
+	// sqlite needs no cgo
+	db := "sqlite:" + filepath.Join(t.TempDir(), "registry.db")
+	require.NoError(t, run([]string{"registry", "import", file, db}, nil, &out))
+	out.Reset()
+	require.NoError(t, run([]string{"registry", "diff", file, db}, nil, &out))
+
+	require.Error(t, run([]string{"registry", "export", "-o", "xml", file}, nil, &out))
+	require.Error(t, run([]string{"registry", "bogus"}, nil, &out))
+}
@@ -7,116 +7,251 @@ import (
 	"crypto/sha256"
 	"crypto/x509"
 	"encoding/base64"
-	"encoding/pem"
-	"errors"
 	"fmt"
 )
 
-// newPairRSA generates a new RSA key pair with the given number of bits.
-func newPairRSA(bits int) (string, string, error) {
+/*
+Keys are parsed once, when a Server, Client or registry snapshot is built,
+into the typed keys below. Every per-request operation then works on parsed
+keys and raw bytes. PEM strings appear only at the edges: generating keys
+for distribution, publishing the server key, and reading configured keys.
+*/
+
+// decryptionKey is an RSA private key used to decrypt payloads: the
+// server's request key, and each client's response key.
+type decryptionKey struct {
+	private *rsa.PrivateKey
+	public  *encryptionKey
+}
+
+// encryptionKey is a parsed RSA public key that payloads are encrypted to.
+type encryptionKey struct {
+	public *rsa.PublicKey
+	pem    string // PEM as published to peers
+	id     string // fingerprint of the encoded key, see publicKeyID()
+}
+
+// newDecryptionKey generates a new RSA key with the given number of bits.
+func newDecryptionKey(bits int) (*decryptionKey, error) {
 	privateKey, err := rsa.GenerateKey(rand.Reader, bits)
 	if err != nil {
-		return "", "", fmt.Errorf("generate key pair: %w", err)
+		return nil, fmt.Errorf("generate key pair: %w", err)
 	}
+	return newDecryptionKeyFrom(privateKey)
+}
 
-	privateKeyBytes := x509.MarshalPKCS1PrivateKey(privateKey)
-	privateKeyPEM := pem.EncodeToMemory(&pem.Block{
-		Type:  "RSA PRIVATE KEY",
-		Bytes: privateKeyBytes,
-	})
-
+// newDecryptionKeyFrom wraps privateKey, deriving its published public key.
+func newDecryptionKeyFrom(privateKey *rsa.PrivateKey) (*decryptionKey, error) {
 	publicKeyBytes, err := x509.MarshalPKIXPublicKey(&privateKey.PublicKey)
 	if err != nil {
-		return "", "", fmt.Errorf("marshal public key: %w", err)
+		return nil, fmt.Errorf("marshal public key: %w", err)
 	}
-	publicKeyPEM := pem.EncodeToMemory(&pem.Block{
-		Type:  "RSA PUBLIC KEY",
-		Bytes: publicKeyBytes,
-	})
+	return &decryptionKey{
+		private: privateKey,
+		public: &encryptionKey{
+			public: &privateKey.PublicKey,
+			pem:    encodePEM(pemPublicKey, publicKeyBytes),
+			id:     fingerprint(publicKeyBytes),
+		},
+	}, nil
+}
 
-	return string(publicKeyPEM), string(privateKeyPEM), nil
+// newPairRSA generates a new RSA key pair with the given number of bits.
+// Returns: publicKeyPEM, privateKeyPEM, error.
+func newPairRSA(bits int) (string, string, error) {
+	key, err := newDecryptionKey(bits)
+	if err != nil {
+		return "", "", err
+	}
+	return key.public.pem, key.PEM(), nil
 }
 
-// encryptRSA encrypts plaintext with publicKeyPEM generated by NewPairRSA(),
-func encryptRSA(publicKeyPEM, plaintext string) (string, error) {
-	block, _ := pem.Decode([]byte(publicKeyPEM))
-	if block == nil || block.Type != "RSA PUBLIC KEY" {
-		return "", errors.New("decode PEM block containing public key")
+// parseDecryptionKey parses privateKeyPEM generated by newPairRSA(),
+// or any PKCS#8 or PKCS#1 RSA private key.
+func parseDecryptionKey(privateKeyPEM string) (*decryptionKey, error) {
+	privateKey, err := decodeRSAPrivate(privateKeyPEM)
+	if err != nil {
+		return nil, err
 	}
+	return newDecryptionKeyFrom(privateKey)
+}
 
-	publicKey, err := x509.ParsePKIXPublicKey(block.Bytes)
+// PEM serializes the private key as PKCS#8.
+func (k *decryptionKey) PEM() string {
+	b, err := x509.MarshalPKCS8PrivateKey(k.private)
 	if err != nil {
-		return "", err
+		// RSA keys always marshal
+		panic("marshal RSA private key: " + err.Error())
 	}
+	return encodePEM(pemPrivateKey, b)
+}
+
+// Public returns the matching encryption key.
+func (k *decryptionKey) Public() *encryptionKey {
+	return k.public
+}
 
-	rsaPublicKey, ok := publicKey.(*rsa.PublicKey)
-	if !ok {
-		return "", errors.New("not RSA public key")
+// Decrypt decrypts ciphertext produced by encryptionKey.Encrypt().
+func (k *decryptionKey) Decrypt(ciphertext []byte) ([]byte, error) {
+	plaintext, err := rsa.DecryptOAEP(sha256.New(), rand.Reader, k.private, ciphertext, nil)
+	if err != nil {
+		return nil, fmt.Errorf("decrypt: %w", err)
 	}
+	return plaintext, nil
+}
 
-	ciphertext, err := rsa.EncryptOAEP(sha256.New(), rand.Reader, rsaPublicKey, []byte(plaintext), nil)
+// parseEncryptionKey parses publicKeyPEM generated by newPairRSA(),
+// or any PKIX or PKCS#1 RSA public key.
+func parseEncryptionKey(publicKeyPEM string) (*encryptionKey, error) {
+	publicKey, der, err := decodeRSAPublic(publicKeyPEM)
 	if err != nil {
-		return "", fmt.Errorf("encrypt: %w", err)
+		return nil, err
 	}
+	return &encryptionKey{
+		public: publicKey,
+		pem:    publicKeyPEM,
+		id:     fingerprint(der),
+	}, nil
+}
 
-	return base64.StdEncoding.EncodeToString(ciphertext), nil
+// PEM returns the key as published to peers.
+func (k *encryptionKey) PEM() string {
+	return k.pem
 }
 
-// decryptRSA decrypts ciphertext with privateKeyPEM generated by NewPairRSA(),
-func decryptRSA(privateKeyPEM, ciphertext string) (string, error) {
-	block, _ := pem.Decode([]byte(privateKeyPEM))
-	if block == nil || block.Type != "RSA PRIVATE KEY" {
-		return "", errors.New("failed to decode PEM block containing private key")
-	}
+// ID returns the key's fingerprint, see publicKeyID().
+func (k *encryptionKey) ID() string {
+	return k.id
+}
 
-	privateKey, err := x509.ParsePKCS1PrivateKey(block.Bytes)
+// Encrypt encrypts plaintext to the key.
+func (k *encryptionKey) Encrypt(plaintext []byte) ([]byte, error) {
+	ciphertext, err := rsa.EncryptOAEP(sha256.New(), rand.Reader, k.public, plaintext, nil)
 	if err != nil {
-		return "", fmt.Errorf("parse private key: %w", err)
+		return nil, fmt.Errorf("encrypt: %w", err)
 	}
+	return ciphertext, nil
+}
 
-	ciphertextBytes, err := base64.StdEncoding.DecodeString(ciphertext)
+// NewPairEd25519 generates a new Ed25519 key pair used to authenticate
+// clients requests to the server, encoded as PKIX and PKCS#8 PEM.
+// Returns: publicKeyPEM, privateKeyPEM, error.
+func NewPairEd25519() (string, string, error) {
+	_, privateKey, err := ed25519.GenerateKey(rand.Reader)
 	if err != nil {
-		return "", fmt.Errorf("decode ciphertext: %w", err)
+		return "", "", fmt.Errorf("generate ed25519 key pair: %w", err)
 	}
+	key := newSigningKey(privateKey)
+	return key.Public().PEM(), key.PEM(), nil
+}
+
+// SigningKey is a parsed ed25519 private key that a client signs
+// requests with.
+type SigningKey struct {
+	private ed25519.PrivateKey
+	public  VerifyKey
+}
+
+// VerifyKey is a parsed ed25519 public key that the server verifies
+// requests with.
+type VerifyKey struct {
+	key ed25519.PublicKey
+	id  string // see signingKeyID()
+}
 
-	plaintext, err := rsa.DecryptOAEP(sha256.New(), rand.Reader, privateKey, ciphertextBytes, nil)
+// ParseSigningKey parses privateKeyPEM generated by NewPairEd25519(),
+// or any ed25519 private key in PKCS#8 or OpenSSH format.
+func ParseSigningKey(privateKeyPEM string) (*SigningKey, error) {
+	privateKey, err := decodeEd25519Private(privateKeyPEM)
 	if err != nil {
-		return "", fmt.Errorf("decrypt: %w", err)
+		return nil, err
 	}
+	return newSigningKey(privateKey), nil
+}
 
-	return string(plaintext), nil
+func newSigningKey(privateKey ed25519.PrivateKey) *SigningKey {
+	return &SigningKey{
+		private: privateKey,
+		public:  newVerifyKey(privateKey.Public().(ed25519.PublicKey)),
+	}
 }
 
-// NewPairEd25519 generates a new Ed25519 key pair used to authenticate
-// clients requests to the server.
-// Returns: publicKeyPEM, privateKeyPEM, error.
-func NewPairEd25519() (string, string, error) {
-	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+// Sign signs message, returning the raw signature. It never fails; the
+// error satisfies Signer.
+func (k *SigningKey) Sign(message []byte) ([]byte, error) {
+	return ed25519.Sign(k.private, message), nil
+}
+
+// Public returns the matching verify key.
+func (k *SigningKey) Public() VerifyKey {
+	return k.public
+}
+
+// ParseVerifyKey parses publicKeyPEM generated by NewPairEd25519(),
+// or any ed25519 public key in PKIX format or as an authorized_keys line.
+func ParseVerifyKey(publicKeyPEM string) (VerifyKey, error) {
+	publicKey, err := decodeEd25519Public(publicKeyPEM)
 	if err != nil {
-		return "", "", fmt.Errorf("generate ked25519 ey pair: %w", err)
+		return VerifyKey{}, err
 	}
+	return newVerifyKey(publicKey), nil
+}
+
+// NewVerifyKey wraps a raw ed25519 public key, e.g. one held by a Signer
+// backend that never exposes its private key.
+func NewVerifyKey(publicKey ed25519.PublicKey) VerifyKey {
+	return newVerifyKey(publicKey)
+}
 
-	privateKeyPEM := pem.EncodeToMemory(&pem.Block{
-		Type:  "ED25519 PRIVATE KEY",
-		Bytes: privateKey.Seed(),
-	})
+func newVerifyKey(publicKey ed25519.PublicKey) VerifyKey {
+	return VerifyKey{key: publicKey, id: signingKeyID(publicKey)}
+}
 
-	publicKeyPEM := pem.EncodeToMemory(&pem.Block{
-		Type:  "ED25519 PUBLIC KEY",
-		Bytes: publicKey,
-	})
+// Verify reports whether signature is a valid signature of message.
+func (k VerifyKey) Verify(message, signature []byte) bool {
+	return ed25519.Verify(k.key, message, signature)
+}
 
-	return string(publicKeyPEM), string(privateKeyPEM), nil
+// ID returns the key ID, see signingKeyID().
+func (k VerifyKey) ID() string {
+	return k.id
 }
 
+// protocolVersion is the request format understood by the server.
+//   - 1: signature covered the plaintext secret name (no longer accepted)
+//   - 2: signature covers the ciphertext and the server key ID, so the
+//     server can authenticate a request before any private-key operation.
+//   - 3: requests name the signing key ID, so the server verifies against
+//     exactly one registered key instead of trying each in turn.
+const protocolVersion = 3
+
 // requestMessage builds the canonical string a client signs and the server
 // verifies. Binding the client encryption pubkey, timestamp, and a single-use
 // nonce into the signed material prevents an attacker from replaying a captured
 // request with a substituted ClientPubKey (which would otherwise leak the
 // secret to them), bounds the window in which any replay is accepted, and lets
 // the server reject exact replays within that window.
-func requestMessage(name, clientPubKey string, timestamp int64, nonce string) string {
-	return fmt.Sprintf("%s\n%s\n%d\n%s", name, clientPubKey, timestamp, nonce)
+//
+// The signature covers the encrypted payload rather than the plaintext name,
+// along with the ID of the server key it was encrypted to, so the server can
+// verify it (cheap) before decrypting (expensive). The signing key ID is
+// bound too, so it cannot be swapped to point at another registered key.
+func requestMessage(keyID, serverKeyID, payload, clientPubKey string, timestamp int64, nonce string) string {
+	return fmt.Sprintf("v%d\n%s\n%s\n%s\n%s\n%d\n%s",
+		protocolVersion, keyID, serverKeyID, payload, clientPubKey, timestamp, nonce,
+	)
+}
+
+// fingerprint returns a short, stable identifier for raw key bytes.
+func fingerprint(b []byte) string {
+	sum := sha256.Sum256(b)
+	return "SHA256:" + base64.RawStdEncoding.EncodeToString(sum[:])
+}
+
+// signingKeyID returns the key ID of an ed25519 public key: the fingerprint
+// of its raw bytes, independent of how the key is encoded.
+func signingKeyID(publicKey ed25519.PublicKey) string {
+	return fingerprint(publicKey)
 }
 
 // newNonce returns a base64-encoded random nonce used to make each request
@@ -128,38 +263,3 @@ func newNonce() (string, error) {
 	}
 	return base64.StdEncoding.EncodeToString(b), nil
 }
-
-// signEd25519 signs a message with privateKeyPEM generated by NewPairEd25519(),
-// and returns a base64 encoded signature.
-func signEd25519(privateKeyPEM, message string) (string, error) {
-	block, _ := pem.Decode([]byte(privateKeyPEM))
-	if block == nil || block.Type != "ED25519 PRIVATE KEY" {
-		return "", errors.New("failed to decode PEM block containing private key")
-	}
-
-	privateKey := ed25519.NewKeyFromSeed(block.Bytes)
-
-	signature := ed25519.Sign(privateKey, []byte(message))
-
-	return base64.StdEncoding.EncodeToString(signature), nil
-}
-
-// verifyEd25519 verifies a message with publicKeyPEM, generated by NewPairEd25519(),
-// and a base64 encoded signature produced by SignEd25519().
-func verifyEd25519(publicKeyPEM, message, signature string) (bool, error) {
-	block, _ := pem.Decode([]byte(publicKeyPEM))
-	if block == nil || block.Type != "ED25519 PUBLIC KEY" {
-		return false, errors.New("failed to decode PEM block containing public key")
-	}
-
-	publicKey := ed25519.PublicKey(block.Bytes)
-
-	signatureBytes, err := base64.StdEncoding.DecodeString(signature)
-	if err != nil {
-		return false, fmt.Errorf("decode signature: %w", err)
-	}
-
-	valid := ed25519.Verify(publicKey, []byte(message), signatureBytes)
-
-	return valid, nil
-}
@@ -1,6 +1,7 @@
 package locket
 
 import (
+	"encoding/base64"
 	"testing"
 
 	"github.com/stretchr/testify/require"
@@ -23,11 +24,10 @@ func TestRSA(t *testing.T) {
 	t.Logf("public key:\n%s", publicKeyPEM)
 	t.Logf("private key:\n%s", privateKeyPEM)
 
-	ciphertext, err := encryptRSA(publicKeyPEM, string(testCypher))
-	require.NoError(t, err)
+	ciphertext := testEncrypt(t, publicKeyPEM, string(testCypher))
 	t.Logf("ciphertext:\n%s", ciphertext)
 
-	plaintext, err := decryptRSA(privateKeyPEM, ciphertext)
+	plaintext, err := testDecrypt(t, privateKeyPEM, ciphertext)
 	require.NoError(t, err)
 	t.Logf("plaintext (decrypted):\n%s", plaintext)
 
@@ -41,12 +41,193 @@ func TestEd25519(t *testing.T) {
 	t.Logf("public key:\n%s", publicKey)
 	t.Logf("private key:\n%s", privateKey)
 
-	signature, err := signEd25519(privateKey, string(testCypher))
-	require.NoError(t, err)
+	signature := testSign(t, privateKey, string(testCypher))
 	t.Logf("signature:\n%s", signature)
 
-	match, err := verifyEd25519(publicKey, string(testCypher), signature)
+	verifyKey, err := ParseVerifyKey(publicKey)
+	require.NoError(t, err)
+	sig, err := base64.StdEncoding.DecodeString(signature)
 	require.NoError(t, err)
-	require.True(t, match)
+	require.True(t, verifyKey.Verify(testCypher, sig))
+	require.False(t, verifyKey.Verify([]byte("tampered"), sig))
 	t.Logf("signature verified")
 }
+
+// TestKeyRoundTrip confirms parsed keys serialize back to the same PEM and
+// that both halves of a pair agree on the key ID.
+func TestKeyRoundTrip(t *testing.T) {
+	publicKeyPEM, privateKeyPEM, err := newPairRSA(2048)
+	require.NoError(t, err)
+	decryptKey, err := parseDecryptionKey(privateKeyPEM)
+	require.NoError(t, err)
+	encryptKey, err := parseEncryptionKey(publicKeyPEM)
+	require.NoError(t, err)
+	require.Equal(t, privateKeyPEM, decryptKey.PEM())
+	require.Equal(t, publicKeyPEM, decryptKey.Public().PEM())
+	require.Equal(t, encryptKey.ID(), decryptKey.Public().ID())
+
+	pub, priv, err := NewPairEd25519()
+	require.NoError(t, err)
+	signingKey, err := ParseSigningKey(priv)
+	require.NoError(t, err)
+	verifyKey, err := ParseVerifyKey(pub)
+	require.NoError(t, err)
+	require.Equal(t, verifyKey.ID(), signingKey.Public().ID())
+
+	_, err = ParseSigningKey(pub)
+	require.Error(t, err)
+	_, err = ParseVerifyKey(priv)
+	require.Error(t, err)
+}
+
+// testEncrypt encrypts plaintext to publicKeyPEM, base64 encoded as on the wire.
+func testEncrypt(t testing.TB, publicKeyPEM, plaintext string) string {
+	t.Helper()
+	key, err := parseEncryptionKey(publicKeyPEM)
+	require.NoError(t, err)
+	ciphertext, err := key.Encrypt([]byte(plaintext))
+	require.NoError(t, err)
+	return base64.StdEncoding.EncodeToString(ciphertext)
+}
+
+// testDecrypt decrypts a base64 ciphertext with privateKeyPEM.
+func testDecrypt(t testing.TB, privateKeyPEM, ciphertext string) (string, error) {
+	t.Helper()
+	key, err := parseDecryptionKey(privateKeyPEM)
+	require.NoError(t, err)
+	b, err := base64.StdEncoding.DecodeString(ciphertext)
+	if err != nil {
+		return "", err
+	}
+	plaintext, err := key.Decrypt(b)
+	return string(plaintext), err
+}
+
+// testSign signs message with privateKeyPEM, base64 encoded as on the wire.
+func testSign(t testing.TB, privateKeyPEM, message string) string {
+	t.Helper()
+	key, err := ParseSigningKey(privateKeyPEM)
+	require.NoError(t, err)
+	sig, err := key.Sign([]byte(message))
+	require.NoError(t, err)
+	return base64.StdEncoding.EncodeToString(sig)
+}
+
+// The crypto benchmarks compare parsing PEM on every call (how every
+// operation used to work) against operating on keys parsed once.
+
+func BenchmarkDecrypt(b *testing.B) {
+	publicKeyPEM, privateKeyPEM, err := newPairRSA(2048)
+	require.NoError(b, err)
+	encryptKey, err := parseEncryptionKey(publicKeyPEM)
+	require.NoError(b, err)
+	ciphertext, err := encryptKey.Encrypt(testCypher[:64])
+	require.NoError(b, err)
+
+	b.Run("pem", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			key, err := parseDecryptionKey(privateKeyPEM)
+			if err != nil {
+				b.Fatal(err)
+			}
+			if _, err := key.Decrypt(ciphertext); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	key, err := parseDecryptionKey(privateKeyPEM)
+	require.NoError(b, err)
+	b.Run("parsed", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if _, err := key.Decrypt(ciphertext); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func BenchmarkEncrypt(b *testing.B) {
+	publicKeyPEM, _, err := newPairRSA(2048)
+	require.NoError(b, err)
+
+	b.Run("pem", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			key, err := parseEncryptionKey(publicKeyPEM)
+			if err != nil {
+				b.Fatal(err)
+			}
+			if _, err := key.Encrypt(testCypher[:64]); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	key, err := parseEncryptionKey(publicKeyPEM)
+	require.NoError(b, err)
+	b.Run("parsed", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if _, err := key.Encrypt(testCypher[:64]); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func BenchmarkSign(b *testing.B) {
+	_, privateKeyPEM, err := NewPairEd25519()
+	require.NoError(b, err)
+
+	b.Run("pem", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			key, err := ParseSigningKey(privateKeyPEM)
+			if err != nil {
+				b.Fatal(err)
+			}
+			key.Sign(testCypher)
+		}
+	})
+	key, err := ParseSigningKey(privateKeyPEM)
+	require.NoError(b, err)
+	b.Run("parsed", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			key.Sign(testCypher)
+		}
+	})
+}
+
+func BenchmarkVerify(b *testing.B) {
+	publicKeyPEM, privateKeyPEM, err := NewPairEd25519()
+	require.NoError(b, err)
+	signingKey, err := ParseSigningKey(privateKeyPEM)
+	require.NoError(b, err)
+	sig, err := signingKey.Sign(testCypher)
+	require.NoError(b, err)
+
+	b.Run("pem", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			key, err := ParseVerifyKey(publicKeyPEM)
+			if err != nil {
+				b.Fatal(err)
+			}
+			if !key.Verify(testCypher, sig) {
+				b.Fatal("verify")
+			}
+		}
+	})
+	key, err := ParseVerifyKey(publicKeyPEM)
+	require.NoError(b, err)
+	b.Run("parsed", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if !key.Verify(testCypher, sig) {
+				b.Fatal("verify")
+			}
+		}
+	})
+}
@@ -0,0 +1,160 @@
+package locket
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Discovery assigns the variables of an Env or Dotenv source to services
+// by name prefix, following the SERVICE1_FOO convention, so a new secret
+// needs no change to ServiceSecrets: with prefix SERVICE1, SERVICE1_FOO is
+// a secret of service1.
+//
+// Prefixes are matched case-insensitively, with any character not valid
+// in a variable name read as "_", so service "billing-api" discovers
+// BILLING_API_TOKEN. A variable matching several prefixes goes to the
+// longest; this and other collisions, and variables matching no prefix,
+// are logged at load time.
+type Discovery struct {
+	// Prefixes are the services to discover. If empty, NewServer uses
+	// the service names of the registry as loaded at startup.
+	Prefixes []string
+	// StripPrefix stores SERVICE1_FOO as FOO, so clients ask for FOO.
+	StripPrefix bool
+}
+
+// discoveryReport lists what Discovery.assign could not assign cleanly.
+type discoveryReport struct {
+	collisions []string // descriptions
+	unassigned []string // variable names
+}
+
+// assign returns vars assigned to services by prefix, keyed by lowercased
+// service name as sources do.
+func (d Discovery) assign(vars map[string]string) (map[string]Secrets, discoveryReport) {
+	var report discoveryReport
+	prefixes := make(map[string]string, len(d.Prefixes)) // service -> prefix
+	owners := make(map[string]string)                    // prefix -> service
+	for _, service := range d.Prefixes {
+		prefix := envPrefix(service)
+		if other, ok := owners[prefix]; ok && other != service {
+			report.collisions = append(report.collisions,
+				fmt.Sprintf("services %q and %q share prefix %s_, ignoring %q", other, service, prefix, service),
+			)
+			continue
+		}
+		owners[prefix] = service
+		prefixes[service] = prefix
+	}
+
+	secrets := make(map[string]Secrets)
+	from := make(map[string]string) // pool + "\x00" + secret name -> variable
+	for _, name := range sortedKeys(vars) {
+		upper := strings.ToUpper(name)
+		var matched []string
+		for service, prefix := range prefixes {
+			if strings.HasPrefix(upper, prefix+"_") {
+				matched = append(matched, service)
+			}
+		}
+		if len(matched) == 0 {
+			report.unassigned = append(report.unassigned, name)
+			continue
+		}
+		sort.Slice(matched, func(i, j int) bool {
+			if len(prefixes[matched[i]]) != len(prefixes[matched[j]]) {
+				return len(prefixes[matched[i]]) > len(prefixes[matched[j]])
+			}
+			return matched[i] < matched[j]
+		})
+		service := matched[0]
+		if len(matched) > 1 {
+			report.collisions = append(report.collisions,
+				fmt.Sprintf("%s matches services %q, assigned to %q", name, matched, service),
+			)
+		}
+		secret := name
+		if d.StripPrefix {
+			secret = name[len(prefixes[service])+1:]
+			if secret == "" {
+				report.unassigned = append(report.unassigned, name)
+				continue
+			}
+		}
+		pool := strings.ToLower(service)
+		if prev, ok := from[pool+"\x00"+secret]; ok {
+			report.collisions = append(report.collisions,
+				fmt.Sprintf("%s and %s are both %s of %q, keeping %s", prev, name, secret, service, name),
+			)
+		}
+		from[pool+"\x00"+secret] = name
+		if secrets[pool] == nil {
+			secrets[pool] = make(Secrets)
+		}
+		secrets[pool][secret] = vars[name]
+	}
+	return secrets, report
+}
+
+// envPrefix returns the variable name prefix of a service: its name in
+// upper case, with characters not valid in a variable name as "_".
+func envPrefix(service string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z':
+			return r - 'a' + 'A'
+		case r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '_':
+			return r
+		default:
+			return '_'
+		}
+	}, service)
+}
+
+// discover assigns vars per d, if set, into secrets, logging the report.
+// Unassigned variables are listed by name if listUnassigned, and only
+// counted otherwise, as for the environment, where most variables are
+// not secrets.
+func discover(d *Discovery, vars map[string]string, secrets map[string]Secrets, source string, listUnassigned bool) {
+	if d == nil {
+		return
+	}
+	found, report := d.assign(vars)
+	for pool, kvs := range found {
+		if secrets[pool] == nil {
+			secrets[pool] = make(Secrets)
+		}
+		for k, v := range kvs {
+			secrets[pool][k] = v
+		}
+	}
+	for _, c := range report.collisions {
+		log.Warn("secret discovery collision", "source", source, "collision", c)
+	}
+	args := []any{"source", source, "services", len(found), "unassigned", len(report.unassigned)}
+	if listUnassigned && len(report.unassigned) > 0 {
+		args = append(args, "unassigned_names", report.unassigned)
+		log.Warn("secrets discovered, some variables unassigned", args...)
+		return
+	}
+	log.Info("secrets discovered", args...)
+}
+
+// withRegistryPrefixes returns d, or, if it has no Prefixes, a copy
+// discovering the registry's services.
+func (s *Server) withRegistryPrefixes(d *Discovery) (*Discovery, error) {
+	if d == nil || len(d.Prefixes) > 0 {
+		return d, nil
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if len(s.entries) == 0 {
+		return nil, fmt.Errorf("discovery without prefixes needs registry entries")
+	}
+	found := *d
+	for _, e := range s.entries {
+		found.Prefixes = append(found.Prefixes, e.Name)
+	}
+	return &found, nil
+}
@@ -0,0 +1,92 @@
+package locket
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDiscoveryAssign(t *testing.T) {
+	vars := map[string]string{
+		"SERVICE1_FOO":     "a",
+		"SERVICE1_BAR":     "b",
+		"SERVICE1_X_FOO":   "c", // both SERVICE1 and SERVICE1_X match
+		"BILLING_API_KEY":  "d",
+		"Service1_FOO":     "e", // same as SERVICE1_FOO once stripped
+		"PATH":             "/bin",
+		"SERVICE2_":        "f", // nothing after the prefix
+		"SERVICE2_PRESENT": "g",
+	}
+	t.Run("keep prefix", func(t *testing.T) {
+		d := Discovery{Prefixes: []string{"SERVICE1", "service1-x", "billing-api", "Service2"}}
+		secrets, report := d.assign(vars)
+		require.Equal(t, map[string]Secrets{
+			"service1":    {"SERVICE1_FOO": "a", "SERVICE1_BAR": "b", "Service1_FOO": "e"},
+			"service1-x":  {"SERVICE1_X_FOO": "c"},
+			"billing-api": {"BILLING_API_KEY": "d"},
+			"service2":    {"SERVICE2_": "f", "SERVICE2_PRESENT": "g"},
+		}, secrets)
+		require.Len(t, report.collisions, 1)
+		require.Contains(t, report.collisions[0], "SERVICE1_X_FOO")
+		require.Equal(t, []string{"PATH"}, report.unassigned)
+	})
+	t.Run("strip prefix", func(t *testing.T) {
+		d := Discovery{Prefixes: []string{"SERVICE1", "service1-x", "billing-api", "Service2"}, StripPrefix: true}
+		secrets, report := d.assign(vars)
+		require.Equal(t, map[string]Secrets{
+			"service1":    {"FOO": "e", "BAR": "b"},
+			"service1-x":  {"FOO": "c"},
+			"billing-api": {"KEY": "d"},
+			"service2":    {"PRESENT": "g"},
+		}, secrets)
+		require.Len(t, report.collisions, 2)
+		require.Contains(t, report.collisions[1], "SERVICE1_FOO and Service1_FOO")
+		require.Equal(t, []string{"PATH", "SERVICE2_"}, report.unassigned)
+	})
+	t.Run("shared prefix", func(t *testing.T) {
+		d := Discovery{Prefixes: []string{"svc-a", "svc.a"}}
+		secrets, report := d.assign(map[string]string{"SVC_A_FOO": "a"})
+		require.Equal(t, map[string]Secrets{"svc-a": {"SVC_A_FOO": "a"}}, secrets)
+		require.Len(t, report.collisions, 1)
+	})
+}
+
+func TestDotenvDiscovery(t *testing.T) {
+	path := filepath.Join(t.TempDir(), ".env")
+	require.NoError(t, os.WriteFile(path, []byte("SERVICE1_FOO=a\nSERVICE2_FOO=b\nOTHER=c\n"), 0o600))
+
+	source := Dotenv{
+		Path:           path,
+		ServiceSecrets: map[string][]string{"service3": {"OTHER"}},
+		Discover:       &Discovery{Prefixes: []string{"service1", "service2"}, StripPrefix: true},
+	}
+	secrets, err := source.Load()
+	require.NoError(t, err)
+	require.Equal(t, map[string]Secrets{
+		"service1": {"FOO": "a"},
+		"service2": {"FOO": "b"},
+		"service3": {"OTHER": "c"},
+	}, secrets)
+}
+
+func TestEnvDiscovery(t *testing.T) {
+	t.Setenv("LOCKETDISCOVERY_TOKEN", "a")
+	source := Env{Discover: &Discovery{Prefixes: []string{"locketdiscovery"}}}
+	secrets, err := source.Load()
+	require.NoError(t, err)
+	require.Equal(t, Secrets{"LOCKETDISCOVERY_TOKEN": "a"}, secrets["locketdiscovery"])
+}
+
+func TestWithRegistryPrefixes(t *testing.T) {
+	s := &Server{entries: []RegEntry{{Name: "service1"}, {Name: "service2"}}}
+	d := &Discovery{StripPrefix: true}
+	found, err := s.withRegistryPrefixes(d)
+	require.NoError(t, err)
+	require.Equal(t, []string{"service1", "service2"}, found.Prefixes)
+	require.Empty(t, d.Prefixes, "caller's discovery is not modified")
+
+	_, err = (&Server{}).withRegistryPrefixes(d)
+	require.Error(t, err)
+}
@@ -0,0 +1,423 @@
+package locket
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+)
+
+/*
+Dotenv files follow the common grammar of dotenv libraries and shells:
+
+	# a comment
+	export KEY=value          # "export " is optional; inline comment
+	PLAIN = value with spaces # surrounding whitespace is trimmed
+	SINGLE='literal $, \n and "quotes"'
+	DOUBLE="escapes: \n \t \" \\ \$, and ${OTHER} if interpolating"
+	MULTI="a value
+	across lines"
+
+  - unquoted values end at the line's end or at a " #" comment; quotes
+    within them are kept
+  - single-quoted values are literal, and may span lines
+  - double-quoted values may span lines, and interpret the escapes \n, \r,
+    \t, \", \\, \$ and \xHH (a byte, in two hex digits); any other
+    backslash is kept
+  - ${VAR} and ${VAR:-default} are replaced, in unquoted and double-quoted
+    values, only when interpolating (see Dotenv.Interpolate), by an earlier
+    variable of the file or else the environment; $ alone is literal
+  - a later assignment of a key replaces an earlier one
+
+MarshalDotenv writes values so UnmarshalDotenv reads them back exactly.
+*/
+
+// dotenvKeyPattern is the pattern dotenv keys must match.
+var dotenvKeyPattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_.-]*$`)
+
+// dotenvPlainValue matches values written unquoted by MarshalDotenv.
+var dotenvPlainValue = regexp.MustCompile(`^[A-Za-z0-9_./:@%+=,-]+$`)
+
+// DotenvError is a syntax error in a dotenv file.
+type DotenvError struct {
+	Line   int // 1-based
+	Column int // 1-based, in characters
+	Msg    string
+}
+
+func (e *DotenvError) Error() string {
+	return fmt.Sprintf("line %d, column %d: %s", e.Line, e.Column, e.Msg)
+}
+
+// UnmarshalDotenv parses a dotenv file, without interpolation.
+func UnmarshalDotenv(data []byte) (map[string]string, error) {
+	return parseDotenv(data, nil)
+}
+
+// MarshalDotenv formats vars as a dotenv file, sorted by key. Values are
+// written unquoted if plain, or else double-quoted with escapes, on one
+// line each, as also read by systemd's EnvironmentFile=. Bytes that are
+// not valid UTF-8 are written as \xHH escapes, so any value reads back
+// unchanged.
+func MarshalDotenv(vars map[string]string) ([]byte, error) {
+	var b bytes.Buffer
+	for _, key := range sortedKeys(vars) {
+		if !dotenvKeyPattern.MatchString(key) {
+			return nil, fmt.Errorf("key %q does not match %s", key, dotenvKeyPattern)
+		}
+		value := vars[key]
+		b.WriteString(key + "=")
+		if value == "" || dotenvPlainValue.MatchString(value) {
+			b.WriteString(value + "\n")
+			continue
+		}
+		b.WriteByte('"')
+		for i := 0; i < len(value); {
+			r, size := utf8.DecodeRuneInString(value[i:])
+			if r == utf8.RuneError && size == 1 {
+				fmt.Fprintf(&b, `\x%02x`, value[i])
+				i++
+				continue
+			}
+			i += size
+			switch r {
+			case '\n':
+				b.WriteString(`\n`)
+			case '\r':
+				b.WriteString(`\r`)
+			case '\t':
+				b.WriteString(`\t`)
+			case '"', '\\', '$':
+				b.WriteByte('\\')
+				b.WriteRune(r)
+			default:
+				b.WriteRune(r)
+			}
+		}
+		b.WriteString("\"\n")
+	}
+	return b.Bytes(), nil
+}
+
+// parseDotenv parses a dotenv file. If lookup is set, ${VAR} references
+// are interpolated, from earlier variables or else lookup.
+func parseDotenv(data []byte, lookup func(string) (string, bool)) (map[string]string, error) {
+	p := dotenvParser{data: data, line: 1, lookup: lookup, vars: make(map[string]string)}
+	if err := p.parse(); err != nil {
+		return nil, err
+	}
+	return p.vars, nil
+}
+
+// dotenvParser holds the state of parseDotenv.
+type dotenvParser struct {
+	data      []byte
+	pos       int
+	line      int // of pos
+	lineStart int // offset of the line's first byte
+	lookup    func(string) (string, bool)
+	vars      map[string]string
+}
+
+// errorf returns a DotenvError at the current position.
+func (p *dotenvParser) errorf(format string, args ...any) error {
+	return p.errorAt(p.line, p.lineStart, p.pos, format, args...)
+}
+
+// errorAt returns a DotenvError at offset pos of the line starting at
+// lineStart.
+func (p *dotenvParser) errorAt(line, lineStart, pos int, format string, args ...any) error {
+	return &DotenvError{
+		Line:   line,
+		Column: utf8.RuneCount(p.data[lineStart:pos]) + 1,
+		Msg:    fmt.Sprintf(format, args...),
+	}
+}
+
+func (p *dotenvParser) eof() bool {
+	return p.pos >= len(p.data)
+}
+
+func (p *dotenvParser) peek() byte {
+	if p.eof() {
+		return 0
+	}
+	return p.data[p.pos]
+}
+
+// next consumes one byte, keeping track of lines.
+func (p *dotenvParser) next() byte {
+	c := p.data[p.pos]
+	p.pos++
+	if c == '\n' {
+		p.line++
+		p.lineStart = p.pos
+	}
+	return c
+}
+
+// skipSpace consumes spaces and tabs.
+func (p *dotenvParser) skipSpace() {
+	for c := p.peek(); c == ' ' || c == '\t'; c = p.peek() {
+		p.next()
+	}
+}
+
+// skipLine consumes the rest of the line, including its newline.
+func (p *dotenvParser) skipLine() {
+	for !p.eof() {
+		if p.next() == '\n' {
+			return
+		}
+	}
+}
+
+// endLine consumes trailing whitespace and an optional comment up to the
+// end of the line, refusing anything else.
+func (p *dotenvParser) endLine() error {
+	p.skipSpace()
+	switch p.peek() {
+	case 0, '\n', '#':
+		p.skipLine()
+		return nil
+	case '\r':
+		p.next()
+		if p.peek() == '\n' || p.eof() {
+			p.skipLine()
+			return nil
+		}
+	}
+	return p.errorf("unexpected %q after value", p.peek())
+}
+
+func (p *dotenvParser) parse() error {
+	for !p.eof() {
+		p.skipSpace()
+		switch p.peek() {
+		case '\n', '\r', '#':
+			p.skipLine()
+			continue
+		case 0:
+			if p.eof() {
+				return nil
+			}
+		}
+		if err := p.assignment(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// assignment parses a KEY=value line.
+func (p *dotenvParser) assignment() error {
+	key := p.word()
+	if key == "export" && (p.peek() == ' ' || p.peek() == '\t') {
+		p.skipSpace()
+		key = p.word()
+	}
+	if !dotenvKeyPattern.MatchString(key) {
+		return p.errorAt(p.line, p.lineStart, p.pos-len(key), "invalid key %q", key)
+	}
+	p.skipSpace()
+	if p.peek() != '=' {
+		return p.errorf("expected = after %s", key)
+	}
+	p.next()
+	p.skipSpace()
+
+	var value string
+	var err error
+	switch p.peek() {
+	case '\'':
+		value, err = p.singleQuoted()
+	case '"':
+		value, err = p.doubleQuoted()
+	default:
+		value, err = p.unquoted()
+	}
+	if err != nil {
+		return err
+	}
+	p.vars[key] = value
+	return nil
+}
+
+// word consumes bytes up to whitespace, "=" or a line end.
+func (p *dotenvParser) word() string {
+	start := p.pos
+	for !p.eof() {
+		switch p.peek() {
+		case ' ', '\t', '=', '\n', '\r':
+			return string(p.data[start:p.pos])
+		}
+		p.next()
+	}
+	return string(p.data[start:p.pos])
+}
+
+// singleQuoted parses a literal '...' value.
+func (p *dotenvParser) singleQuoted() (string, error) {
+	line, lineStart, start := p.line, p.lineStart, p.pos
+	p.next()
+	for !p.eof() {
+		if p.peek() == '\'' {
+			value := string(p.data[start+1 : p.pos])
+			p.next()
+			return value, p.endLine()
+		}
+		p.next()
+	}
+	return "", p.errorAt(line, lineStart, start, "unterminated single-quoted value")
+}
+
+// doubleQuoted parses a "..." value with escapes and interpolation.
+func (p *dotenvParser) doubleQuoted() (string, error) {
+	line, lineStart, start := p.line, p.lineStart, p.pos
+	p.next()
+	var b strings.Builder
+	for !p.eof() {
+		switch c := p.peek(); c {
+		case '"':
+			p.next()
+			return b.String(), p.endLine()
+		case '\\':
+			p.next()
+			switch e := p.peek(); e {
+			case 'n':
+				b.WriteByte('\n')
+			case 'r':
+				b.WriteByte('\r')
+			case 't':
+				b.WriteByte('\t')
+			case '"', '\\', '$':
+				b.WriteByte(e)
+			case 'x':
+				if c, ok := p.hexByte(); ok {
+					b.WriteByte(c)
+					continue
+				}
+				b.WriteByte('\\')
+				continue
+			default:
+				// not an escape, keep the backslash
+				b.WriteByte('\\')
+				continue
+			}
+			p.next()
+		case '$':
+			s, err := p.reference()
+			if err != nil {
+				return "", err
+			}
+			b.WriteString(s)
+		default:
+			b.WriteByte(p.next())
+		}
+	}
+	return "", p.errorAt(line, lineStart, start, "unterminated double-quoted value")
+}
+
+// hexByte consumes the "xHH" of a \xHH escape, if the two bytes after the
+// x are hex digits, returning the byte they encode.
+func (p *dotenvParser) hexByte() (byte, bool) {
+	if p.pos+3 > len(p.data) {
+		return 0, false
+	}
+	var c byte
+	for _, h := range p.data[p.pos+1 : p.pos+3] {
+		switch {
+		case h >= '0' && h <= '9':
+			c = c<<4 | (h - '0')
+		case h >= 'a' && h <= 'f':
+			c = c<<4 | (h - 'a' + 10)
+		case h >= 'A' && h <= 'F':
+			c = c<<4 | (h - 'A' + 10)
+		default:
+			return 0, false
+		}
+	}
+	p.pos += 3
+	return c, true
+}
+
+// unquoted parses a value running to the line's end or a " #" comment.
+func (p *dotenvParser) unquoted() (string, error) {
+	var b strings.Builder
+	for !p.eof() {
+		c := p.peek()
+		if c == '\n' || (c == '\r' && (p.pos+1 == len(p.data) || p.data[p.pos+1] == '\n')) {
+			break
+		}
+		if c == '#' && (b.Len() == 0 || isSpace(b.String()[b.Len()-1])) {
+			break
+		}
+		if c == '$' {
+			s, err := p.reference()
+			if err != nil {
+				return "", err
+			}
+			b.WriteString(s)
+			continue
+		}
+		b.WriteByte(p.next())
+	}
+	p.skipLine()
+	return strings.TrimRight(b.String(), " \t"), nil
+}
+
+func isSpace(c byte) bool {
+	return c == ' ' || c == '\t'
+}
+
+// reference consumes a "$", and, when interpolating, a ${VAR} or
+// ${VAR:-default} following it, returning its value.
+func (p *dotenvParser) reference() (string, error) {
+	line, lineStart, start := p.line, p.lineStart, p.pos
+	p.next()
+	if p.lookup == nil || p.peek() != '{' {
+		return "$", nil
+	}
+	end := bytes.IndexByte(p.data[p.pos:], '}')
+	if nl := bytes.IndexByte(p.data[p.pos:], '\n'); end == -1 || (nl != -1 && nl < end) {
+		return "", p.errorAt(line, lineStart, start, "unterminated ${")
+	}
+	ref := string(p.data[p.pos+1 : p.pos+end])
+	name, def, hasDefault := strings.Cut(ref, ":-")
+	if !dotenvKeyPattern.MatchString(name) {
+		return "", p.errorAt(line, lineStart, start, "invalid reference ${%s}", ref)
+	}
+	for i := 0; i <= end; i++ {
+		p.next()
+	}
+	if value, ok := p.vars[name]; ok && (value != "" || !hasDefault) {
+		return value, nil
+	}
+	if value, ok := p.lookup(name); ok && (value != "" || !hasDefault) {
+		return value, nil
+	}
+	if hasDefault {
+		return def, nil
+	}
+	return "", p.errorAt(line, lineStart, start, "${%s} is not set", name)
+}
+
+// readDotenv reads and parses the dotenv file at path, interpolating from
+// the environment if interpolate is set.
+func readDotenv(path string, interpolate bool) (map[string]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read file %q: %w", path, err)
+	}
+	var lookup func(string) (string, bool)
+	if interpolate {
+		lookup = os.LookupEnv
+	}
+	vars, err := parseDotenv(data, lookup)
+	if err != nil {
+		return nil, fmt.Errorf("parse %s: %w", path, err)
+	}
+	return vars, nil
+}
@@ -0,0 +1,164 @@
+package locket
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+// DotenvDir satisfies the source interface, loading secrets from a
+// directory of dotenv files, named for the service they are for, so no
+// ServiceSecrets are needed. Files are layered, each setting keys over
+// the ones before it:
+//  1. common.env: shared by every service
+//  2. common.<environment>.env
+//  3. <service>.env
+//  4. <service>.<environment>.env
+//
+// The <environment> files are read only if Environment is set to it.
+// Every <service>.env file makes a service, as does a
+// <service>.<Environment>.env file alone; <service>.<other>.env is an
+// overlay of another environment, and ignored, if <service>.env exists,
+// or else a service named "<service>.<other>". Overlays of common for
+// other environments, dotfiles, subdirectories and files not ending in
+// .env are ignored.
+//
+// Files must not be accessible to other users, that is, have no
+// permission bits for "other" set (not checked on Windows).
+// See dotenv.go for the file format.
+type DotenvDir struct {
+	Path        string // directory of .env files
+	Environment string // selects <service>.<environment>.env overlays, e.g. "prod"
+	Interpolate bool   // replace ${VAR} from earlier layers or the environment
+}
+
+const (
+	dotenvExt    = ".env"
+	dotenvCommon = "common"
+)
+
+// Load reads every service's layers.
+func (d DotenvDir) Load() (map[string]Secrets, error) {
+	files, err := os.ReadDir(d.Path)
+	if err != nil {
+		return nil, fmt.Errorf("read dir: %w", err)
+	}
+	names := make(map[string]bool) // file names without .env
+	for _, f := range files {
+		name, ok := strings.CutSuffix(f.Name(), dotenvExt)
+		if !ok || name == "" || strings.HasPrefix(name, ".") || f.IsDir() {
+			continue
+		}
+		names[name] = true
+	}
+
+	services := make(map[string]bool)
+	for name := range names {
+		if name == dotenvCommon || strings.HasPrefix(name, dotenvCommon+".") {
+			continue
+		}
+		if d.Environment != "" {
+			if service, ok := strings.CutSuffix(name, "."+d.Environment); ok {
+				services[service] = true
+				continue
+			}
+		}
+		if i := strings.LastIndex(name, "."); i > 0 && names[name[:i]] {
+			log.Debug("skipping dotenv overlay of another environment", "dir", d.Path, "file", name+dotenvExt)
+			continue
+		}
+		services[name] = true
+	}
+
+	layers := []string{dotenvCommon}
+	if d.Environment != "" {
+		layers = append(layers, dotenvCommon+"."+d.Environment)
+	}
+	common, err := d.readLayers(layers, names, nil)
+	if err != nil {
+		return nil, err
+	}
+	secrets := make(map[string]Secrets, len(services))
+	for _, service := range sortedKeys(services) {
+		layers := []string{service}
+		if d.Environment != "" {
+			layers = append(layers, service+"."+d.Environment)
+		}
+		vars, err := d.readLayers(layers, names, common)
+		if err != nil {
+			return nil, err
+		}
+		pool := strings.ToLower(service)
+		if _, ok := secrets[pool]; ok {
+			return nil, fmt.Errorf("service %q: more than one file set, names differ only in case", pool)
+		}
+		secrets[pool] = vars
+		log.Debug("loaded dotenv service", "dir", d.Path, "service", pool, "qty", len(vars))
+	}
+	return secrets, nil
+}
+
+// readLayers reads the files of layers that exist in names, in order,
+// over a copy of base.
+func (d DotenvDir) readLayers(layers []string, names map[string]bool, base Secrets) (Secrets, error) {
+	vars := make(Secrets, len(base))
+	for k, v := range base {
+		vars[k] = v
+	}
+	for _, layer := range layers {
+		if !names[layer] {
+			continue
+		}
+		path := filepath.Join(d.Path, layer+dotenvExt)
+		data, err := readPrivateFile(path, false)
+		if err != nil {
+			return nil, err
+		}
+		var lookup func(string) (string, bool)
+		if d.Interpolate {
+			lookup = func(name string) (string, bool) {
+				if v, ok := vars[name]; ok {
+					return v, true
+				}
+				return os.LookupEnv(name)
+			}
+		}
+		layerVars, err := parseDotenv(data, lookup)
+		if err != nil {
+			return nil, fmt.Errorf("parse %s: %w", path, err)
+		}
+		for k, v := range layerVars {
+			vars[k] = v
+		}
+	}
+	return vars, nil
+}
+
+// readPrivateFile reads the file at path, refusing it if other users may
+// access it, or, if allowOtherRead, write it.
+func readPrivateFile(path string, allowOtherRead bool) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("open %q: %w", path, err)
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return nil, fmt.Errorf("stat %q: %w", path, err)
+	}
+	denied := os.FileMode(0o007)
+	if allowOtherRead {
+		denied = 0o003
+	}
+	if perm := info.Mode().Perm(); runtime.GOOS != "windows" && perm&denied != 0 {
+		return nil, fmt.Errorf("%s has mode %v, accessible to other users: chmod o-rwx it", path, perm)
+	}
+	data, err := io.ReadAll(f)
+	if err != nil {
+		return nil, fmt.Errorf("read %q: %w", path, err)
+	}
+	return data, nil
+}
@@ -0,0 +1,76 @@
+package locket
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// writeDotenvDir writes files to a new directory with mode 0600.
+func writeDotenvDir(t *testing.T, files map[string]string) string {
+	t.Helper()
+	dir := t.TempDir()
+	for name, content := range files {
+		require.NoError(t, os.WriteFile(filepath.Join(dir, name), []byte(content), 0o600))
+	}
+	return dir
+}
+
+func TestDotenvDir(t *testing.T) {
+	dir := writeDotenvDir(t, map[string]string{
+		"common.env":         "LEVEL=common\nREGION=eu\nURL=https://${REGION}.example.com\n",
+		"common.prod.env":    "LEVEL=common.prod\n",
+		"service1.env":       "LEVEL=service1\nFOO=bar\n",
+		"service1.prod.env":  "LEVEL=service1.prod\n",
+		"service1.dev.env":   "FOO=dev\n",
+		"Service2.env":       "REGION=us\nURL=https://${REGION}.example.com\n",
+		"service3.prod.env":  "BAZ=qux\n",
+		".hidden.env":        "X=1\n",
+		"notes.txt":          "X=1\n",
+		"common.staging.env": "LEVEL=staging\n",
+	})
+	require.NoError(t, os.Mkdir(filepath.Join(dir, "sub.env"), 0o700))
+
+	t.Run("prod", func(t *testing.T) {
+		secrets, err := DotenvDir{Path: dir, Environment: "prod", Interpolate: true}.Load()
+		require.NoError(t, err)
+		require.Equal(t, map[string]Secrets{
+			"service1": {"LEVEL": "service1.prod", "REGION": "eu", "URL": "https://eu.example.com", "FOO": "bar"},
+			"service2": {"LEVEL": "common.prod", "REGION": "us", "URL": "https://us.example.com"},
+			"service3": {"LEVEL": "common.prod", "REGION": "eu", "URL": "https://eu.example.com", "BAZ": "qux"},
+		}, secrets)
+	})
+	t.Run("no environment", func(t *testing.T) {
+		secrets, err := DotenvDir{Path: dir}.Load()
+		require.NoError(t, err)
+		require.Equal(t, map[string]Secrets{
+			"service1":      {"LEVEL": "service1", "REGION": "eu", "URL": "https://${REGION}.example.com", "FOO": "bar"},
+			"service2":      {"LEVEL": "common", "REGION": "us", "URL": "https://${REGION}.example.com"},
+			"service3.prod": {"LEVEL": "common", "REGION": "eu", "URL": "https://${REGION}.example.com", "BAZ": "qux"},
+		}, secrets)
+	})
+}
+
+func TestDotenvDirErrors(t *testing.T) {
+	t.Run("parse error", func(t *testing.T) {
+		dir := writeDotenvDir(t, map[string]string{"service1.env": "FOO='bar\n"})
+		_, err := DotenvDir{Path: dir}.Load()
+		require.ErrorContains(t, err, "service1.env")
+	})
+	t.Run("missing dir", func(t *testing.T) {
+		_, err := DotenvDir{Path: filepath.Join(t.TempDir(), "missing")}.Load()
+		require.Error(t, err)
+	})
+	t.Run("world readable", func(t *testing.T) {
+		if runtime.GOOS == "windows" {
+			t.Skip("permissions are not checked on windows")
+		}
+		dir := writeDotenvDir(t, map[string]string{"service1.env": "FOO=bar\n"})
+		require.NoError(t, os.Chmod(filepath.Join(dir, "service1.env"), 0o644))
+		_, err := DotenvDir{Path: dir}.Load()
+		require.ErrorContains(t, err, "accessible to other users")
+	})
+}
@@ -0,0 +1,142 @@
+package locket
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestUnmarshalDotenv(t *testing.T) {
+	data := `# comment
+export EXPORTED=yes
+  SPACED = value with spaces   # comment
+HASH=pass#word
+EMPTY=
+EMPTY_COMMENT= # nothing
+SINGLE='it''s'
+SINGLE_LITERAL='a\nb $HOME ${HOME} "q"'
+DOUBLE="a\nb\tc \"q\" \\ \$ \d 'x' # not a comment"
+QUOTE_INSIDE=it's "fine"
+MULTI_SINGLE='line1
+line2'
+MULTI_DOUBLE="line1
+line2" # trailing comment
+HEX="\x41\xff \xZZ \x4"
+CRLF=value` + "\r\n" + `DOLLAR=pa$$word
+DUP=first
+DUP=second
+`
+	vars, err := UnmarshalDotenv([]byte(data))
+	require.Error(t, err, "SINGLE='it''s' leaves s' after the value")
+
+	data = strings.Replace(data, "SINGLE='it''s'\n", "", 1)
+	vars, err = UnmarshalDotenv([]byte(data))
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{
+		"EXPORTED":       "yes",
+		"SPACED":         "value with spaces",
+		"HASH":           "pass#word",
+		"EMPTY":          "",
+		"EMPTY_COMMENT":  "",
+		"SINGLE_LITERAL": `a\nb $HOME ${HOME} "q"`,
+		"DOUBLE":         "a\nb\tc \"q\" \\ $ \\d 'x' # not a comment",
+		"QUOTE_INSIDE":   `it's "fine"`,
+		"MULTI_SINGLE":   "line1\nline2",
+		"MULTI_DOUBLE":   "line1\nline2",
+		"HEX":            "A\xff \\xZZ \\x4",
+		"CRLF":           "value",
+		"DOLLAR":         "pa$$word",
+		"DUP":            "second",
+	}, vars)
+}
+
+func TestUnmarshalDotenvErrors(t *testing.T) {
+	tests := []struct {
+		data         string
+		line, column int
+	}{
+		{"A=1\nnot a line\n", 2, 5},
+		{"A=1\n1BAD=x\n", 2, 1},
+		{"A=1\nB='open\nstill open\n", 2, 3},
+		{"A=\"x\" trailing\n", 1, 7},
+		{"é=1\n", 1, 1},
+		{"A=1\n  B=\"é\" x\n", 2, 9},
+	}
+	for _, tt := range tests {
+		t.Run(tt.data, func(t *testing.T) {
+			_, err := UnmarshalDotenv([]byte(tt.data))
+			var derr *DotenvError
+			require.True(t, errors.As(err, &derr), "%v", err)
+			require.Equal(t, tt.line, derr.Line, derr.Error())
+			require.Equal(t, tt.column, derr.Column, derr.Error())
+		})
+	}
+}
+
+func TestDotenvInterpolate(t *testing.T) {
+	t.Setenv("LOCKET_TEST_HOST", "db.internal")
+	lookup := os.LookupEnv
+	vars, err := parseDotenv([]byte(`USER=admin
+URL="postgres://${USER}@${LOCKET_TEST_HOST}/${DB:-main}"
+PLAIN=${USER}-x
+LITERAL='${USER}'
+ESCAPED="\${USER}"
+`), lookup)
+	require.NoError(t, err)
+	require.Equal(t, "postgres://admin@db.internal/main", vars["URL"])
+	require.Equal(t, "admin-x", vars["PLAIN"])
+	require.Equal(t, "${USER}", vars["LITERAL"])
+	require.Equal(t, "${USER}", vars["ESCAPED"])
+
+	_, err = parseDotenv([]byte("A=${LOCKET_TEST_UNSET}\n"), lookup)
+	require.ErrorContains(t, err, "not set")
+	_, err = parseDotenv([]byte("A=\"${OPEN\"\n"), lookup)
+	require.ErrorContains(t, err, "unterminated")
+
+	path := filepath.Join(t.TempDir(), ".env")
+	require.NoError(t, os.WriteFile(path, []byte("SVC_URL=http://${LOCKET_TEST_HOST}\n"), 0o600))
+	source := Dotenv{Path: path, ServiceSecrets: map[string][]string{"svc": {"SVC_URL"}}}
+	secrets, err := source.Load()
+	require.NoError(t, err)
+	require.Equal(t, "http://${LOCKET_TEST_HOST}", secrets["svc"]["SVC_URL"])
+	source.Interpolate = true
+	secrets, err = source.Load()
+	require.NoError(t, err)
+	require.Equal(t, "http://db.internal", secrets["svc"]["SVC_URL"])
+}
+
+func TestMarshalDotenvRoundTrip(t *testing.T) {
+	_, priv, err := NewPairEd25519()
+	require.NoError(t, err)
+	vars := map[string]string{
+		"PLAIN":    "abc-123_./:@%+=,",
+		"EMPTY":    "",
+		"KEY":      priv,
+		"QUOTES":   `'single' "double"`,
+		"ESCAPES":  `\n is not a newline \\ \$ \"`,
+		"DOLLAR":   "${HOME} $PATH",
+		"HASH":     "a #b",
+		"SPACES":   "  padded  ",
+		"CONTROL":  "tab\tcr\r\x00nul",
+		"UNICODE":  "ünïcødé ✓",
+		"NEWLINES": "\n\nx\n",
+		"BINARY":   "\xff\xfe",
+		"MIXED":    "ok \x00\xc3 ✓ \xe2\x9c",
+		"HEX_TEXT": `\x41 stays text`,
+	}
+	data, err := MarshalDotenv(vars)
+	require.NoError(t, err)
+	got, err := UnmarshalDotenv(data)
+	require.NoError(t, err)
+	require.Equal(t, vars, got)
+	got, err = parseDotenv(data, os.LookupEnv)
+	require.NoError(t, err, "written values are not interpolated")
+	require.Equal(t, vars, got)
+
+	_, err = MarshalDotenv(map[string]string{"BAD KEY": "x"})
+	require.Error(t, err)
+}
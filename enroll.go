@@ -0,0 +1,295 @@
+package locket
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"sync"
+	"time"
+)
+
+/*
+Enrollment lets a new service instance register itself without an operator
+ever handling its private key:
+ 1. An admin issues a bootstrap token scoped to a service name
+    (Enroller.Issue) and hands it to the deploy system.
+ 2. The instance generates its own ed25519 key pair and presents the public
+    key with the token (Enroll).
+ 3. The server adds the key to the service's registry entry and burns the
+    token. The private key never leaves the instance.
+
+Tokens are short-lived and single-use. Only their SHA-256 is held, so a
+leaked token list cannot be replayed. Issuing, using, refusing and revoking
+tokens are all audit events.
+*/
+
+// PathEnroll is the API endpoint for enrollment.
+//   - POST: enroll a key (enrollRequest JSON body)
+var PathEnroll = "/locket/enroll"
+
+// EnrollToken describes an issued bootstrap token, never the token itself.
+type EnrollToken struct {
+	ID        string     `json:"id"` // stable reference for audit and Revoke
+	Service   string     `json:"service"`
+	IssuedAt  time.Time  `json:"issued_at"`
+	ExpiresAt time.Time  `json:"expires_at"`
+	UsedAt    *time.Time `json:"used_at,omitempty"`
+	KeyID     string     `json:"key_id,omitempty"` // key enrolled with the token
+	Revoked   bool       `json:"revoked,omitempty"`
+}
+
+// Enroller issues bootstrap tokens and enrolls keys presented with them into
+// a Registry. Tokens are held in memory, so are void after a restart, and
+// are forgotten once expired, used or not.
+type Enroller struct {
+	reg    Registry
+	mu     sync.Mutex
+	tokens map[string]*EnrollToken // sha256 of token -> token
+}
+
+// enrollRequest is the request format for the enrollment endpoint.
+type enrollRequest struct {
+	Token  string `json:"token"`
+	KeyPub string `json:"keypub"`
+}
+
+// enrollResponse reports the service a key was enrolled to.
+type enrollResponse struct {
+	Service string `json:"service"`
+	KeyID   string `json:"key_id"`
+}
+
+// errEnrollToken is returned for any unusable token, without saying why.
+var errEnrollToken = errors.New("invalid enrollment token")
+
+// NewEnroller returns an Enroller adding keys to reg.
+func NewEnroller(reg Registry) *Enroller {
+	return &Enroller{reg: reg, tokens: make(map[string]*EnrollToken)}
+}
+
+// Issue returns a new single-use token allowing one key to be enrolled for
+// service within ttl, along with the token's ID.
+func (e *Enroller) Issue(service string, ttl time.Duration) (string, string, error) {
+	if service == "" {
+		return "", "", errors.New("service name must not be empty")
+	}
+	if ttl <= 0 {
+		return "", "", errors.New("ttl must be positive")
+	}
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", "", fmt.Errorf("read random: %w", err)
+	}
+	token := base64.RawURLEncoding.EncodeToString(b)
+	hash := hashEnrollToken(token)
+	now := time.Now().UTC()
+	info := &EnrollToken{
+		ID:        hash[:16],
+		Service:   service,
+		IssuedAt:  now,
+		ExpiresAt: now.Add(ttl),
+	}
+
+	e.mu.Lock()
+	e.prune(now)
+	e.tokens[hash] = info
+	e.mu.Unlock()
+	audit("enrollment token issued",
+		"event", "enroll_token_issued",
+		"token_id", info.ID,
+		"service", service,
+		"expires_at", info.ExpiresAt,
+	)
+	return token, info.ID, nil
+}
+
+// Revoke voids the unused token with the given ID.
+func (e *Enroller) Revoke(id string) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for _, t := range e.tokens {
+		if t.ID != id {
+			continue
+		}
+		if t.UsedAt != nil {
+			return fmt.Errorf("token %s already used", id)
+		}
+		t.Revoked = true
+		audit("enrollment token revoked",
+			"event", "enroll_token_revoked",
+			"token_id", id,
+			"service", t.Service,
+		)
+		return nil
+	}
+	return fmt.Errorf("token %s not found", id)
+}
+
+// prune forgets expired tokens, which can no longer be used. The caller
+// must hold e.mu.
+func (e *Enroller) prune(now time.Time) {
+	for hash, t := range e.tokens {
+		if !now.Before(t.ExpiresAt) {
+			delete(e.tokens, hash)
+		}
+	}
+}
+
+// Tokens lists every issued token not yet expired, oldest first.
+func (e *Enroller) Tokens() []EnrollToken {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.prune(time.Now())
+	tokens := make([]EnrollToken, 0, len(e.tokens))
+	for _, t := range e.tokens {
+		tokens = append(tokens, *t)
+	}
+	sort.Slice(tokens, func(i, j int) bool {
+		return tokens[i].IssuedAt.Before(tokens[j].IssuedAt)
+	})
+	return tokens
+}
+
+// Enroll adds keyPub to the registry entry of the service token is scoped
+// to, creating the entry if needed, and burns the token. It returns the
+// service name.
+func (e *Enroller) Enroll(token, keyPub string) (string, error) {
+	key, err := ParseVerifyKey(keyPub)
+	if err != nil {
+		return "", fmt.Errorf("parse public key: %w", err)
+	}
+
+	// spend the token under the lock so concurrent requests cannot both
+	// use it, but write the registry, perhaps remotely, without it
+	e.mu.Lock()
+	t, ok := e.tokens[hashEnrollToken(token)]
+	now := time.Now().UTC()
+	var reason string
+	switch {
+	case !ok:
+		reason = "unknown"
+	case t.Revoked:
+		reason = "revoked"
+	case t.UsedAt != nil:
+		reason = "already used"
+	case !now.Before(t.ExpiresAt):
+		reason = "expired"
+	}
+	if reason != "" {
+		args := []any{"event", "enroll_token_refused", "reason", reason, "key_id", key.ID()}
+		if ok {
+			args = append(args, "token_id", t.ID, "service", t.Service)
+		}
+		e.prune(now)
+		e.mu.Unlock()
+		audit("enrollment token refused", args...)
+		return "", errEnrollToken
+	}
+	t.UsedAt = &now
+	t.KeyID = key.ID()
+	service, id := t.Service, t.ID
+	e.prune(now)
+	e.mu.Unlock()
+
+	rotator, ok := e.reg.(KeyRotator)
+	if !ok {
+		rotator = upsertRotator{reg: e.reg}
+	}
+	err = rotator.AddKey(service, RegKey{KeyPub: keyPub})
+	if err != nil {
+		// give the token back, so the instance can retry
+		e.mu.Lock()
+		t.UsedAt = nil
+		t.KeyID = ""
+		e.mu.Unlock()
+		return "", fmt.Errorf("add key: %w", err)
+	}
+	audit("key enrolled",
+		"event", "enroll_token_used",
+		"token_id", id,
+		"service", service,
+		"key_id", key.ID(),
+	)
+	return service, nil
+}
+
+// ServeHTTP serves the enrollment endpoint.
+func (e *Enroller) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req enrollRequest
+	r.Body = http.MaxBytesReader(w, r.Body, 1<<16)
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil || req.Token == "" || req.KeyPub == "" {
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+	service, err := e.Enroll(req.Token, req.KeyPub)
+	if errors.Is(err, errEnrollToken) {
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+	if err != nil {
+		log.Error("enroll", "ip", r.RemoteAddr, "error", err)
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+	key, _ := ParseVerifyKey(req.KeyPub)
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(enrollResponse{Service: service, KeyID: key.ID()})
+	if err != nil {
+		log.Error("encode enroll response", "error", err)
+	}
+}
+
+// hashEnrollToken returns the hex SHA-256 of token, as stored.
+func hashEnrollToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// Enroll generates a new ed25519 signing key pair locally and enrolls its
+// public key with the enrollment endpoint under baseURL using a bootstrap
+// token. It returns the service the key was enrolled to and the key pair,
+// ready for NewClient.
+// Returns: service, publicKeyPEM, privateKeyPEM, error.
+func Enroll(baseURL, token string) (string, string, string, error) {
+	pub, priv, err := NewPairEd25519()
+	if err != nil {
+		return "", "", "", fmt.Errorf("generate key pair: %w", err)
+	}
+	endpoint, err := url.JoinPath(baseURL, PathEnroll)
+	if err != nil {
+		return "", "", "", fmt.Errorf("join url: %w", err)
+	}
+	b, err := json.Marshal(enrollRequest{Token: token, KeyPub: pub})
+	if err != nil {
+		return "", "", "", fmt.Errorf("marshal: %w", err)
+	}
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Post(endpoint, "application/json", bytes.NewReader(b))
+	if err != nil {
+		return "", "", "", fmt.Errorf("do request: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", "", "", fmt.Errorf("not ok, status: %d", resp.StatusCode)
+	}
+	var enrolled enrollResponse
+	err = json.NewDecoder(resp.Body).Decode(&enrolled)
+	if err != nil {
+		return "", "", "", fmt.Errorf("decode response: %w", err)
+	}
+	return enrolled.Service, pub, priv, nil
+}
@@ -0,0 +1,183 @@
+package locket
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestEnrollEndToEnd(t *testing.T) {
+	reg := FileRegistry{Path: filepath.Join(t.TempDir(), "registry.yml")}
+	enroller := NewEnroller(reg)
+	mux := http.NewServeMux()
+	mux.Handle(PathEnroll, enroller)
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	token, id, err := enroller.Issue("SERVICE1", time.Minute)
+	require.NoError(t, err)
+
+	service, pub, priv, err := Enroll(srv.URL, token)
+	require.NoError(t, err)
+	require.Equal(t, "SERVICE1", service)
+	require.NotEmpty(t, priv)
+
+	entries, err := reg.Entries()
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	require.Equal(t, "SERVICE1", entries[0].Name)
+	require.Equal(t, pub, entries[0].AllKeys()[0].KeyPub)
+
+	// the enrolled key authenticates against a server over the registry
+	ts, server := newTestServerWith(t, reg)
+	clientPub, _, err := newPairRSA(Defaults.BitsizeRSA)
+	require.NoError(t, err)
+	req := craftRequest(t, server.key.Public().PEM(), priv, testSecretName, clientPub, time.Now().Unix())
+	resp, _ := postRequest(t, ts.URL, req)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	// single use
+	_, _, _, err = Enroll(srv.URL, token)
+	require.ErrorContains(t, err, "403")
+
+	tokens := enroller.Tokens()
+	require.Len(t, tokens, 1)
+	require.Equal(t, id, tokens[0].ID)
+	require.NotNil(t, tokens[0].UsedAt)
+	require.Equal(t, testKeyID(t, priv), tokens[0].KeyID)
+	require.Error(t, enroller.Revoke(id), "used tokens cannot be revoked")
+}
+
+func TestEnrollRefusesToken(t *testing.T) {
+	reg := FileRegistry{Path: filepath.Join(t.TempDir(), "registry.yml")}
+	enroller := NewEnroller(reg)
+	pub, _, err := NewPairEd25519()
+	require.NoError(t, err)
+
+	_, err = enroller.Enroll("unknown", pub)
+	require.ErrorIs(t, err, errEnrollToken)
+
+	revoked, id, err := enroller.Issue("svc", time.Minute)
+	require.NoError(t, err)
+	require.NoError(t, enroller.Revoke(id))
+	_, err = enroller.Enroll(revoked, pub)
+	require.ErrorIs(t, err, errEnrollToken)
+	require.Error(t, enroller.Revoke("missing"))
+
+	expired, _, err := enroller.Issue("svc", time.Nanosecond)
+	require.NoError(t, err)
+	time.Sleep(time.Millisecond)
+	_, err = enroller.Enroll(expired, pub)
+	require.ErrorIs(t, err, errEnrollToken)
+
+	// a bad key does not burn the token
+	token, _, err := enroller.Issue("svc", time.Minute)
+	require.NoError(t, err)
+	_, err = enroller.Enroll(token, "not a key")
+	require.Error(t, err)
+	_, err = enroller.Enroll(token, pub)
+	require.NoError(t, err)
+
+	_, _, err = enroller.Issue("", time.Minute)
+	require.Error(t, err)
+	_, _, err = enroller.Issue("svc", 0)
+	require.Error(t, err)
+
+	entries, err := reg.Entries()
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+}
+
+func TestEnrollTokenSingleUseConcurrent(t *testing.T) {
+	reg := FileRegistry{Path: filepath.Join(t.TempDir(), "registry.yml")}
+	enroller := NewEnroller(reg)
+	token, _, err := enroller.Issue("svc", time.Minute)
+	require.NoError(t, err)
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	succeeded := 0
+	for range 10 {
+		pub, _, err := NewPairEd25519()
+		require.NoError(t, err)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := enroller.Enroll(token, pub); err == nil {
+				mu.Lock()
+				succeeded++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	require.Equal(t, 1, succeeded)
+}
+
+// slowRegistry is a FileRegistry whose AddKey waits for release, then
+// fails if fail is set.
+type slowRegistry struct {
+	FileRegistry
+	release chan struct{}
+	fail    bool
+}
+
+func (r slowRegistry) AddKey(name string, key RegKey) error {
+	<-r.release
+	if r.fail {
+		return errors.New("registry down")
+	}
+	return r.FileRegistry.AddKey(name, key)
+}
+
+func TestEnrollRegistryWrite(t *testing.T) {
+	reg := slowRegistry{
+		FileRegistry: FileRegistry{Path: filepath.Join(t.TempDir(), "registry.yml")},
+		release:      make(chan struct{}),
+		fail:         true,
+	}
+	enroller := NewEnroller(reg)
+	token, _, err := enroller.Issue("svc", time.Minute)
+	require.NoError(t, err)
+	pub, _, err := NewPairEd25519()
+	require.NoError(t, err)
+
+	errs := make(chan error)
+	go func() {
+		_, err := enroller.Enroll(token, pub)
+		errs <- err
+	}()
+	// the registry write does not hold up the token list or a second use
+	require.Eventually(t, func() bool {
+		tokens := enroller.Tokens()
+		return len(tokens) == 1 && tokens[0].UsedAt != nil
+	}, 5*time.Second, time.Millisecond)
+	_, err = enroller.Enroll(token, pub)
+	require.ErrorIs(t, err, errEnrollToken)
+
+	// a failed write gives the token back
+	close(reg.release)
+	require.ErrorContains(t, <-errs, "registry down")
+	require.Nil(t, enroller.Tokens()[0].UsedAt)
+}
+
+func TestEnrollPrunesExpiredTokens(t *testing.T) {
+	enroller := NewEnroller(FileRegistry{Path: filepath.Join(t.TempDir(), "registry.yml")})
+	for range 3 {
+		_, _, err := enroller.Issue("svc", time.Nanosecond)
+		require.NoError(t, err)
+	}
+	time.Sleep(time.Millisecond)
+	_, _, err := enroller.Issue("svc", time.Minute)
+	require.NoError(t, err)
+	require.Len(t, enroller.Tokens(), 1)
+	enroller.mu.Lock()
+	require.Len(t, enroller.tokens, 1)
+	enroller.mu.Unlock()
+}
@@ -0,0 +1,300 @@
+package locket
+
+import (
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+/*
+Key encodings.
+
+Keys are emitted in standard encodings that openssl, ssh-keygen and other
+languages read and write:
+  - ed25519 private: PKCS#8 "PRIVATE KEY"
+  - ed25519 public: PKIX "PUBLIC KEY"
+  - RSA private: PKCS#8 "PRIVATE KEY"
+  - RSA public: PKIX "PUBLIC KEY"
+
+Accepted on input, in addition:
+  - ed25519 private: OpenSSH "OPENSSH PRIVATE KEY" (unencrypted)
+  - ed25519 public: an authorized_keys line ("ssh-ed25519 AAAA... comment")
+  - legacy locket encodings, see MigrateKeyPEM
+*/
+
+const (
+	pemPrivateKey = "PRIVATE KEY"         // PKCS#8
+	pemPublicKey  = "PUBLIC KEY"          // PKIX
+	pemOpenSSH    = "OPENSSH PRIVATE KEY" // OpenSSH private key format
+	pemRSAPrivate = "RSA PRIVATE KEY"     // PKCS#1
+
+	// legacy locket encodings: a raw ed25519 seed and raw public key under
+	// custom labels, and PKIX bytes mislabeled with the PKCS#1 label.
+	pemLegacyEd25519Private = "ED25519 PRIVATE KEY"
+	pemLegacyEd25519Public  = "ED25519 PUBLIC KEY"
+	pemLegacyRSAPublic      = "RSA PUBLIC KEY"
+)
+
+// encodePEM returns the PEM encoding of b under label.
+func encodePEM(label string, b []byte) string {
+	return string(pem.EncodeToMemory(&pem.Block{Type: label, Bytes: b}))
+}
+
+// decodeEd25519Private parses an ed25519 private key in any accepted
+// encoding.
+func decodeEd25519Private(privateKey string) (ed25519.PrivateKey, error) {
+	block, _ := pem.Decode([]byte(privateKey))
+	if block == nil {
+		return nil, errors.New("failed to decode PEM block containing private key")
+	}
+	switch block.Type {
+	case pemPrivateKey:
+		key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("parse PKCS#8: %w", err)
+		}
+		edKey, ok := key.(ed25519.PrivateKey)
+		if !ok {
+			return nil, fmt.Errorf("not an ed25519 private key: %T", key)
+		}
+		return edKey, nil
+	case pemOpenSSH:
+		key, err := ssh.ParseRawPrivateKey([]byte(privateKey))
+		if err != nil {
+			return nil, fmt.Errorf("parse OpenSSH: %w", err)
+		}
+		switch key := key.(type) {
+		case ed25519.PrivateKey:
+			return key, nil
+		case *ed25519.PrivateKey:
+			return *key, nil
+		default:
+			return nil, fmt.Errorf("not an ed25519 private key: %T", key)
+		}
+	case pemLegacyEd25519Private:
+		if len(block.Bytes) != ed25519.SeedSize {
+			return nil, fmt.Errorf("bad private key length %d", len(block.Bytes))
+		}
+		return ed25519.NewKeyFromSeed(block.Bytes), nil
+	default:
+		return nil, fmt.Errorf("unsupported private key type %q", block.Type)
+	}
+}
+
+// decodeEd25519Public parses an ed25519 public key in any accepted
+// encoding, including an authorized_keys line.
+func decodeEd25519Public(publicKey string) (ed25519.PublicKey, error) {
+	if strings.HasPrefix(strings.TrimSpace(publicKey), ssh.KeyAlgoED25519+" ") {
+		key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(publicKey))
+		if err != nil {
+			return nil, fmt.Errorf("parse authorized key: %w", err)
+		}
+		cryptoKey, ok := key.(ssh.CryptoPublicKey)
+		if !ok {
+			return nil, fmt.Errorf("unsupported ssh key type %q", key.Type())
+		}
+		edKey, ok := cryptoKey.CryptoPublicKey().(ed25519.PublicKey)
+		if !ok {
+			return nil, fmt.Errorf("not an ed25519 public key: %q", key.Type())
+		}
+		return edKey, nil
+	}
+
+	block, _ := pem.Decode([]byte(publicKey))
+	if block == nil {
+		return nil, errors.New("failed to decode PEM block containing public key")
+	}
+	switch block.Type {
+	case pemPublicKey:
+		key, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("parse PKIX: %w", err)
+		}
+		edKey, ok := key.(ed25519.PublicKey)
+		if !ok {
+			return nil, fmt.Errorf("not an ed25519 public key: %T", key)
+		}
+		return edKey, nil
+	case pemLegacyEd25519Public:
+		if len(block.Bytes) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("bad public key length %d", len(block.Bytes))
+		}
+		return ed25519.PublicKey(block.Bytes), nil
+	default:
+		return nil, fmt.Errorf("unsupported public key type %q", block.Type)
+	}
+}
+
+// decodeRSAPrivate parses an RSA private key, PKCS#8 or PKCS#1.
+func decodeRSAPrivate(privateKeyPEM string) (*rsa.PrivateKey, error) {
+	block, _ := pem.Decode([]byte(privateKeyPEM))
+	if block == nil {
+		return nil, errors.New("failed to decode PEM block containing private key")
+	}
+	switch block.Type {
+	case pemPrivateKey:
+		key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("parse PKCS#8: %w", err)
+		}
+		rsaKey, ok := key.(*rsa.PrivateKey)
+		if !ok {
+			return nil, fmt.Errorf("not an RSA private key: %T", key)
+		}
+		return rsaKey, nil
+	case pemRSAPrivate:
+		key, err := x509.ParsePKCS1PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("parse PKCS#1: %w", err)
+		}
+		return key, nil
+	default:
+		return nil, fmt.Errorf("unsupported private key type %q", block.Type)
+	}
+}
+
+// decodeRSAPublic parses an RSA public key, returning it with its PKIX
+// encoding (from which key IDs are derived). The legacy "RSA PUBLIC KEY"
+// label is accepted holding either PKIX (as locket used to emit) or
+// genuine PKCS#1 bytes (as other tools emit).
+func decodeRSAPublic(publicKeyPEM string) (*rsa.PublicKey, []byte, error) {
+	block, _ := pem.Decode([]byte(publicKeyPEM))
+	if block == nil {
+		return nil, nil, errors.New("decode PEM block containing public key")
+	}
+	switch block.Type {
+	case pemPublicKey, pemLegacyRSAPublic:
+	default:
+		return nil, nil, fmt.Errorf("unsupported public key type %q", block.Type)
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil && block.Type == pemLegacyRSAPublic {
+		pkcs1, pkcs1Err := x509.ParsePKCS1PublicKey(block.Bytes)
+		if pkcs1Err != nil {
+			return nil, nil, fmt.Errorf("parse public key: %w", err)
+		}
+		der, err := x509.MarshalPKIXPublicKey(pkcs1)
+		if err != nil {
+			return nil, nil, fmt.Errorf("marshal public key: %w", err)
+		}
+		return pkcs1, der, nil
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("parse public key: %w", err)
+	}
+	rsaKey, ok := key.(*rsa.PublicKey)
+	if !ok {
+		return nil, nil, errors.New("not RSA public key")
+	}
+	return rsaKey, block.Bytes, nil
+}
+
+// PEM encodes the key as PKCS#8 "PRIVATE KEY".
+func (k *SigningKey) PEM() string {
+	b, err := x509.MarshalPKCS8PrivateKey(k.private)
+	if err != nil {
+		// ed25519 keys always marshal
+		panic("marshal ed25519 private key: " + err.Error())
+	}
+	return encodePEM(pemPrivateKey, b)
+}
+
+// OpenSSH encodes the key in the OpenSSH private key format, as written
+// by ssh-keygen.
+func (k *SigningKey) OpenSSH(comment string) (string, error) {
+	block, err := ssh.MarshalPrivateKey(k.private, comment)
+	if err != nil {
+		return "", fmt.Errorf("marshal private key: %w", err)
+	}
+	return string(pem.EncodeToMemory(block)), nil
+}
+
+// PEM encodes the key as PKIX "PUBLIC KEY".
+func (k VerifyKey) PEM() string {
+	b, err := x509.MarshalPKIXPublicKey(k.key)
+	if err != nil {
+		// ed25519 keys always marshal
+		panic("marshal ed25519 public key: " + err.Error())
+	}
+	return encodePEM(pemPublicKey, b)
+}
+
+// AuthorizedKey encodes the key as an authorized_keys line,
+// e.g. "ssh-ed25519 AAAA...".
+func (k VerifyKey) AuthorizedKey() (string, error) {
+	sshKey, err := ssh.NewPublicKey(k.key)
+	if err != nil {
+		return "", fmt.Errorf("ssh public key: %w", err)
+	}
+	return strings.TrimSpace(string(ssh.MarshalAuthorizedKey(sshKey))), nil
+}
+
+// MigrateKeyPEM re-encodes an ed25519 key from the legacy locket encodings
+// ("ED25519 PUBLIC KEY", "ED25519 PRIVATE KEY") to the standard ones
+// (PKIX "PUBLIC KEY", PKCS#8 "PRIVATE KEY"). Keys in any other accepted
+// encoding are returned unchanged. The key ID is unaffected.
+func MigrateKeyPEM(key string) (string, error) {
+	block, _ := pem.Decode([]byte(key))
+	if block == nil {
+		return key, nil
+	}
+	switch block.Type {
+	case pemLegacyEd25519Public:
+		pub, err := decodeEd25519Public(key)
+		if err != nil {
+			return "", err
+		}
+		return newVerifyKey(pub).PEM(), nil
+	case pemLegacyEd25519Private:
+		priv, err := ParseSigningKey(key)
+		if err != nil {
+			return "", err
+		}
+		return priv.PEM(), nil
+	default:
+		return key, nil
+	}
+}
+
+// MigrateRegistry rewrites every entry whose public key uses a legacy
+// encoding to the standard encoding (see MigrateKeyPEM), returning how many
+// entries were rewritten. Entries already in an accepted standard encoding
+// are left as they are. Clients need no change: key IDs are unaffected.
+func MigrateRegistry(reg Registry) (int, error) {
+	entries, err := reg.Entries()
+	if err != nil {
+		return 0, fmt.Errorf("read entries: %w", err)
+	}
+	migrated := 0
+	for _, e := range entries {
+		keyPub, err := MigrateKeyPEM(e.KeyPub)
+		if err != nil {
+			return migrated, fmt.Errorf("migrate %q: %w", e.Name, err)
+		}
+		changed := keyPub != e.KeyPub
+		e.KeyPub = keyPub
+		for i, k := range e.Keys {
+			keyPub, err := MigrateKeyPEM(k.KeyPub)
+			if err != nil {
+				return migrated, fmt.Errorf("migrate %q: %w", e.Name, err)
+			}
+			changed = changed || keyPub != k.KeyPub
+			e.Keys[i].KeyPub = keyPub
+		}
+		if !changed {
+			continue
+		}
+		err = reg.Upsert(e)
+		if err != nil {
+			return migrated, fmt.Errorf("upsert %q: %w", e.Name, err)
+		}
+		migrated++
+	}
+	return migrated, nil
+}
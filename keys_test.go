@@ -0,0 +1,209 @@
+package locket
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// legacyPairEd25519 returns a key pair in the encoding NewPairEd25519 used to
+// emit: raw bytes under custom PEM labels.
+func legacyPairEd25519(t *testing.T) (string, string) {
+	t.Helper()
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	return encodePEM(pemLegacyEd25519Public, pub),
+		encodePEM(pemLegacyEd25519Private, priv.Seed())
+}
+
+func TestKeyEncodingsStandard(t *testing.T) {
+	pub, priv, err := NewPairEd25519()
+	require.NoError(t, err)
+	requirePEMType(t, pemPublicKey, pub)
+	requirePEMType(t, pemPrivateKey, priv)
+
+	pub, priv, err = newPairRSA(2048)
+	require.NoError(t, err)
+	requirePEMType(t, pemPublicKey, pub)
+	requirePEMType(t, pemPrivateKey, priv)
+}
+
+func requirePEMType(t *testing.T, want, key string) {
+	t.Helper()
+	block, _ := pem.Decode([]byte(key))
+	require.NotNil(t, block)
+	require.Equal(t, want, block.Type)
+}
+
+// TestKeyEncodingsLegacy confirms keys in the old locket encodings still parse,
+// and to the same key IDs as their standard re-encodings.
+func TestKeyEncodingsLegacy(t *testing.T) {
+	pub, priv := legacyPairEd25519(t)
+	verifyKey, err := ParseVerifyKey(pub)
+	require.NoError(t, err)
+	signingKey, err := ParseSigningKey(priv)
+	require.NoError(t, err)
+	require.Equal(t, verifyKey.ID(), signingKey.Public().ID())
+
+	migratedPub, err := MigrateKeyPEM(pub)
+	require.NoError(t, err)
+	requirePEMType(t, pemPublicKey, migratedPub)
+	migratedPriv, err := MigrateKeyPEM(priv)
+	require.NoError(t, err)
+	requirePEMType(t, pemPrivateKey, migratedPriv)
+
+	migratedKey, err := ParseVerifyKey(migratedPub)
+	require.NoError(t, err)
+	require.Equal(t, verifyKey.ID(), migratedKey.ID())
+
+	// standard keys pass through untouched
+	unchanged, err := MigrateKeyPEM(migratedPub)
+	require.NoError(t, err)
+	require.Equal(t, migratedPub, unchanged)
+
+	// PKIX bytes under the PKCS#1 label, as newPairRSA used to emit
+	key, err := newDecryptionKey(2048)
+	require.NoError(t, err)
+	block, _ := pem.Decode([]byte(key.Public().PEM()))
+	legacyRSA := encodePEM(pemLegacyRSAPublic, block.Bytes)
+	encryptKey, err := parseEncryptionKey(legacyRSA)
+	require.NoError(t, err)
+	require.Equal(t, key.Public().ID(), encryptKey.ID())
+}
+
+func TestMigrateRegistry(t *testing.T) {
+	reg := FileRegistry{Path: filepath.Join(t.TempDir(), "registry.yml")}
+	legacyPub, _ := legacyPairEd25519(t)
+	standardPub, _, err := NewPairEd25519()
+	require.NoError(t, err)
+	require.NoError(t, reg.Upsert(RegEntry{Name: "old", KeyPub: legacyPub}))
+	require.NoError(t, reg.Upsert(RegEntry{Name: "new", KeyPub: standardPub}))
+
+	n, err := MigrateRegistry(reg)
+	require.NoError(t, err)
+	require.Equal(t, 1, n)
+
+	entries, err := reg.Entries()
+	require.NoError(t, err)
+	for _, e := range entries {
+		requirePEMType(t, pemPublicKey, e.KeyPub)
+	}
+
+	n, err = MigrateRegistry(reg)
+	require.NoError(t, err)
+	require.Zero(t, n, "migration is idempotent")
+}
+
+func TestKeyEncodingsOpenSSH(t *testing.T) {
+	pub, priv, err := NewPairEd25519()
+	require.NoError(t, err)
+	signingKey, err := ParseSigningKey(priv)
+	require.NoError(t, err)
+
+	openssh, err := signingKey.OpenSSH("svc")
+	require.NoError(t, err)
+	requirePEMType(t, pemOpenSSH, openssh)
+	parsed, err := ParseSigningKey(openssh)
+	require.NoError(t, err)
+	require.Equal(t, signingKey.Public().ID(), parsed.Public().ID())
+
+	authorized, err := signingKey.Public().AuthorizedKey()
+	require.NoError(t, err)
+	require.True(t, strings.HasPrefix(authorized, "ssh-ed25519 AAAA"))
+	verifyKey, err := ParseVerifyKey(authorized + " comment@host")
+	require.NoError(t, err)
+	pemKey, err := ParseVerifyKey(pub)
+	require.NoError(t, err)
+	require.Equal(t, pemKey.ID(), verifyKey.ID())
+}
+
+// TestKeyInteropTooling checks that keys and primitives from standard tooling
+// (openssl, ssh-keygen) work with locket, as a non-Go client would use them.
+func TestKeyInteropTooling(t *testing.T) {
+	dir := t.TempDir()
+	run := func(t *testing.T, name string, args ...string) []byte {
+		t.Helper()
+		out, err := exec.Command(name, args...).CombinedOutput()
+		require.NoError(t, err, "%s", out)
+		return out
+	}
+
+	t.Run("openssl", func(t *testing.T) {
+		if _, err := exec.LookPath("openssl"); err != nil {
+			t.Skip("openssl not installed")
+		}
+		priv := filepath.Join(dir, "client.pem")
+		pub := filepath.Join(dir, "client.pub")
+		run(t, "openssl", "genpkey", "-algorithm", "ed25519", "-out", priv)
+		run(t, "openssl", "pkey", "-in", priv, "-pubout", "-out", pub)
+		signingKey := parseFile(t, priv, ParseSigningKey)
+		verifyKey := parseFile(t, pub, ParseVerifyKey)
+		require.Equal(t, verifyKey.ID(), signingKey.Public().ID())
+
+		// a signature made by openssl verifies with the registry key
+		msg := filepath.Join(dir, "msg")
+		require.NoError(t, os.WriteFile(msg, testCypher, 0o600))
+		sig := run(t, "openssl", "pkeyutl", "-sign", "-rawin", "-inkey", priv, "-in", msg)
+		require.True(t, verifyKey.Verify(testCypher, sig))
+
+		// a payload encrypted by openssl to the server key decrypts
+		key, err := newDecryptionKey(2048)
+		require.NoError(t, err)
+		serverPub := filepath.Join(dir, "server.pub")
+		require.NoError(t, os.WriteFile(serverPub, []byte(key.Public().PEM()), 0o600))
+		ciphertext := run(t, "openssl", "pkeyutl", "-encrypt", "-pubin",
+			"-inkey", serverPub, "-in", msg,
+			"-pkeyopt", "rsa_padding_mode:oaep",
+			"-pkeyopt", "rsa_oaep_md:sha256",
+			"-pkeyopt", "rsa_mgf1_md:sha256",
+		)
+		plaintext, err := key.Decrypt(ciphertext)
+		require.NoError(t, err)
+		require.Equal(t, testCypher, plaintext)
+
+		// and a secret encrypted by locket decrypts with openssl
+		clientPriv := filepath.Join(dir, "response.pem")
+		run(t, "openssl", "genpkey", "-algorithm", "RSA", "-out", clientPriv)
+		clientPub := run(t, "openssl", "pkey", "-in", clientPriv, "-pubout")
+		encryptKey, err := parseEncryptionKey(string(clientPub))
+		require.NoError(t, err)
+		ciphertext, err = encryptKey.Encrypt([]byte("secret"))
+		require.NoError(t, err)
+		encrypted := filepath.Join(dir, "secret.enc")
+		require.NoError(t, os.WriteFile(encrypted, ciphertext, 0o600))
+		out := run(t, "openssl", "pkeyutl", "-decrypt",
+			"-inkey", clientPriv, "-in", encrypted,
+			"-pkeyopt", "rsa_padding_mode:oaep",
+			"-pkeyopt", "rsa_oaep_md:sha256",
+			"-pkeyopt", "rsa_mgf1_md:sha256",
+		)
+		require.Equal(t, "secret", string(out))
+	})
+
+	t.Run("ssh-keygen", func(t *testing.T) {
+		if _, err := exec.LookPath("ssh-keygen"); err != nil {
+			t.Skip("ssh-keygen not installed")
+		}
+		priv := filepath.Join(dir, "id_ed25519")
+		run(t, "ssh-keygen", "-q", "-t", "ed25519", "-N", "", "-C", "svc", "-f", priv)
+		signingKey := parseFile(t, priv, ParseSigningKey)
+		verifyKey := parseFile(t, priv+".pub", ParseVerifyKey)
+		require.Equal(t, verifyKey.ID(), signingKey.Public().ID())
+	})
+}
+
+func parseFile[K any](t *testing.T, path string, parse func(string) (K, error)) K {
+	t.Helper()
+	b, err := os.ReadFile(path)
+	require.NoError(t, err)
+	key, err := parse(string(b))
+	require.NoError(t, err)
+	return key
+}
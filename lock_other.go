@@ -0,0 +1,22 @@
+//go:build !(darwin || dragonfly || freebsd || linux || netbsd || openbsd)
+
+package locket
+
+import "sync"
+
+// fileLocks holds one mutex per lock path.
+var fileLocks sync.Map // path -> *sync.Mutex
+
+// lockFile takes an exclusive lock on path and returns a func releasing
+// it. Without flock the lock only excludes other goroutines of this
+// process.
+func lockFile(path string) (func(), error) {
+	mu, _ := fileLocks.LoadOrStore(path, new(sync.Mutex))
+	mu.(*sync.Mutex).Lock()
+	return mu.(*sync.Mutex).Unlock, nil
+}
+
+// syncDir is a no-op where directories cannot be fsynced.
+func syncDir(string) error {
+	return nil
+}
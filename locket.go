@@ -2,6 +2,7 @@ package locket
 
 import (
 	"log/slog"
+	"runtime"
 	"testing"
 	"time"
 
@@ -9,23 +10,35 @@ import (
 )
 
 var Defaults = defaults{
-	AllowCIDR:    "10.0.0.0/24",
-	BitsizeRSA:   2048,
-	MaxClockSkew: 30 * time.Second,
+	AllowCIDR:        "10.0.0.0/24",
+	BitsizeRSA:       2048,
+	MaxClockSkew:     30 * time.Second,
+	MaxPrivateKeyOps: runtime.NumCPU(),
+	PrivateKeyWait:   5 * time.Second,
 }
 
 type defaults struct {
-	AllowCIDR    string        // client requests from outside this CIDR are forbidden
-	BitsizeRSA   int           // bit size passed to RSA creation for client and server encryption
-	MaxClockSkew time.Duration // max client/server clock difference before a request is rejected
+	AllowCIDR        string        // client requests from outside this CIDR are forbidden
+	BitsizeRSA       int           // bit size passed to RSA creation for client and server encryption
+	MaxClockSkew     time.Duration // max client/server clock difference before a request is rejected
+	MaxPrivateKeyOps int           // max concurrent server private-key (RSA decrypt) operations
+	PrivateKeyWait   time.Duration // max time a request waits for a private-key slot before 503
 }
 
 // PathRegistry is the API endpoint for registry operations.
-//   - GET: list all entries
+//   - GET: list all entries, with an ETag; given a matching If-None-Match,
+//     304 Not Modified, or with ?wait=<duration> once the entries change.
+//     Operator signatures, if any, are sent as X-Registry-Signature headers.
 //   - POST: upsert an entry (RegEntry JSON body)
 //   - DELETE: remove an entry (RegEntry JSON body with name)
 var PathRegistry = "/locket/registry"
 
+// PathRegistryKeys is the API endpoint for key rotation, see KeyRotator.
+//   - POST: add a key (RegKeyRequest JSON body with name and key)
+//   - PATCH: retire a key (RegKeyRequest JSON body with name, key_id, not_after)
+//   - DELETE: remove a key (RegKeyRequest JSON body with name and key_id)
+var PathRegistryKeys = "/locket/registry/keys"
+
 // map[serviceName]keyPrivateSigning
 type KeysPrivateSigning map[string]string
 
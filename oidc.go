@@ -0,0 +1,648 @@
+package locket
+
+import (
+	"crypto"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+/*
+Workload identity: in OIDC mode a request carries a JWT (e.g. a CI job's
+OIDC token) instead of a registry key signature. The server verifies the
+token against the issuer's JWKS, checks its issuer, audience and lifetime,
+and maps its claims to a service name through rules. Registry keys are not
+consulted. The request nonce and timestamp are still checked, so a captured
+request cannot be replayed as is.
+
+The token is the only credential: nothing else in the request is signed.
+Proof of possession comes from a "cnf" claim (RFC 7800) whose "jkt" member
+is the JWK thumbprint (RFC 7638) of the request's ClientPubKey, see
+Client.KeyThumbprint: the response is encrypted to that key, so a stolen
+token is useless to anyone without its private key. A token carrying "cnf"
+is always checked against it, and RequireKeyBinding refuses tokens without.
+
+A token without "cnf" is a bearer credential. It is bound to the
+ClientPubKey of the first request it authenticates, so it cannot be resent
+with another key while bound, but the binding is held in memory only: it
+is lost on restart, not shared between replicas, and whoever presents a
+leaked token first claims it. Without RequireKeyBinding, serve over TLS and
+prefer short-lived tokens.
+
+Supported algorithms: RS256, ES256, EdDSA (Ed25519).
+*/
+
+// OIDC configures authentication of requests by JWT, see WithOIDC.
+type OIDC struct {
+	Issuer   string      `yaml:"issuer"`    // required "iss" claim
+	Audience string      `yaml:"audience"`  // required member of "aud" claim
+	JWKSFile string      `yaml:"jwks_file"` // JWKS file, or
+	JWKSURL  string      `yaml:"jwks_url"`  // JWKS URL, typically local
+	Rules    []ClaimRule `yaml:"rules"`
+	// RequireKeyBinding refuses tokens without a "cnf" claim binding them
+	// to the request's ClientPubKey, so no token is a bearer credential.
+	RequireKeyBinding bool `yaml:"require_key_binding"`
+}
+
+// ClaimRule maps tokens whose claims match to a service name. Each entry of
+// Claims is a claim name and a path.Match pattern its value must match, e.g.
+// {"repository": "grackleclub/*", "ref": "refs/heads/main"}. A rule with no
+// claims matches nothing.
+type ClaimRule struct {
+	Claims  map[string]string `yaml:"claims"`
+	Service string            `yaml:"service"`
+}
+
+// LoadOIDC reads an OIDC configuration from a YAML file.
+func LoadOIDC(path string) (*OIDC, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read file: %w", err)
+	}
+	var o OIDC
+	err = yaml.Unmarshal(b, &o)
+	if err != nil {
+		return nil, fmt.Errorf("unmarshal: %w", err)
+	}
+	if err := o.Validate(); err != nil {
+		return nil, err
+	}
+	return &o, nil
+}
+
+// Validate reports the first configuration error, if any.
+func (o *OIDC) Validate() error {
+	if o.Issuer == "" {
+		return errors.New("issuer required")
+	}
+	if o.Audience == "" {
+		return errors.New("audience required")
+	}
+	if (o.JWKSFile == "") == (o.JWKSURL == "") {
+		return errors.New("exactly one of jwks_file or jwks_url required")
+	}
+	if len(o.Rules) == 0 {
+		return errors.New("at least one rule required")
+	}
+	for i, rule := range o.Rules {
+		if rule.Service == "" {
+			return fmt.Errorf("rule %d: service required", i)
+		}
+		if len(rule.Claims) == 0 {
+			return fmt.Errorf("rule %d: claims required", i)
+		}
+		for claim, pattern := range rule.Claims {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return fmt.Errorf("rule %d: claim %q: %w", i, claim, err)
+			}
+		}
+	}
+	return nil
+}
+
+// WithOIDC authenticates requests by JWT per o, in place of registry keys.
+// The registry passed to NewServer may then be nil. Unless
+// o.RequireKeyBinding, a token without a "cnf" claim is a bearer
+// credential, bound to a client key in this process's memory only; see the
+// top of oidc.go.
+func WithOIDC(o *OIDC) ServerOption {
+	return func(s *Server) {
+		s.oidc = o
+	}
+}
+
+// service returns the service of the first rule claims match.
+func (o *OIDC) service(claims map[string]any) (string, bool) {
+	for _, rule := range o.Rules {
+		if len(rule.Claims) == 0 {
+			continue
+		}
+		matched := true
+		for claim, pattern := range rule.Claims {
+			value, ok := claimString(claims[claim])
+			if !ok {
+				matched = false
+				break
+			}
+			if m, _ := path.Match(pattern, value); !m {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			return rule.Service, true
+		}
+	}
+	return "", false
+}
+
+// claimString returns a scalar claim as a string.
+func claimString(v any) (string, bool) {
+	switch v := v.(type) {
+	case string:
+		return v, true
+	case bool, json.Number:
+		return fmt.Sprint(v), true
+	default:
+		return "", false
+	}
+}
+
+// minJWKSRefresh bounds how often an unknown key ID triggers a JWKS fetch.
+const minJWKSRefresh = time.Minute
+
+// tokenVerifier verifies JWTs against an OIDC configuration.
+type tokenVerifier struct {
+	cfg        OIDC
+	client     *http.Client
+	mu         sync.RWMutex
+	keys       map[string]crypto.PublicKey // kid -> key
+	fetched    time.Time                   // of the last fetch, successful or not
+	refreshing chan struct{}               // closed when the refresh in progress ends
+
+	bindMu    sync.Mutex
+	bound     map[string]tokenBinding // tokenID -> client key it is bound to
+	bindSwept time.Time
+}
+
+// tokenBinding is the client key a token was first used with.
+type tokenBinding struct {
+	client string // sha256 of the ClientPubKey
+	expiry time.Time
+}
+
+// tokenID identifies a token for binding: by issuer and "jti" claim if it
+// has one, or else by its hash.
+func tokenID(token string, claims map[string]any) string {
+	if jti, ok := claims["jti"].(string); ok && jti != "" {
+		iss, _ := claims["iss"].(string)
+		return "jti:" + iss + "\x00" + jti
+	}
+	sum := sha256.Sum256([]byte(token))
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+// bind binds the token id to clientPubKey until expiry, reporting whether
+// it is not bound to another key already. Expired bindings are swept at
+// most once per Defaults.MaxClockSkew, keeping the map bounded by the
+// tokens live at once.
+func (v *tokenVerifier) bind(id, clientPubKey string, expiry time.Time) bool {
+	sum := sha256.Sum256([]byte(clientPubKey))
+	client := hex.EncodeToString(sum[:])
+	now := time.Now()
+	v.bindMu.Lock()
+	defer v.bindMu.Unlock()
+	if v.bound == nil {
+		v.bound = make(map[string]tokenBinding)
+	}
+	if now.Sub(v.bindSwept) > Defaults.MaxClockSkew {
+		for k, b := range v.bound {
+			if now.After(b.expiry) {
+				delete(v.bound, k)
+			}
+		}
+		v.bindSwept = now
+	}
+	if b, ok := v.bound[id]; ok && now.Before(b.expiry) {
+		return b.client == client
+	}
+	v.bound[id] = tokenBinding{client: client, expiry: expiry}
+	return true
+}
+
+// newTokenVerifier loads the JWKS of cfg.
+func newTokenVerifier(cfg OIDC) (*tokenVerifier, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid oidc config: %w", err)
+	}
+	v := &tokenVerifier{cfg: cfg, client: &http.Client{Timeout: 10 * time.Second}}
+	if err := v.refresh(); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+// refresh reloads the JWKS.
+func (v *tokenVerifier) refresh() error {
+	var b []byte
+	var err error
+	if v.cfg.JWKSFile != "" {
+		b, err = os.ReadFile(v.cfg.JWKSFile)
+		if err != nil {
+			return fmt.Errorf("read jwks: %w", err)
+		}
+	} else {
+		b, err = v.fetch()
+		if err != nil {
+			return fmt.Errorf("fetch jwks: %w", err)
+		}
+	}
+	keys, err := parseJWKS(b)
+	if err != nil {
+		return fmt.Errorf("parse jwks: %w", err)
+	}
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.keys = keys
+	v.fetched = time.Now()
+	return nil
+}
+
+// fetch downloads the JWKS from cfg.JWKSURL.
+func (v *tokenVerifier) fetch() ([]byte, error) {
+	resp, err := v.client.Get(v.cfg.JWKSURL)
+	if err != nil {
+		return nil, fmt.Errorf("do request: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("not ok, status: %d", resp.StatusCode)
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+}
+
+// key returns the key with the given ID, refreshing the JWKS (at most once
+// per minJWKSRefresh) if it is unknown, as after an issuer key rotation.
+// An empty kid selects the only key of a single-key JWKS.
+func (v *tokenVerifier) key(kid string) (crypto.PublicKey, bool) {
+	lookup := func() (crypto.PublicKey, bool, time.Time) {
+		v.mu.RLock()
+		defer v.mu.RUnlock()
+		if kid == "" && len(v.keys) == 1 {
+			for _, k := range v.keys {
+				return k, true, v.fetched
+			}
+		}
+		k, ok := v.keys[kid]
+		return k, ok, v.fetched
+	}
+	k, ok, fetched := lookup()
+	if ok || time.Since(fetched) < minJWKSRefresh {
+		return k, ok
+	}
+	v.refreshShared()
+	k, ok, _ = lookup()
+	return k, ok
+}
+
+// refreshShared refreshes the JWKS, or waits for the refresh already in
+// progress, so concurrent requests with unknown key IDs fetch it once. A
+// failed fetch counts as one for minJWKSRefresh, so a failing endpoint is
+// not retried on every request.
+func (v *tokenVerifier) refreshShared() {
+	v.mu.Lock()
+	if wait := v.refreshing; wait != nil {
+		v.mu.Unlock()
+		<-wait
+		return
+	}
+	if time.Since(v.fetched) < minJWKSRefresh {
+		// refreshed since the caller looked
+		v.mu.Unlock()
+		return
+	}
+	done := make(chan struct{})
+	v.refreshing = done
+	v.mu.Unlock()
+
+	err := v.refresh()
+	v.mu.Lock()
+	if err != nil {
+		v.fetched = time.Now()
+	}
+	v.refreshing = nil
+	v.mu.Unlock()
+	close(done)
+	if err != nil {
+		log.Error("jwks refresh failed", "error", err)
+	}
+}
+
+// jwtHeader is the JOSE header of a JWT.
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+}
+
+// verify checks token's signature, issuer, audience and lifetime, returning
+// its claims.
+func (v *tokenVerifier) verify(token string, now time.Time) (map[string]any, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed token")
+	}
+	var header jwtHeader
+	if err := decodeJWTPart(parts[0], &header); err != nil {
+		return nil, fmt.Errorf("header: %w", err)
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("signature: %w", err)
+	}
+	key, ok := v.key(header.Kid)
+	if !ok {
+		return nil, fmt.Errorf("unknown key %q", header.Kid)
+	}
+	if err := verifyJWS(header.Alg, key, parts[0]+"."+parts[1], sig); err != nil {
+		return nil, err
+	}
+
+	var claims map[string]any
+	if err := decodeJWTPart(parts[1], &claims); err != nil {
+		return nil, fmt.Errorf("claims: %w", err)
+	}
+	if iss, _ := claims["iss"].(string); iss != v.cfg.Issuer {
+		return nil, fmt.Errorf("unexpected issuer %q", iss)
+	}
+	if !audienceContains(claims["aud"], v.cfg.Audience) {
+		return nil, fmt.Errorf("audience does not include %q", v.cfg.Audience)
+	}
+	leeway := Defaults.MaxClockSkew
+	exp, ok := claimTime(claims["exp"])
+	if !ok {
+		return nil, errors.New("exp claim required")
+	}
+	if !now.Before(exp.Add(leeway)) {
+		return nil, fmt.Errorf("token expired at %s", exp)
+	}
+	if nbf, ok := claimTime(claims["nbf"]); ok && now.Add(leeway).Before(nbf) {
+		return nil, fmt.Errorf("token not valid before %s", nbf)
+	}
+	return claims, nil
+}
+
+// decodeJWTPart decodes a base64url JSON segment of a JWT into v,
+// keeping numbers as json.Number.
+func decodeJWTPart(part string, v any) error {
+	b, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return fmt.Errorf("decode: %w", err)
+	}
+	dec := json.NewDecoder(strings.NewReader(string(b)))
+	dec.UseNumber()
+	return dec.Decode(v)
+}
+
+// verifyJWS verifies a JWS signature over signed with key under alg. The
+// algorithm must match the key type, so a token cannot pick a weaker one.
+func verifyJWS(alg string, key crypto.PublicKey, signed string, sig []byte) error {
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		if alg != "RS256" {
+			break
+		}
+		sum := sha256.Sum256([]byte(signed))
+		if err := rsa.VerifyPKCS1v15(k, crypto.SHA256, sum[:], sig); err != nil {
+			return errors.New("bad signature")
+		}
+		return nil
+	case *ecdsa.PublicKey:
+		if alg != "ES256" {
+			break
+		}
+		if len(sig) != 64 {
+			return errors.New("bad signature")
+		}
+		sum := sha256.Sum256([]byte(signed))
+		r := new(big.Int).SetBytes(sig[:32])
+		s := new(big.Int).SetBytes(sig[32:])
+		if !ecdsa.Verify(k, sum[:], r, s) {
+			return errors.New("bad signature")
+		}
+		return nil
+	case ed25519.PublicKey:
+		if alg != "EdDSA" {
+			break
+		}
+		if !ed25519.Verify(k, []byte(signed), sig) {
+			return errors.New("bad signature")
+		}
+		return nil
+	}
+	return fmt.Errorf("algorithm %q not allowed for key type %T", alg, key)
+}
+
+// audienceContains reports whether the "aud" claim, a string or an array
+// of strings, includes want.
+func audienceContains(aud any, want string) bool {
+	switch aud := aud.(type) {
+	case string:
+		return aud == want
+	case []any:
+		for _, a := range aud {
+			if s, ok := a.(string); ok && s == want {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// claimTime returns a NumericDate claim as a time.
+func claimTime(v any) (time.Time, bool) {
+	n, ok := v.(json.Number)
+	if !ok {
+		return time.Time{}, false
+	}
+	f, err := n.Float64()
+	if err != nil {
+		return time.Time{}, false
+	}
+	return time.Unix(int64(f), 0), true
+}
+
+// jwk is a JSON Web Key, with the members of the supported key types.
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// parseJWKS parses a JSON Web Key Set, skipping keys not used for
+// signatures and of unsupported types.
+func parseJWKS(b []byte) (map[string]crypto.PublicKey, error) {
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.Unmarshal(b, &set); err != nil {
+		return nil, fmt.Errorf("unmarshal: %w", err)
+	}
+	keys := make(map[string]crypto.PublicKey, len(set.Keys))
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		key, err := k.publicKey()
+		if err != nil {
+			log.Warn("skipping jwks key", "kid", k.Kid, "error", err)
+			continue
+		}
+		keys[k.Kid] = key
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("no usable keys")
+	}
+	return keys, nil
+}
+
+// publicKey decodes the key.
+func (k jwk) publicKey() (crypto.PublicKey, error) {
+	decode := base64.RawURLEncoding.DecodeString
+	switch {
+	case k.Kty == "RSA":
+		n, err := decode(k.N)
+		if err != nil {
+			return nil, fmt.Errorf("n: %w", err)
+		}
+		e, err := decode(k.E)
+		if err != nil {
+			return nil, fmt.Errorf("e: %w", err)
+		}
+		exp := new(big.Int).SetBytes(e)
+		if !exp.IsInt64() || exp.Int64() < 3 || exp.Int64() > 1<<31-1 {
+			return nil, errors.New("bad exponent")
+		}
+		key := &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(exp.Int64())}
+		if key.N.BitLen() < 2048 {
+			return nil, fmt.Errorf("RSA key too small: %d bits", key.N.BitLen())
+		}
+		return key, nil
+	case k.Kty == "EC" && k.Crv == "P-256":
+		x, err := decode(k.X)
+		if err != nil {
+			return nil, fmt.Errorf("x: %w", err)
+		}
+		y, err := decode(k.Y)
+		if err != nil {
+			return nil, fmt.Errorf("y: %w", err)
+		}
+		if len(x) != 32 || len(y) != 32 {
+			return nil, errors.New("bad P-256 coordinates")
+		}
+		// validate the point is on the curve
+		point := append(append([]byte{4}, x...), y...)
+		if _, err := ecdh.P256().NewPublicKey(point); err != nil {
+			return nil, fmt.Errorf("bad P-256 point: %w", err)
+		}
+		return &ecdsa.PublicKey{
+			Curve: elliptic.P256(),
+			X:     new(big.Int).SetBytes(x),
+			Y:     new(big.Int).SetBytes(y),
+		}, nil
+	case k.Kty == "OKP" && k.Crv == "Ed25519":
+		x, err := decode(k.X)
+		if err != nil {
+			return nil, fmt.Errorf("x: %w", err)
+		}
+		if len(x) != ed25519.PublicKeySize {
+			return nil, errors.New("bad Ed25519 key length")
+		}
+		return ed25519.PublicKey(x), nil
+	default:
+		return nil, fmt.Errorf("unsupported key type %q %q", k.Kty, k.Crv)
+	}
+}
+
+// authenticateToken verifies request's JWT, returning the service its
+// claims map to.
+func (s *Server) authenticateToken(request kvRequest, r *http.Request, id string) (string, bool) {
+	if request.Token == "" {
+		log.Warn("request missing token", "request_id", id)
+		return "", false
+	}
+	claims, err := s.tokens.verify(request.Token, time.Now())
+	if err != nil {
+		log.Warn("token rejected",
+			"ip", r.RemoteAddr, "request_id", id, "error", err,
+		)
+		return "", false
+	}
+	sub, _ := claims["sub"].(string)
+	service, ok := s.oidc.service(claims)
+	if !ok {
+		log.Warn("token claims match no rule",
+			"sub", sub, "request_id", id,
+		)
+		return "", false
+	}
+	if cnf, ok := claims["cnf"]; ok || s.oidc.RequireKeyBinding {
+		if err := checkKeyBinding(cnf, request.ClientPubKey); err != nil {
+			audit("token not bound to client key",
+				"event", "token_unbound",
+				"service", service, "sub", sub, "error", err,
+				"ip", r.RemoteAddr, "request_id", id,
+			)
+			return "", false
+		}
+	} else {
+		exp, _ := claimTime(claims["exp"])
+		if !s.tokens.bind(tokenID(request.Token, claims), request.ClientPubKey, exp.Add(Defaults.MaxClockSkew)) {
+			audit("token reused with another client key",
+				"event", "token_rebound",
+				"service", service, "sub", sub,
+				"ip", r.RemoteAddr, "request_id", id,
+			)
+			return "", false
+		}
+	}
+	log.Debug("token verified",
+		"service", service, "sub", sub, "request_id", id,
+	)
+	return service, true
+}
+
+// checkKeyBinding checks that a "cnf" claim holds the JWK thumbprint of
+// clientPubKey as "jkt".
+func checkKeyBinding(cnf any, clientPubKey string) error {
+	claim, ok := cnf.(map[string]any)
+	if !ok {
+		return errors.New("cnf claim required")
+	}
+	jkt, _ := claim["jkt"].(string)
+	if jkt == "" {
+		return errors.New("cnf claim has no jkt")
+	}
+	key, err := parseEncryptionKey(clientPubKey)
+	if err != nil {
+		return fmt.Errorf("parse client pubkey: %w", err)
+	}
+	if subtle.ConstantTimeCompare([]byte(jkt), []byte(jwkThumbprint(key.public))) != 1 {
+		return errors.New("cnf jkt does not match client pubkey")
+	}
+	return nil
+}
+
+// jwkThumbprint returns the RFC 7638 JWK SHA-256 thumbprint of an RSA key,
+// base64url encoded, as in a "cnf" claim's "jkt" member.
+func jwkThumbprint(key *rsa.PublicKey) string {
+	enc := base64.RawURLEncoding.EncodeToString
+	// required members only, in lexical order, with no whitespace
+	canonical := `{"e":"` + enc(big.NewInt(int64(key.E)).Bytes()) +
+		`","kty":"RSA","n":"` + enc(key.N.Bytes()) + `"}`
+	sum := sha256.Sum256([]byte(canonical))
+	return enc(sum[:])
+}
@@ -0,0 +1,427 @@
+package locket
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	testIssuer   = "https://token.actions.example.com"
+	testAudience = "locket"
+)
+
+// testIssuerKey is a signing key of a test OIDC issuer.
+type testIssuerKey struct {
+	kid  string
+	alg  string
+	priv crypto.Signer
+}
+
+func newTestIssuerKeys(t *testing.T) []testIssuerKey {
+	t.Helper()
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	return []testIssuerKey{
+		{kid: "rsa", alg: "RS256", priv: rsaKey},
+		{kid: "ec", alg: "ES256", priv: ecKey},
+		{kid: "ed", alg: "EdDSA", priv: edKey},
+	}
+}
+
+// testJWKS returns the JWKS publishing keys.
+func testJWKS(t *testing.T, keys ...testIssuerKey) []byte {
+	t.Helper()
+	enc := base64.RawURLEncoding.EncodeToString
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	for _, k := range keys {
+		switch pub := k.priv.Public().(type) {
+		case *rsa.PublicKey:
+			set.Keys = append(set.Keys, jwk{
+				Kty: "RSA", Kid: k.kid, Use: "sig",
+				N: enc(pub.N.Bytes()), E: enc(big.NewInt(int64(pub.E)).Bytes()),
+			})
+		case *ecdsa.PublicKey:
+			set.Keys = append(set.Keys, jwk{
+				Kty: "EC", Kid: k.kid, Crv: "P-256",
+				X: enc(pub.X.FillBytes(make([]byte, 32))),
+				Y: enc(pub.Y.FillBytes(make([]byte, 32))),
+			})
+		case ed25519.PublicKey:
+			set.Keys = append(set.Keys, jwk{Kty: "OKP", Kid: k.kid, Crv: "Ed25519", X: enc(pub)})
+		}
+	}
+	b, err := json.Marshal(set)
+	require.NoError(t, err)
+	return b
+}
+
+// testJWT signs claims with key, announcing alg in the header.
+func testJWT(t *testing.T, key testIssuerKey, alg string, claims map[string]any) string {
+	t.Helper()
+	enc := base64.RawURLEncoding.EncodeToString
+	header, err := json.Marshal(map[string]string{"alg": alg, "kid": key.kid, "typ": "JWT"})
+	require.NoError(t, err)
+	body, err := json.Marshal(claims)
+	require.NoError(t, err)
+	signed := enc(header) + "." + enc(body)
+
+	var sig []byte
+	sum := sha256.Sum256([]byte(signed))
+	switch priv := key.priv.(type) {
+	case *rsa.PrivateKey:
+		sig, err = rsa.SignPKCS1v15(rand.Reader, priv, crypto.SHA256, sum[:])
+	case *ecdsa.PrivateKey:
+		var r, s *big.Int
+		r, s, err = ecdsa.Sign(rand.Reader, priv, sum[:])
+		sig = append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+	case ed25519.PrivateKey:
+		sig = ed25519.Sign(priv, []byte(signed))
+	}
+	require.NoError(t, err)
+	return signed + "." + enc(sig)
+}
+
+// testClaims returns valid claims for a CI job of repository.
+func testClaims(repository string) map[string]any {
+	now := time.Now()
+	return map[string]any{
+		"iss":        testIssuer,
+		"aud":        []string{"other", testAudience},
+		"sub":        "repo:" + repository + ":ref:refs/heads/main",
+		"repository": repository,
+		"iat":        now.Unix(),
+		"nbf":        now.Unix(),
+		"exp":        now.Add(5 * time.Minute).Unix(),
+	}
+}
+
+func testOIDC(jwksFile string) OIDC {
+	return OIDC{
+		Issuer:   testIssuer,
+		Audience: testAudience,
+		JWKSFile: jwksFile,
+		Rules: []ClaimRule{
+			{Claims: map[string]string{"repository": "grackleclub/deploy"}, Service: "SERVICE1"},
+			{Claims: map[string]string{"repository": "grackleclub/*"}, Service: "SERVICE2"},
+		},
+	}
+}
+
+func TestTokenVerifier(t *testing.T) {
+	keys := newTestIssuerKeys(t)
+	jwksFile := filepath.Join(t.TempDir(), "jwks.json")
+	require.NoError(t, os.WriteFile(jwksFile, testJWKS(t, keys...), 0o600))
+	v, err := newTokenVerifier(testOIDC(jwksFile))
+	require.NoError(t, err)
+
+	for _, key := range keys {
+		t.Run(key.alg, func(t *testing.T) {
+			claims, err := v.verify(testJWT(t, key, key.alg, testClaims("grackleclub/deploy")), time.Now())
+			require.NoError(t, err)
+			service, ok := v.cfg.service(claims)
+			require.True(t, ok)
+			require.Equal(t, "SERVICE1", service)
+		})
+	}
+
+	key := keys[0]
+	cases := map[string]func(map[string]any){
+		"issuer":   func(c map[string]any) { c["iss"] = "https://evil.example.com" },
+		"audience": func(c map[string]any) { c["aud"] = "other" },
+		"expired":  func(c map[string]any) { c["exp"] = time.Now().Add(-time.Hour).Unix() },
+		"no exp":   func(c map[string]any) { delete(c, "exp") },
+		"nbf":      func(c map[string]any) { c["nbf"] = time.Now().Add(time.Hour).Unix() },
+	}
+	for name, mutate := range cases {
+		t.Run(name, func(t *testing.T) {
+			claims := testClaims("grackleclub/deploy")
+			mutate(claims)
+			_, err := v.verify(testJWT(t, key, key.alg, claims), time.Now())
+			require.Error(t, err)
+		})
+	}
+
+	t.Run("algorithm confusion", func(t *testing.T) {
+		for _, alg := range []string{"none", "HS256", "ES256"} {
+			_, err := v.verify(testJWT(t, key, alg, testClaims("grackleclub/deploy")), time.Now())
+			require.Error(t, err, alg)
+		}
+	})
+	t.Run("tampered", func(t *testing.T) {
+		token := testJWT(t, key, key.alg, testClaims("grackleclub/deploy"))
+		parts := strings.Split(token, ".")
+		body, err := json.Marshal(testClaims("grackleclub/other"))
+		require.NoError(t, err)
+		parts[1] = base64.RawURLEncoding.EncodeToString(body)
+		_, err = v.verify(strings.Join(parts, "."), time.Now())
+		require.Error(t, err)
+	})
+	t.Run("unknown key", func(t *testing.T) {
+		stranger := newTestIssuerKeys(t)[0]
+		stranger.kid = "stranger"
+		_, err := v.verify(testJWT(t, stranger, stranger.alg, testClaims("grackleclub/deploy")), time.Now())
+		require.Error(t, err)
+	})
+}
+
+func TestLoadOIDCExample(t *testing.T) {
+	cfg, err := LoadOIDC(filepath.Join("example", "oidc.yml"))
+	require.NoError(t, err)
+	service, ok := cfg.service(map[string]any{
+		"repository": "grackleclub/deploy", "ref": "refs/heads/main",
+	})
+	require.True(t, ok)
+	require.Equal(t, "SERVICE1", service)
+}
+
+func TestOIDCRules(t *testing.T) {
+	cfg := testOIDC("jwks.json")
+	require.NoError(t, cfg.Validate())
+
+	service, ok := cfg.service(map[string]any{"repository": "grackleclub/web"})
+	require.True(t, ok)
+	require.Equal(t, "SERVICE2", service)
+	_, ok = cfg.service(map[string]any{"repository": "someone/else"})
+	require.False(t, ok)
+	_, ok = cfg.service(map[string]any{"repository": []any{"grackleclub/deploy"}})
+	require.False(t, ok, "non-scalar claims never match")
+
+	bad := cfg
+	bad.JWKSURL = "http://localhost/jwks"
+	require.Error(t, bad.Validate())
+	bad = cfg
+	bad.Rules = []ClaimRule{{Service: "SERVICE1"}}
+	require.Error(t, bad.Validate())
+	bad = cfg
+	bad.Audience = ""
+	require.Error(t, bad.Validate())
+}
+
+func TestTokenVerifierRefreshesJWKS(t *testing.T) {
+	keys := newTestIssuerKeys(t)
+	var jwks atomic.Value
+	jwks.Store(testJWKS(t, keys[0]))
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(jwks.Load().([]byte))
+	}))
+	defer srv.Close()
+
+	cfg := testOIDC("")
+	cfg.JWKSURL = srv.URL
+	v, err := newTokenVerifier(cfg)
+	require.NoError(t, err)
+
+	// the issuer rotates to a new key
+	jwks.Store(testJWKS(t, keys[1]))
+	token := testJWT(t, keys[1], keys[1].alg, testClaims("grackleclub/deploy"))
+	_, err = v.verify(token, time.Now())
+	require.Error(t, err, "refresh is rate limited")
+
+	v.mu.Lock()
+	v.fetched = time.Now().Add(-minJWKSRefresh)
+	v.mu.Unlock()
+	_, err = v.verify(token, time.Now())
+	require.NoError(t, err)
+}
+
+// TestTokenVerifierRefreshOnce checks concurrent lookups of unknown keys
+// share one JWKS fetch, and a failed fetch is not retried at once.
+func TestTokenVerifierRefreshOnce(t *testing.T) {
+	keys := newTestIssuerKeys(t)
+	var fetches atomic.Int32
+	var failing atomic.Bool
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if fetches.Add(1) > 1 {
+			<-release
+		}
+		if failing.Load() {
+			http.Error(w, "down", http.StatusInternalServerError)
+			return
+		}
+		w.Write(testJWKS(t, keys[0]))
+	}))
+	defer srv.Close()
+
+	cfg := testOIDC("")
+	cfg.JWKSURL = srv.URL
+	v, err := newTokenVerifier(cfg)
+	require.NoError(t, err)
+	stale := func() {
+		v.mu.Lock()
+		v.fetched = time.Now().Add(-minJWKSRefresh)
+		v.mu.Unlock()
+	}
+
+	stale()
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			v.key("unknown")
+		}()
+	}
+	require.Eventually(t, func() bool { return fetches.Load() == 2 }, 5*time.Second, time.Millisecond)
+	time.Sleep(20 * time.Millisecond) // let any duplicate fetch start
+	close(release)
+	wg.Wait()
+	require.EqualValues(t, 2, fetches.Load(), "one refresh for all lookups")
+
+	failing.Store(true)
+	stale()
+	_, ok := v.key("unknown")
+	require.False(t, ok)
+	_, ok = v.key("unknown")
+	require.False(t, ok)
+	require.EqualValues(t, 3, fetches.Load(), "a failed refresh is rate limited too")
+}
+
+// TestHandlerOIDC fetches a secret authenticated by JWT, with no registry.
+func TestHandlerOIDC(t *testing.T) {
+	keys := newTestIssuerKeys(t)
+	jwksFile := filepath.Join(t.TempDir(), "jwks.json")
+	require.NoError(t, os.WriteFile(jwksFile, testJWKS(t, keys...), 0o600))
+	cfg := testOIDC(jwksFile)
+	ts, server := newTestServerWith(t, nil, WithOIDC(&cfg))
+
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	token := testJWT(t, keys[2], keys[2].alg, testClaims("grackleclub/deploy"))
+	require.NoError(t, os.WriteFile(tokenFile, []byte(token+"\n"), 0o600))
+	client, err := NewClientWithToken(ts.URL, TokenFile(tokenFile))
+	require.NoError(t, err)
+	got, err := client.FetchSecret(testSecretName)
+	require.NoError(t, err)
+	require.Equal(t, testSecretValue, got)
+
+	// replay protection still applies
+	nonce, err := newNonce()
+	require.NoError(t, err)
+	req := kvRequest{
+		Version:      protocolVersion,
+		ServerKeyID:  server.key.Public().ID(),
+		Payload:      testEncrypt(t, server.key.Public().PEM(), testSecretName),
+		ClientPubKey: client.key.Public().PEM(),
+		Timestamp:    time.Now().Unix(),
+		Nonce:        nonce,
+		Token:        token,
+	}
+	resp, _ := postRequest(t, ts.URL, req)
+	require.Equal(t, http.StatusOK, resp.StatusCode, "the same client may reuse its token")
+	resp, _ = postRequest(t, ts.URL, req)
+	require.Equal(t, http.StatusForbidden, resp.StatusCode)
+	req.Nonce, req.Timestamp = "fresh", time.Now().Add(-time.Hour).Unix()
+	resp, _ = postRequest(t, ts.URL, req)
+	require.Equal(t, http.StatusForbidden, resp.StatusCode)
+
+	// the token is bound to the client key it was first sent with, so it
+	// cannot be resent with a fresh nonce for another key
+	clientPub, _, err := newPairRSA(Defaults.BitsizeRSA)
+	require.NoError(t, err)
+	req.Nonce, req.Timestamp, req.ClientPubKey = "stolen", time.Now().Unix(), clientPub
+	resp, _ = postRequest(t, ts.URL, req)
+	require.Equal(t, http.StatusForbidden, resp.StatusCode)
+
+	// claims mapping to another service read that service's pool instead
+	other := testJWT(t, keys[2], keys[2].alg, testClaims("grackleclub/web"))
+	req.Nonce, req.Timestamp, req.Token = "other", time.Now().Unix(), other
+	resp, _ = postRequest(t, ts.URL, req)
+	require.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	// registry key signatures are not accepted in OIDC mode
+	_, signingPriv, err := NewPairEd25519()
+	require.NoError(t, err)
+	signed := craftRequest(t, server.key.Public().PEM(), signingPriv, testSecretName, clientPub, time.Now().Unix())
+	resp, _ = postRequest(t, ts.URL, signed)
+	require.Equal(t, http.StatusForbidden, resp.StatusCode)
+}
+
+func TestJWKThumbprint(t *testing.T) {
+	// RFC 7638, section 3.1
+	n, err := base64.RawURLEncoding.DecodeString("0vx7agoebGcQSuuPiLJXZptN9nndrQmbXEps2aiAFbWhM78LhWx4cbbfAAtVT86zwu1RK7aPFFxuhDR1L6tSoc_BJECPebWKRXjBZCiFV4n3oknjhMstn64tZ_2W-5JsGY4Hc5n9yBXArwl93lqt7_RN5w6Cf0h4QyQ5v-65YGjQR0_FDW2QvzqY368QQMicAtaSqzs8KJZgnYb9c7d0zgdAZHzu6qMQvRL5hajrn1n91CbOpbISD08qNLyrdkt-bFTWhAI4vMQFh6WeZu0fM4lFd2NcRwr3XPksINHaQ-G_xBniIqbw0Ls1jF44-csFCur-kEgU8awapJzKnqDKgw")
+	require.NoError(t, err)
+	key := &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: 65537}
+	require.Equal(t, "NzbLsXh8uDCcd-6MNwXF4W_7noWXFZAfHkxZsRGC9Xs", jwkThumbprint(key))
+}
+
+// TestHandlerOIDCKeyBinding fetches a secret with a token bound to the
+// client key by its "cnf" claim, which no other key can use, on any server.
+func TestHandlerOIDCKeyBinding(t *testing.T) {
+	keys := newTestIssuerKeys(t)
+	jwksFile := filepath.Join(t.TempDir(), "jwks.json")
+	require.NoError(t, os.WriteFile(jwksFile, testJWKS(t, keys...), 0o600))
+	cfg := testOIDC(jwksFile)
+	cfg.RequireKeyBinding = true
+	ts, server := newTestServerWith(t, nil, WithOIDC(&cfg))
+	// a replica, or the server restarted: it has seen no token
+	replicaTS, replica := newTestServerWith(t, nil, WithOIDC(&cfg))
+
+	var client *Client
+	var token string
+	client, err := NewClientWithToken(ts.URL, func() (string, error) {
+		claims := testClaims("grackleclub/deploy")
+		claims["cnf"] = map[string]string{"jkt": client.KeyThumbprint()}
+		token = testJWT(t, keys[0], keys[0].alg, claims)
+		return token, nil
+	})
+	require.NoError(t, err)
+	got, err := client.FetchSecret(testSecretName)
+	require.NoError(t, err)
+	require.Equal(t, testSecretValue, got)
+
+	request := func(server *Server, clientPub, token string) kvRequest {
+		nonce, err := newNonce()
+		require.NoError(t, err)
+		return kvRequest{
+			Version:      protocolVersion,
+			ServerKeyID:  server.key.Public().ID(),
+			Payload:      testEncrypt(t, server.key.Public().PEM(), testSecretName),
+			ClientPubKey: clientPub,
+			Timestamp:    time.Now().Unix(),
+			Nonce:        nonce,
+			Token:        token,
+		}
+	}
+
+	// a replayed token with a fresh nonce is refused for another key
+	stolenPub, _, err := newPairRSA(Defaults.BitsizeRSA)
+	require.NoError(t, err)
+	resp, _ := postRequest(t, ts.URL, request(server, stolenPub, token))
+	require.Equal(t, http.StatusForbidden, resp.StatusCode)
+	resp, _ = postRequest(t, replicaTS.URL, request(replica, stolenPub, token))
+	require.Equal(t, http.StatusForbidden, resp.StatusCode, "before the bound client")
+
+	// the bound client's key is accepted everywhere
+	resp, _ = postRequest(t, replicaTS.URL, request(replica, client.key.Public().PEM(), token))
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	// unbound tokens are refused
+	unbound := testJWT(t, keys[0], keys[0].alg, testClaims("grackleclub/deploy"))
+	resp, _ = postRequest(t, ts.URL, request(server, client.key.Public().PEM(), unbound))
+	require.Equal(t, http.StatusForbidden, resp.StatusCode)
+}
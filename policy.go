@@ -0,0 +1,220 @@
+package locket
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+/*
+Policy decides which secrets a verified service may read.
+
+Without a policy a service may read only its own secrets, i.e. whatever
+the source loaded under its (lowercased) name. A policy replaces that
+implicit rule with explicit grants, which also allows several services to
+share a pool of secrets loaded under a separate name, instead of
+duplicating the value under each service.
+
+Rules are evaluated in order. A matching deny rule always wins; otherwise
+the first matching allow rule decides which pool the value is read from.
+Anything not explicitly allowed is denied.
+*/
+
+const (
+	EffectAllow = "allow"
+	EffectDeny  = "deny"
+)
+
+// Policy is an ordered set of access rules, typically loaded from a YAML
+// file kept alongside the registry (see LoadPolicy).
+type Policy struct {
+	Rules []PolicyRule `yaml:"rules" json:"rules"`
+}
+
+// PolicyRule grants (or denies) services read access to secrets.
+// A rule matches a service if any of Services match it and, if set,
+// Selector matches the labels of its registry entry; either may be
+// omitted, but not both.
+// A rule matches a secret if any of Names, Globs or Prefixes match it.
+type PolicyRule struct {
+	Services []string `yaml:"services,omitempty" json:"services,omitempty"` // service names or path.Match globs; "*" matches all
+	Selector string   `yaml:"selector,omitempty" json:"selector,omitempty"` // LabelSelector over the service's registry labels
+	Effect   string   `yaml:"effect,omitempty"   json:"effect,omitempty"`   // EffectAllow (default) or EffectDeny
+	Pool     string   `yaml:"pool,omitempty"     json:"pool,omitempty"`     // secrets pool to read; empty means the service's own
+	Names    []string `yaml:"names,omitempty"    json:"names,omitempty"`    // exact secret names
+	Globs    []string `yaml:"globs,omitempty"    json:"globs,omitempty"`    // path.Match patterns over secret names
+	Prefixes []string `yaml:"prefixes,omitempty" json:"prefixes,omitempty"` // secret name prefixes
+}
+
+// Decision is the outcome of evaluating a Policy for a service/secret pair.
+type Decision struct {
+	Allowed bool   // whether the service may read the secret
+	Pool    string // lowercased secrets pool the value is read from, if allowed
+	Rule    int    // index of the deciding rule, or -1 if none matched
+	Reason  string // human readable explanation
+}
+
+func (d Decision) String() string {
+	verdict := "denied"
+	if d.Allowed {
+		verdict = "allowed"
+	}
+	return fmt.Sprintf("%s: %s", verdict, d.Reason)
+}
+
+// LoadPolicy reads and validates a YAML policy file.
+func LoadPolicy(path string) (*Policy, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read file: %w", err)
+	}
+	var p Policy
+	err = yaml.Unmarshal(b, &p)
+	if err != nil {
+		return nil, fmt.Errorf("unmarshal: %w", err)
+	}
+	err = p.Validate()
+	if err != nil {
+		return nil, fmt.Errorf("validate: %w", err)
+	}
+	return &p, nil
+}
+
+// Validate reports the first malformed rule, if any.
+func (p *Policy) Validate() error {
+	if p == nil {
+		return nil
+	}
+	for i, rule := range p.Rules {
+		switch rule.Effect {
+		case "", EffectAllow, EffectDeny:
+		default:
+			return fmt.Errorf("rule %d: invalid effect %q", i, rule.Effect)
+		}
+		if len(rule.Services) == 0 && rule.Selector == "" {
+			return fmt.Errorf("rule %d: no services or selector", i)
+		}
+		if _, err := ParseLabelSelector(rule.Selector); err != nil {
+			return fmt.Errorf("rule %d: %w", i, err)
+		}
+		if len(rule.Names)+len(rule.Globs)+len(rule.Prefixes) == 0 {
+			return fmt.Errorf("rule %d: no names, globs or prefixes", i)
+		}
+		for _, pattern := range append(rule.Services, rule.Globs...) {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return fmt.Errorf("rule %d: pattern %q: %w", i, pattern, err)
+			}
+		}
+	}
+	return nil
+}
+
+// Explain evaluates the policy for service reading secret, and reports
+// whether it is allowed, from which pool, and why. A nil Policy applies
+// the implicit rule: a service may read any secret in its own pool.
+// The service is taken to have no labels, see ExplainLabels.
+func (p *Policy) Explain(service, secret string) Decision {
+	return p.ExplainLabels(service, nil, secret)
+}
+
+// ExplainLabels is Explain for a service whose registry entry has labels,
+// matched by rule selectors.
+func (p *Policy) ExplainLabels(service string, labels map[string]string, secret string) Decision {
+	own := strings.ToLower(service)
+	if p == nil {
+		return Decision{
+			Allowed: true,
+			Pool:    own,
+			Rule:    -1,
+			Reason:  "no policy configured, service reads its own pool",
+		}
+	}
+
+	allow := -1
+	for i, rule := range p.Rules {
+		if !rule.matchesService(own, labels) {
+			continue
+		}
+		how, ok := rule.matchesSecret(secret)
+		if !ok {
+			continue
+		}
+		if rule.Effect == EffectDeny {
+			return Decision{
+				Rule:   i,
+				Reason: fmt.Sprintf("rule %d denies %q (%s)", i, secret, how),
+			}
+		}
+		if allow == -1 {
+			allow = i
+		}
+	}
+	if allow == -1 {
+		return Decision{
+			Rule:   -1,
+			Reason: fmt.Sprintf("no rule grants %q to %q", secret, own),
+		}
+	}
+
+	rule := p.Rules[allow]
+	pool := own
+	if rule.Pool != "" {
+		pool = strings.ToLower(rule.Pool)
+	}
+	how, _ := rule.matchesSecret(secret)
+	return Decision{
+		Allowed: true,
+		Pool:    pool,
+		Rule:    allow,
+		Reason: fmt.Sprintf("rule %d grants %q from pool %q (%s)",
+			allow, secret, pool, how,
+		),
+	}
+}
+
+// matchesService reports whether the (lowercased) service, with labels,
+// is covered by the rule. Service patterns are compared case-insensitively,
+// matching how sources key their pools.
+func (r PolicyRule) matchesService(service string, labels map[string]string) bool {
+	if r.Selector != "" {
+		sel, err := ParseLabelSelector(r.Selector)
+		if err != nil || !sel.Matches(labels) {
+			return false
+		}
+		if len(r.Services) == 0 {
+			return true
+		}
+	}
+	for _, pattern := range r.Services {
+		ok, err := path.Match(strings.ToLower(pattern), service)
+		if err == nil && ok {
+			return true
+		}
+	}
+	return false
+}
+
+// matchesSecret reports whether secret is covered by the rule, and how.
+// Secret names are matched exactly (case-sensitive), as sources store them.
+func (r PolicyRule) matchesSecret(secret string) (string, bool) {
+	for _, name := range r.Names {
+		if name == secret {
+			return "name " + name, true
+		}
+	}
+	for _, pattern := range r.Globs {
+		ok, err := path.Match(pattern, secret)
+		if err == nil && ok {
+			return "glob " + pattern, true
+		}
+	}
+	for _, prefix := range r.Prefixes {
+		if strings.HasPrefix(secret, prefix) {
+			return "prefix " + prefix, true
+		}
+	}
+	return "", false
+}
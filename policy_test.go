@@ -0,0 +1,142 @@
+package locket
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+var testPolicyFile = filepath.Join("example", "policy.yml")
+
+func TestPolicyExplain(t *testing.T) {
+	policy, err := LoadPolicy(testPolicyFile)
+	require.NoError(t, err)
+
+	tests := []struct {
+		service string
+		secret  string
+		allowed bool
+		pool    string
+		rule    int
+	}{
+		{"SERVICE1", "SHARED_VAR", true, "shared", 0},
+		{"service2", "SHARED_VAR", true, "shared", 0},
+		{"SERVICE1", "SERVICE1_FOO", true, "service1", 1},
+		{"SERVICE2", "SERVICE2_FOO", true, "service2", 1},
+		{"SERVICE2", "SERVICE2_SYMBOLS", false, "", 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.service+"/"+tt.secret, func(t *testing.T) {
+			d := policy.Explain(tt.service, tt.secret)
+			t.Logf("%s", d)
+			require.Equal(t, tt.allowed, d.Allowed)
+			require.Equal(t, tt.pool, d.Pool)
+			require.Equal(t, tt.rule, d.Rule)
+			require.NotEmpty(t, d.Reason)
+		})
+	}
+}
+
+func TestPolicyDefaultDeny(t *testing.T) {
+	policy := &Policy{Rules: []PolicyRule{
+		{Services: []string{"svc-*"}, Prefixes: []string{"DB_"}},
+	}}
+	require.NoError(t, policy.Validate())
+
+	require.True(t, policy.Explain("svc-a", "DB_PASS").Allowed)
+	d := policy.Explain("svc-a", "API_KEY")
+	require.False(t, d.Allowed)
+	require.Equal(t, -1, d.Rule)
+	require.False(t, policy.Explain("other", "DB_PASS").Allowed)
+}
+
+// TestPolicyNilImplicit confirms a nil policy keeps the original behavior: a
+// service reads only its own lowercased pool.
+func TestPolicyNilImplicit(t *testing.T) {
+	var policy *Policy
+	d := policy.Explain("SERVICE1", "ANYTHING")
+	require.True(t, d.Allowed)
+	require.Equal(t, "service1", d.Pool)
+}
+
+func TestPolicyValidate(t *testing.T) {
+	bad := []PolicyRule{
+		{Services: []string{"a"}, Effect: "maybe", Names: []string{"X"}},
+		{Names: []string{"X"}},
+		{Services: []string{"a"}},
+		{Services: []string{"a"}, Globs: []string{"[x"}},
+	}
+	for _, rule := range bad {
+		p := &Policy{Rules: []PolicyRule{rule}}
+		require.Error(t, p.Validate(), "%+v", rule)
+	}
+}
+
+// TestHandlerPolicySharedPool fetches a secret loaded once into a shared pool
+// by a service granted access through the policy, and confirms a denied
+// secret is refused even though it is present in the service's own pool.
+func TestHandlerPolicySharedPool(t *testing.T) {
+	pub, priv, err := NewPairEd25519()
+	require.NoError(t, err)
+	reg := FileRegistry{Path: filepath.Join(t.TempDir(), "registry.yml")}
+	require.NoError(t, reg.Upsert(RegEntry{Name: "SERVICE2", KeyPub: pub}))
+
+	policy, err := LoadPolicy(testPolicyFile)
+	require.NoError(t, err)
+	source := Dotenv{
+		Path: testEnvFile,
+		ServiceSecrets: map[string][]string{
+			"SERVICE2": {"SERVICE2_FOO", "SERVICE2_SYMBOLS"},
+			"shared":   {"SHARED_VAR"},
+		},
+	}
+	server, err := NewServer(
+		context.Background(), source, reg, 0, nil, WithPolicy(policy),
+	)
+	require.NoError(t, err)
+	t.Cleanup(server.Close)
+	ts := httptest.NewServer(http.HandlerFunc(server.Handler))
+	t.Cleanup(ts.Close)
+
+	clientPub, clientPriv, err := newPairRSA(Defaults.BitsizeRSA)
+	require.NoError(t, err)
+
+	req := craftRequest(t, server.key.Public().PEM(), priv, "SHARED_VAR", clientPub, time.Now().Unix())
+	resp, body := postRequest(t, ts.URL, req)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	var kv kvResponse
+	require.NoError(t, json.Unmarshal(body, &kv))
+	got, err := testDecrypt(t, clientPriv, kv.Payload)
+	require.NoError(t, err)
+	require.Equal(t, "sharedpassword", got)
+
+	req = craftRequest(t, server.key.Public().PEM(), priv, "SERVICE2_SYMBOLS", clientPub, time.Now().Unix())
+	resp, _ = postRequest(t, ts.URL, req)
+	require.Equal(t, http.StatusForbidden, resp.StatusCode)
+}
+
+func TestPolicySelector(t *testing.T) {
+	policy := &Policy{Rules: []PolicyRule{
+		{Selector: "team=payments", Pool: "payments", Prefixes: []string{"STRIPE_"}},
+		{Services: []string{"svc-*"}, Selector: "env=prod", Effect: EffectDeny, Prefixes: []string{"DEBUG_"}},
+		{Services: []string{"*"}, Globs: []string{"*"}},
+	}}
+	require.NoError(t, policy.Validate())
+	payments := map[string]string{"team": "payments", "env": "prod"}
+
+	d := policy.ExplainLabels("svc-a", payments, "STRIPE_KEY")
+	require.True(t, d.Allowed)
+	require.Equal(t, "payments", d.Pool)
+	require.Equal(t, "svc-a", policy.ExplainLabels("svc-a", nil, "STRIPE_KEY").Pool, "unlabelled")
+	require.False(t, policy.ExplainLabels("svc-a", payments, "DEBUG_TOKEN").Allowed)
+	require.True(t, policy.ExplainLabels("other", payments, "DEBUG_TOKEN").Allowed, "service must match too")
+
+	require.Error(t, (&Policy{Rules: []PolicyRule{{Prefixes: []string{"X"}}}}).Validate(), "no services or selector")
+	require.Error(t, (&Policy{Rules: []PolicyRule{{Selector: "a b", Prefixes: []string{"X"}}}}).Validate())
+}
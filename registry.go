@@ -3,6 +3,8 @@ package locket
 import (
 	"fmt"
 	"os"
+	"path/filepath"
+	"time"
 
 	"gopkg.in/yaml.v3"
 )
@@ -18,9 +20,260 @@ are created before deploying either server or client.
 // RegEntry is a single registry item,
 // representing a single client which
 // the server should recognize and authorize.
+// KeyPub is the client's ed25519 public signing key, as PEM
+// or as an authorized_keys line ("ssh-ed25519 AAAA...").
+// Keys holds any further keys, each optionally bounded in time, so a
+// service can hold several valid keys while rotating (see KeyRotator).
+// ExpiresAt, if set, refuses every key of the entry from that time on.
+// The remaining fields are metadata for audits, not used to authenticate;
+// Labels can be matched by a LabelSelector, and fields this version does
+// not know are kept in Extra, so rewriting an entry preserves them.
 type RegEntry struct {
-	Name   string `yaml:"name"   json:"name"`
-	KeyPub string `yaml:"keypub" json:"keypub"`
+	Name        string            `yaml:"name"                  json:"name"`
+	KeyPub      string            `yaml:"keypub"                json:"keypub,omitempty"`
+	Keys        []RegKey          `yaml:"keys,omitempty"        json:"keys,omitempty"`
+	ExpiresAt   *time.Time        `yaml:"expires_at,omitempty"  json:"expires_at,omitempty"`
+	Owner       string            `yaml:"owner,omitempty"       json:"owner,omitempty"`       // team or person responsible
+	Description string            `yaml:"description,omitempty" json:"description,omitempty"` // what the service is
+	Labels      map[string]string `yaml:"labels,omitempty"      json:"labels,omitempty"`      // see LabelSelector
+	CreatedAt   *time.Time        `yaml:"created_at,omitempty"  json:"created_at,omitempty"`  // set when the entry is created by Register or AddKey
+	RotatedAt   *time.Time        `yaml:"rotated_at,omitempty"  json:"rotated_at,omitempty"`  // set when an entry holding keys is given another
+	Extra       map[string]any    `yaml:",inline"               json:"-"`                     // unknown fields, see MarshalJSON
+}
+
+// RegKey is one of an entry's signing keys, valid from NotBefore
+// until NotAfter; either bound may be unset.
+type RegKey struct {
+	KeyPub    string     `yaml:"keypub"               json:"keypub"`
+	NotBefore *time.Time `yaml:"not_before,omitempty" json:"not_before,omitempty"`
+	NotAfter  *time.Time `yaml:"not_after,omitempty"  json:"not_after,omitempty"`
+}
+
+// ID returns the key ID of the key, see signingKeyID().
+func (k RegKey) ID() (string, error) {
+	key, err := ParseVerifyKey(k.KeyPub)
+	if err != nil {
+		return "", err
+	}
+	return key.ID(), nil
+}
+
+// ValidAt reports whether t is within the key's validity bounds.
+func (k RegKey) ValidAt(t time.Time) bool {
+	if k.NotBefore != nil && t.Before(*k.NotBefore) {
+		return false
+	}
+	if k.NotAfter != nil && !t.Before(*k.NotAfter) {
+		return false
+	}
+	return true
+}
+
+// AllKeys returns every key of the entry: KeyPub, if set, as an
+// unbounded key, followed by Keys.
+func (e RegEntry) AllKeys() []RegKey {
+	keys := make([]RegKey, 0, len(e.Keys)+1)
+	if e.KeyPub != "" {
+		keys = append(keys, RegKey{KeyPub: e.KeyPub})
+	}
+	return append(keys, e.Keys...)
+}
+
+// KeyRotator is implemented by registries that support rotating a
+// service's keys without a hard cutover:
+//  1. AddKey the new key; both keys are now accepted.
+//  2. Deploy the new private key to every instance.
+//  3. RetireKey the old key (now, or at a scheduled time), then
+//     optionally RemoveKey it once retired.
+//
+// Keys are identified by key ID, see VerifyKey.ID().
+type KeyRotator interface {
+	// AddKey adds a key to the named entry, creating the entry if needed.
+	AddKey(name string, key RegKey) error
+	// RetireKey sets the key's NotAfter, after which it is refused.
+	RetireKey(name, keyID string, at time.Time) error
+	// RemoveKey deletes the key from the entry.
+	RemoveKey(name, keyID string) error
+}
+
+var (
+	_ KeyRotator = FileRegistry{}
+	_ KeyRotator = RemoteRegistry{}
+)
+
+// addKey adds key to e, refusing an unparseable or duplicate key.
+func (e *RegEntry) addKey(key RegKey) error {
+	id, err := key.ID()
+	if err != nil {
+		return fmt.Errorf("parse key: %w", err)
+	}
+	keys := e.AllKeys()
+	for _, k := range keys {
+		if kid, _ := k.ID(); kid == id {
+			return fmt.Errorf("key %s already registered to %q", id, e.Name)
+		}
+	}
+	e.Keys = append(e.Keys, key)
+	if len(keys) > 0 {
+		now := time.Now().UTC()
+		e.RotatedAt = &now
+	}
+	return nil
+}
+
+// register replaces the keys of e with keyPub, as Register does, keeping
+// its metadata.
+func (e *RegEntry) register(keyPub string) {
+	if len(e.AllKeys()) > 0 {
+		now := time.Now().UTC()
+		e.RotatedAt = &now
+	}
+	e.KeyPub, e.Keys, e.ExpiresAt = keyPub, nil, nil
+}
+
+// retireKey sets NotAfter on the key with the given ID. A retired KeyPub
+// is moved into Keys, since KeyPub has no validity bounds.
+func (e *RegEntry) retireKey(keyID string, at time.Time) error {
+	if e.KeyPub != "" {
+		if id, _ := (RegKey{KeyPub: e.KeyPub}).ID(); id == keyID {
+			e.Keys = append([]RegKey{{KeyPub: e.KeyPub}}, e.Keys...)
+			e.KeyPub = ""
+		}
+	}
+	for i, k := range e.Keys {
+		if id, _ := k.ID(); id == keyID {
+			at := at.UTC()
+			e.Keys[i].NotAfter = &at
+			return nil
+		}
+	}
+	return fmt.Errorf("key %s not registered to %q", keyID, e.Name)
+}
+
+// removeKey deletes the key with the given ID.
+func (e *RegEntry) removeKey(keyID string) error {
+	if e.KeyPub != "" {
+		if id, _ := (RegKey{KeyPub: e.KeyPub}).ID(); id == keyID {
+			e.KeyPub = ""
+			return nil
+		}
+	}
+	for i, k := range e.Keys {
+		if id, _ := k.ID(); id == keyID {
+			e.Keys = append(e.Keys[:i], e.Keys[i+1:]...)
+			return nil
+		}
+	}
+	return fmt.Errorf("key %s not registered to %q", keyID, e.Name)
+}
+
+// modifyEntry applies fn to a copy of the named entry of entries, and
+// returns it. If create is set, a missing entry is created.
+func modifyEntry(entries []RegEntry, name string, create bool, fn func(*RegEntry) error) (RegEntry, error) {
+	entry := RegEntry{Name: name}
+	found := false
+	for _, e := range entries {
+		if e.Name == name {
+			entry = e
+			entry.Keys = append([]RegKey(nil), e.Keys...)
+			found = true
+			break
+		}
+	}
+	if !found && !create {
+		return RegEntry{}, fmt.Errorf("entry %q not found", name)
+	}
+	if !found {
+		now := time.Now().UTC()
+		entry.CreatedAt = &now
+	}
+	err := fn(&entry)
+	return entry, err
+}
+
+// upsertEntry replaces the entry of the same name in entries, or
+// appends it.
+func upsertEntry(entries []RegEntry, entry RegEntry) []RegEntry {
+	for i, e := range entries {
+		if e.Name == entry.Name {
+			entries[i] = entry
+			return entries
+		}
+	}
+	return append(entries, entry)
+}
+
+// mergeEntry returns entry with the metadata it leaves unset taken from
+// existing: owner, description, labels, timestamps and unknown fields.
+// Keys and expiry are entry's, as given.
+func mergeEntry(existing, entry RegEntry) RegEntry {
+	if entry.Owner == "" {
+		entry.Owner = existing.Owner
+	}
+	if entry.Description == "" {
+		entry.Description = existing.Description
+	}
+	if entry.Labels == nil {
+		entry.Labels = existing.Labels
+	}
+	if entry.CreatedAt == nil {
+		entry.CreatedAt = existing.CreatedAt
+	}
+	if entry.RotatedAt == nil {
+		entry.RotatedAt = existing.RotatedAt
+	}
+	if entry.Extra == nil {
+		entry.Extra = existing.Extra
+	}
+	return entry
+}
+
+// EntryReplacer is implemented by registries whose Upsert keeps metadata
+// an entry leaves unset, to write an entry exactly as given instead, as
+// ImportRegistry does.
+type EntryReplacer interface {
+	// Replace inserts or overwrites a client entry by name.
+	Replace(RegEntry) error
+}
+
+var _ EntryReplacer = FileRegistry{}
+
+// upsertRotator implements KeyRotator for any Registry by reading and
+// upserting the whole entry.
+type upsertRotator struct {
+	reg Registry
+}
+
+// updateEntry applies fn to the named entry with a read-modify-write
+// through Entries and Upsert.
+func (u upsertRotator) updateEntry(name string, create bool, fn func(*RegEntry) error) error {
+	entries, err := u.reg.Entries()
+	if err != nil {
+		return fmt.Errorf("read existing: %w", err)
+	}
+	entry, err := modifyEntry(entries, name, create, fn)
+	if err != nil {
+		return err
+	}
+	return u.reg.Upsert(entry)
+}
+
+func (u upsertRotator) AddKey(name string, key RegKey) error {
+	return u.updateEntry(name, true, func(e *RegEntry) error {
+		return e.addKey(key)
+	})
+}
+
+func (u upsertRotator) RetireKey(name, keyID string, at time.Time) error {
+	return u.updateEntry(name, false, func(e *RegEntry) error {
+		return e.retireKey(keyID, at)
+	})
+}
+
+func (u upsertRotator) RemoveKey(name, keyID string) error {
+	return u.updateEntry(name, false, func(e *RegEntry) error {
+		return e.removeKey(keyID)
+	})
 }
 
 // Registry reads and writes authorized client entries.
@@ -36,8 +289,18 @@ type Registry interface {
 }
 
 // FileRegistry is a Registry backed by a local YAML file.
+//
+// Writes are atomic: the new file is written and fsynced beside the old
+// one, then renamed over it, so a crash leaves either the old or the new
+// registry, never a partial one. Each read-modify-write holds an advisory
+// lock on Path + ".lock", so concurrent writers, in this process or
+// others, do not lose each other's updates.
+// If Backup is set, the previous file is kept as Path + ".bak".
+// WatchInterval is how often Watch checks the file for changes.
 type FileRegistry struct {
-	Path string
+	Path          string
+	Backup        bool
+	WatchInterval time.Duration
 }
 
 // Entries reads all authorized clients from the YAML file.
@@ -58,79 +321,208 @@ func (f FileRegistry) Entries() ([]RegEntry, error) {
 // If the file does not exist, it is created. The name is stored verbatim
 // (exact-match, case-sensitive) to match the RemoteRegistry / cloud contract;
 // derive a clean service name before calling if needed.
+// An existing entry takes the keys and expiry of entry, and keeps any
+// metadata entry leaves unset, see mergeEntry; Replace overwrites it.
 func (f FileRegistry) Upsert(entry RegEntry) error {
-	var entries []RegEntry
-	_, err := os.Stat(f.Path)
-	switch {
-	case err == nil:
-		entries, err = f.Entries()
-		if err != nil {
-			return fmt.Errorf("read existing: %w", err)
+	return f.update(false, func(entries []RegEntry) ([]RegEntry, error) {
+		for _, e := range entries {
+			if e.Name == entry.Name {
+				return upsertEntry(entries, mergeEntry(e, entry)), nil
+			}
 		}
-	case !os.IsNotExist(err):
-		return fmt.Errorf("stat file: %w", err)
+		return append(entries, entry), nil
+	})
+}
+
+// Replace inserts or overwrites a client entry in the YAML file, as given,
+// see EntryReplacer.
+func (f FileRegistry) Replace(entry RegEntry) error {
+	return f.update(false, func(entries []RegEntry) ([]RegEntry, error) {
+		return upsertEntry(entries, entry), nil
+	})
+}
+
+// update runs a read-modify-write cycle under the registry lock: fn is
+// given the current entries and returns those to write. Unless mustExist
+// is set, a missing file reads as no entries.
+func (f FileRegistry) update(mustExist bool, fn func([]RegEntry) ([]RegEntry, error)) error {
+	unlock, err := lockFile(f.Path + ".lock")
+	if err != nil {
+		return fmt.Errorf("lock registry: %w", err)
 	}
+	defer unlock()
 
-	replaced := false
-	for i, e := range entries {
-		if e.Name == entry.Name {
-			entries[i].KeyPub = entry.KeyPub
-			replaced = true
-			break
-		}
+	var entries []RegEntry
+	if mustExist {
+		entries, err = f.Entries()
+	} else {
+		entries, err = f.existing()
+	}
+	if err != nil {
+		return fmt.Errorf("read existing: %w", err)
 	}
-	if !replaced {
-		entries = append(entries, entry)
+	before := append([]RegEntry(nil), entries...)
+	entries, err = fn(entries)
+	if err != nil {
+		return err
+	}
+	if err := validateChange(before, entries); err != nil {
+		return err
 	}
-
 	return f.write(entries)
 }
 
+// existing reads the entries of the YAML file, or none if it does
+// not exist yet.
+func (f FileRegistry) existing() ([]RegEntry, error) {
+	_, err := os.Stat(f.Path)
+	switch {
+	case err == nil:
+		return f.Entries()
+	case os.IsNotExist(err):
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("stat file: %w", err)
+	}
+}
+
 // Delete removes a client entry by name from the YAML file.
 func (f FileRegistry) Delete(name string) error {
-	entries, err := f.Entries()
-	if err != nil {
-		return fmt.Errorf("read existing: %w", err)
-	}
-	filtered := entries[:0]
-	for _, e := range entries {
-		if e.Name != name {
-			filtered = append(filtered, e)
+	return f.update(true, func(entries []RegEntry) ([]RegEntry, error) {
+		filtered := entries[:0]
+		for _, e := range entries {
+			if e.Name != name {
+				filtered = append(filtered, e)
+			}
 		}
-	}
-	return f.write(filtered)
+		return filtered, nil
+	})
 }
 
-// Register generates a new ed25519 signing keypair, upserts the
-// public key into the YAML file, and returns the keypair.
+// Register generates a new ed25519 signing keypair, makes its public key
+// the only key of the named entry in the YAML file, and returns the
+// keypair. The entry's metadata is kept, or CreatedAt set for a new entry.
 func (f FileRegistry) Register(name string) (string, string, error) {
 	pub, priv, err := NewPairEd25519()
 	if err != nil {
 		return "", "", fmt.Errorf("generate key pair: %w", err)
 	}
-	err = f.Upsert(RegEntry{Name: name, KeyPub: pub})
+	err = f.updateEntry(name, true, func(e *RegEntry) error {
+		e.register(pub)
+		return nil
+	})
 	if err != nil {
 		return "", "", fmt.Errorf("upsert: %w", err)
 	}
 	return pub, priv, nil
 }
 
-// write serializes entries to the YAML file, creating or
-// truncating it as needed.
-func (f FileRegistry) write(entries []RegEntry) error {
-	file, err := os.Create(f.Path)
+// AddKey adds a signing key to the named entry, see KeyRotator.
+func (f FileRegistry) AddKey(name string, key RegKey) error {
+	return f.updateEntry(name, true, func(e *RegEntry) error {
+		return e.addKey(key)
+	})
+}
+
+// RetireKey bounds a signing key's validity to before at, see KeyRotator.
+func (f FileRegistry) RetireKey(name, keyID string, at time.Time) error {
+	return f.updateEntry(name, false, func(e *RegEntry) error {
+		return e.retireKey(keyID, at)
+	})
+}
+
+// RemoveKey deletes a signing key from the named entry, see KeyRotator.
+func (f FileRegistry) RemoveKey(name, keyID string) error {
+	return f.updateEntry(name, false, func(e *RegEntry) error {
+		return e.removeKey(keyID)
+	})
+}
+
+// updateEntry applies fn to the named entry under the registry lock.
+func (f FileRegistry) updateEntry(name string, create bool, fn func(*RegEntry) error) error {
+	return f.update(false, func(entries []RegEntry) ([]RegEntry, error) {
+		entry, err := modifyEntry(entries, name, create, fn)
+		if err != nil {
+			return nil, err
+		}
+		return upsertEntry(entries, entry), nil
+	})
+}
+
+// Rotate generates a new ed25519 signing keypair and adds its public key
+// to the named entry alongside the existing keys, returning the keypair.
+// Retire the old key with RetireKey once the new one is deployed.
+func (f FileRegistry) Rotate(name string) (string, string, error) {
+	pub, priv, err := NewPairEd25519()
 	if err != nil {
-		return fmt.Errorf("create file: %w", err)
+		return "", "", fmt.Errorf("generate key pair: %w", err)
 	}
-	defer file.Close()
+	err = f.AddKey(name, RegKey{KeyPub: pub})
+	if err != nil {
+		return "", "", fmt.Errorf("add key: %w", err)
+	}
+	return pub, priv, nil
+}
 
+// write serializes entries to the YAML file, atomically replacing it.
+// The caller must hold the registry lock.
+func (f FileRegistry) write(entries []RegEntry) error {
 	b, err := yaml.Marshal(entries)
 	if err != nil {
 		return fmt.Errorf("marshal: %w", err)
 	}
-	_, err = file.Write(b)
+	perm := os.FileMode(0o644)
+	info, err := os.Stat(f.Path)
+	switch {
+	case err == nil:
+		perm = info.Mode().Perm()
+		if f.Backup {
+			old, err := os.ReadFile(f.Path)
+			if err != nil {
+				return fmt.Errorf("read for backup: %w", err)
+			}
+			err = writeFileAtomic(f.Path+".bak", old, perm)
+			if err != nil {
+				return fmt.Errorf("write backup: %w", err)
+			}
+		}
+	case !os.IsNotExist(err):
+		return fmt.Errorf("stat file: %w", err)
+	}
+	return writeFileAtomic(f.Path, b, perm)
+}
+
+// writeFileAtomic replaces path with data: it writes a temporary file in
+// the same directory, fsyncs it, renames it over path, and fsyncs the
+// directory, so readers and crashes see either the old or the new file.
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	dir, base := filepath.Split(path)
+	if dir == "" {
+		dir = "."
+	}
+	tmp, err := os.CreateTemp(dir, "."+base+".tmp-*")
 	if err != nil {
-		return fmt.Errorf("write file: %w", err)
+		return fmt.Errorf("create temp file: %w", err)
 	}
-	return nil
+	// removes the temp file on failure; a no-op once it is renamed
+	defer os.Remove(tmp.Name())
+
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Chmod(perm)
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("write temp file: %w", err)
+	}
+	err = os.Rename(tmp.Name(), path)
+	if err != nil {
+		return fmt.Errorf("rename: %w", err)
+	}
+	return syncDir(dir)
 }
@@ -0,0 +1,216 @@
+package locket
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// PathRegistryStatus is the API endpoint for CachedRegistry status.
+//   - GET: CacheStatus JSON; 503 Service Unavailable while the cache
+//     refuses to serve a stale snapshot
+var PathRegistryStatus = "/locket/registry/status"
+
+// ErrRegistryStale is returned by CachedRegistry.Entries when the backend
+// is unavailable and the snapshot is older than MaxAge, unless FailOpen.
+// A Server polling a CachedRegistry drops every key on this error.
+var ErrRegistryStale = errors.New("registry snapshot too old")
+
+// CachedRegistry wraps a Registry, usually a RemoteRegistry, so an outage
+// of the backend does not take the server down with it. Every successful
+// Entries call is saved to a snapshot file at Path; while the backend is
+// unavailable, including at startup, the snapshot is served instead.
+//
+// Once the snapshot is older than MaxAge (if set) it is stale: with
+// FailOpen it is still served, otherwise Entries returns ErrRegistryStale
+// and the server authorizes no one until the backend recovers.
+//
+// The snapshot carries a SHA-256 checksum, or an HMAC-SHA256 if Key is
+// set, and is ignored if it does not match. Writes go to the backend only.
+// A CachedRegistry must not be copied after first use.
+type CachedRegistry struct {
+	Registry Registry      // backend
+	Path     string        // snapshot file
+	MaxAge   time.Duration // max snapshot age served; 0 for no limit
+	FailOpen bool          // serve a stale snapshot rather than refuse
+	Key      []byte        // optional HMAC key authenticating the snapshot
+
+	mu     sync.Mutex
+	status CacheStatus
+}
+
+// CacheStatus reports whether a CachedRegistry is serving its snapshot.
+type CacheStatus struct {
+	Degraded    bool       `json:"degraded"`               // backend unavailable
+	Stale       bool       `json:"stale"`                  // snapshot older than MaxAge
+	Refusing    bool       `json:"refusing"`               // stale and not FailOpen
+	LastSuccess *time.Time `json:"last_success,omitempty"` // last backend fetch
+	SnapshotAt  *time.Time `json:"snapshot_at,omitempty"`  // when the served snapshot was saved
+	Error       string     `json:"error,omitempty"`        // last backend error
+}
+
+// registrySnapshot is the snapshot file format.
+type registrySnapshot struct {
+	SavedAt    time.Time           `json:"saved_at"`
+	Entries    []RegEntry          `json:"entries"`
+	Signatures []RegistrySignature `json:"signatures,omitempty"` // see SignedRegistry
+	Sum        string              `json:"sum"`                  // see snapshotSum()
+}
+
+var _ Registry = (*CachedRegistry)(nil)
+
+// Entries returns the backend's entries, saving them as the snapshot, or,
+// if the backend fails, the snapshot's.
+func (c *CachedRegistry) Entries() ([]RegEntry, error) {
+	entries, _, err := c.SignedEntries()
+	return entries, err
+}
+
+// SignedEntries is Entries with the backend's signatures, if it is a
+// SignedRegistry, which are saved in and served from the snapshot too.
+func (c *CachedRegistry) SignedEntries() ([]RegEntry, []RegistrySignature, error) {
+	now := time.Now().UTC()
+	var entries []RegEntry
+	var sigs []RegistrySignature
+	var err error
+	if signed, ok := c.Registry.(SignedRegistry); ok {
+		entries, sigs, err = signed.SignedEntries()
+	} else {
+		entries, err = c.Registry.Entries()
+	}
+	if err == nil {
+		if err := c.save(entries, sigs, now); err != nil {
+			// the entries are good; an unwritable snapshot only
+			// weakens the next outage
+			log.Error("save registry snapshot", "path", c.Path, "error", err)
+		}
+		c.mu.Lock()
+		if c.status.Degraded {
+			log.Info("registry backend recovered")
+		}
+		c.status = CacheStatus{LastSuccess: &now, SnapshotAt: &now}
+		c.mu.Unlock()
+		return entries, sigs, nil
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.status.Degraded = true
+	c.status.Error = err.Error()
+	snap, serr := c.load()
+	if serr != nil {
+		c.status.SnapshotAt = nil
+		c.status.Stale, c.status.Refusing = false, false
+		log.Error("registry backend unavailable, no snapshot",
+			"error", err, "snapshot_error", serr,
+		)
+		return nil, nil, fmt.Errorf("backend: %w; snapshot: %w", err, serr)
+	}
+	age := now.Sub(snap.SavedAt)
+	c.status.SnapshotAt = &snap.SavedAt
+	c.status.Stale = c.MaxAge > 0 && age > c.MaxAge
+	c.status.Refusing = c.status.Stale && !c.FailOpen
+	if c.status.Refusing {
+		log.Error("registry backend unavailable, snapshot too old",
+			"age", age.Round(time.Second), "max_age", c.MaxAge, "error", err,
+		)
+		return nil, nil, fmt.Errorf("%w: saved %s ago: %w", ErrRegistryStale, age.Round(time.Second), err)
+	}
+	log.Warn("registry backend unavailable, serving snapshot",
+		"age", age.Round(time.Second), "stale", c.status.Stale, "error", err,
+	)
+	return snap.Entries, snap.Signatures, nil
+}
+
+// Upsert upserts entry in the backend.
+func (c *CachedRegistry) Upsert(entry RegEntry) error {
+	return c.Registry.Upsert(entry)
+}
+
+// Delete deletes the named entry from the backend.
+func (c *CachedRegistry) Delete(name string) error {
+	return c.Registry.Delete(name)
+}
+
+// Status returns the state of the last Entries call.
+func (c *CachedRegistry) Status() CacheStatus {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.status
+}
+
+// ServeHTTP serves the status endpoint.
+func (c *CachedRegistry) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	status := c.Status()
+	w.Header().Set("Content-Type", "application/json")
+	if status.Refusing {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	if err := json.NewEncoder(w).Encode(status); err != nil {
+		log.Error("encode registry status", "error", err)
+	}
+}
+
+// save writes entries and their signatures as the snapshot.
+func (c *CachedRegistry) save(entries []RegEntry, sigs []RegistrySignature, savedAt time.Time) error {
+	snap := registrySnapshot{SavedAt: savedAt, Entries: entries, Signatures: sigs}
+	sum, err := c.snapshotSum(snap)
+	if err != nil {
+		return err
+	}
+	snap.Sum = sum
+	data, err := json.Marshal(snap)
+	if err != nil {
+		return fmt.Errorf("marshal: %w", err)
+	}
+	return writeFileAtomic(c.Path, data, 0o600)
+}
+
+// load reads and verifies the snapshot.
+func (c *CachedRegistry) load() (registrySnapshot, error) {
+	var snap registrySnapshot
+	data, err := os.ReadFile(c.Path)
+	if err != nil {
+		return snap, fmt.Errorf("read snapshot: %w", err)
+	}
+	if err := json.Unmarshal(data, &snap); err != nil {
+		return snap, fmt.Errorf("unmarshal snapshot: %w", err)
+	}
+	sum, err := c.snapshotSum(snap)
+	if err != nil {
+		return snap, err
+	}
+	if !hmac.Equal([]byte(sum), []byte(snap.Sum)) {
+		return snap, errors.New("snapshot checksum mismatch")
+	}
+	return snap, nil
+}
+
+// snapshotSum returns "sha256:<hex>", or "hmac-sha256:<hex>" given a Key,
+// over the snapshot's time, entries and signatures.
+func (c *CachedRegistry) snapshotSum(snap registrySnapshot) (string, error) {
+	snap.Sum = ""
+	data, err := json.Marshal(snap)
+	if err != nil {
+		return "", fmt.Errorf("marshal: %w", err)
+	}
+	if len(c.Key) == 0 {
+		sum := sha256.Sum256(data)
+		return "sha256:" + hex.EncodeToString(sum[:]), nil
+	}
+	mac := hmac.New(sha256.New, c.Key)
+	mac.Write(data)
+	return "hmac-sha256:" + hex.EncodeToString(mac.Sum(nil)), nil
+}
@@ -0,0 +1,159 @@
+package locket
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// flakyRegistry is a backend that can be taken down.
+type flakyRegistry struct {
+	mu      sync.Mutex
+	entries []RegEntry
+	down    bool
+}
+
+func (f *flakyRegistry) Entries() ([]RegEntry, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.down {
+		return nil, errors.New("backend down")
+	}
+	return f.entries, nil
+}
+func (f *flakyRegistry) Upsert(RegEntry) error { return nil }
+func (f *flakyRegistry) Delete(string) error   { return nil }
+func (f *flakyRegistry) setDown(down bool) {
+	f.mu.Lock()
+	f.down = down
+	f.mu.Unlock()
+}
+
+// ageSnapshot backdates the snapshot of c by age, keeping it valid.
+func ageSnapshot(t *testing.T, c *CachedRegistry, age time.Duration) {
+	t.Helper()
+	snap, err := c.load()
+	require.NoError(t, err)
+	require.NoError(t, c.save(snap.Entries, snap.Signatures, snap.SavedAt.Add(-age)))
+}
+
+func TestCachedRegistry(t *testing.T) {
+	backend := &flakyRegistry{entries: testRegistryItems}
+	c := &CachedRegistry{Registry: backend, Path: filepath.Join(t.TempDir(), "snapshot.json")}
+
+	backend.setDown(true)
+	_, err := c.Entries()
+	require.Error(t, err, "no snapshot yet")
+	require.True(t, c.Status().Degraded)
+
+	backend.setDown(false)
+	entries, err := c.Entries()
+	require.NoError(t, err)
+	require.Equal(t, testRegistryItems, entries)
+	require.False(t, c.Status().Degraded)
+
+	// a new process serves the snapshot while the backend is down
+	backend.setDown(true)
+	restarted := &CachedRegistry{Registry: backend, Path: c.Path}
+	entries, err = restarted.Entries()
+	require.NoError(t, err)
+	require.Equal(t, testRegistryItems, entries)
+	status := restarted.Status()
+	require.True(t, status.Degraded)
+	require.False(t, status.Stale)
+	require.NotNil(t, status.SnapshotAt)
+	require.Equal(t, "backend down", status.Error)
+
+	backend.setDown(false)
+	_, err = restarted.Entries()
+	require.NoError(t, err)
+	require.False(t, restarted.Status().Degraded)
+}
+
+func TestCachedRegistryMaxAge(t *testing.T) {
+	backend := &flakyRegistry{entries: testRegistryItems}
+	c := &CachedRegistry{Registry: backend, Path: filepath.Join(t.TempDir(), "snapshot.json"), MaxAge: time.Hour}
+	_, err := c.Entries()
+	require.NoError(t, err)
+	ageSnapshot(t, c, 2*time.Hour)
+	backend.setDown(true)
+
+	_, err = c.Entries()
+	require.ErrorIs(t, err, ErrRegistryStale)
+	require.True(t, c.Status().Refusing)
+
+	rec := httptest.NewRecorder()
+	c.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, PathRegistryStatus, nil))
+	require.Equal(t, http.StatusServiceUnavailable, rec.Code)
+	var status CacheStatus
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&status))
+	require.True(t, status.Stale)
+
+	c.FailOpen = true
+	entries, err := c.Entries()
+	require.NoError(t, err)
+	require.Equal(t, testRegistryItems, entries)
+	require.True(t, c.Status().Stale)
+	rec = httptest.NewRecorder()
+	c.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, PathRegistryStatus, nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+}
+
+func TestCachedRegistryTamperedSnapshot(t *testing.T) {
+	backend := &flakyRegistry{entries: testRegistryItems}
+	c := &CachedRegistry{Registry: backend, Path: filepath.Join(t.TempDir(), "snapshot.json"), Key: []byte("secret")}
+	_, err := c.Entries()
+	require.NoError(t, err)
+	backend.setDown(true)
+
+	// without the key the snapshot does not verify
+	_, err = (&CachedRegistry{Registry: backend, Path: c.Path}).Entries()
+	require.ErrorContains(t, err, "checksum mismatch")
+
+	var snap registrySnapshot
+	data, err := os.ReadFile(c.Path)
+	require.NoError(t, err)
+	require.NoError(t, json.Unmarshal(data, &snap))
+	snap.Entries = append(snap.Entries, RegEntry{Name: "intruder", KeyPub: testPub3})
+	data, err = json.Marshal(snap)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(c.Path, data, 0o600))
+	_, err = c.Entries()
+	require.ErrorContains(t, err, "checksum mismatch")
+}
+
+// TestServerCachedRegistry starts a server while the backend is down, then
+// drops every key once the snapshot goes stale.
+func TestServerCachedRegistry(t *testing.T) {
+	pub, _, err := NewPairEd25519()
+	require.NoError(t, err)
+	key, err := ParseVerifyKey(pub)
+	require.NoError(t, err)
+	backend := &flakyRegistry{entries: []RegEntry{{Name: "SERVICE1", KeyPub: pub}}}
+	c := &CachedRegistry{Registry: backend, Path: filepath.Join(t.TempDir(), "snapshot.json"), MaxAge: time.Hour}
+	_, err = c.Entries()
+	require.NoError(t, err)
+	backend.setDown(true)
+
+	source := Dotenv{Path: testEnvFile, ServiceSecrets: testServiceMap}
+	server, err := NewServer(context.Background(), source, c, 5*time.Millisecond, nil)
+	require.NoError(t, err)
+	defer server.Close()
+	_, ok := server.lookupKey(key.ID())
+	require.True(t, ok)
+
+	ageSnapshot(t, c, 2*time.Hour)
+	require.Eventually(t, func() bool {
+		_, ok := server.lookupKey(key.ID())
+		return !ok
+	}, time.Second, 5*time.Millisecond)
+}
@@ -0,0 +1,350 @@
+package locket
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// DirRegistry is a Registry backed by a directory holding each service's
+// entry in its own files, so entries can be added and reviewed in git
+// without conflicting:
+//   - <service>.pub: the service's public signing key (RegEntry.KeyPub)
+//   - <service>.yml: optional further fields (keys, expires_at, and
+//     metadata such as owner and labels)
+//
+// Either file alone makes an entry. Other files, subdirectories and
+// dotfiles are ignored. A file that cannot be parsed drops only its own
+// entry, see Load.
+//
+// Each file is written atomically, and writes hold an advisory lock on
+// the directory's ".lock" file.
+type DirRegistry struct {
+	Path string
+}
+
+// dirMeta is the format of a <service>.yml file: the fields of a RegEntry
+// but its name and first key, which are the files'.
+type dirMeta struct {
+	Keys        []RegKey          `yaml:"keys,omitempty"`
+	ExpiresAt   *time.Time        `yaml:"expires_at,omitempty"`
+	Owner       string            `yaml:"owner,omitempty"`
+	Description string            `yaml:"description,omitempty"`
+	Labels      map[string]string `yaml:"labels,omitempty"`
+	CreatedAt   *time.Time        `yaml:"created_at,omitempty"`
+	RotatedAt   *time.Time        `yaml:"rotated_at,omitempty"`
+	Extra       map[string]any    `yaml:",inline"`
+}
+
+// newDirMeta returns the fields of entry stored in its .yml file.
+func newDirMeta(e RegEntry) dirMeta {
+	return dirMeta{
+		Keys: e.Keys, ExpiresAt: e.ExpiresAt,
+		Owner: e.Owner, Description: e.Description, Labels: e.Labels,
+		CreatedAt: e.CreatedAt, RotatedAt: e.RotatedAt, Extra: e.Extra,
+	}
+}
+
+// apply sets the fields of m on entry.
+func (m dirMeta) apply(entry *RegEntry) {
+	entry.Keys, entry.ExpiresAt = m.Keys, m.ExpiresAt
+	entry.Owner, entry.Description, entry.Labels = m.Owner, m.Description, m.Labels
+	entry.CreatedAt, entry.RotatedAt, entry.Extra = m.CreatedAt, m.RotatedAt, m.Extra
+}
+
+// empty reports whether m holds nothing, so needs no file.
+func (m dirMeta) empty() bool {
+	return len(m.Keys) == 0 && m.ExpiresAt == nil &&
+		m.Owner == "" && m.Description == "" && len(m.Labels) == 0 &&
+		m.CreatedAt == nil && m.RotatedAt == nil && len(m.Extra) == 0
+}
+
+const (
+	dirKeyExt  = ".pub"
+	dirMetaExt = ".yml"
+)
+
+var _ KeyRotator = DirRegistry{}
+
+// Entries returns every entry that could be parsed, ordered by name.
+// Files that could not be parsed are logged and skipped.
+func (d DirRegistry) Entries() ([]RegEntry, error) {
+	entries, fileErrs, err := d.Load()
+	if err != nil {
+		return nil, err
+	}
+	for _, err := range fileErrs {
+		log.Warn("skipping registry file", "dir", d.Path, "error", err)
+	}
+	return entries, nil
+}
+
+// Load reads every entry, ordered by name. An entry whose files cannot
+// be parsed is left out, and reported in fileErrs instead; err is only
+// set if the directory itself cannot be read.
+func (d DirRegistry) Load() (entries []RegEntry, fileErrs []error, err error) {
+	files, err := os.ReadDir(d.Path)
+	if err != nil {
+		return nil, nil, fmt.Errorf("read dir: %w", err)
+	}
+	names := make(map[string]bool)
+	for _, f := range files {
+		name, ok := dirEntryName(f.Name())
+		if ok && !f.IsDir() {
+			names[name] = true
+		}
+	}
+	sorted := make([]string, 0, len(names))
+	for name := range names {
+		sorted = append(sorted, name)
+	}
+	sort.Strings(sorted)
+	for _, name := range sorted {
+		entry, err := d.read(name)
+		if err != nil {
+			fileErrs = append(fileErrs, err)
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	return entries, fileErrs, nil
+}
+
+// dirEntryName returns the service name of a registry file, or false if
+// the file is not part of the registry.
+func dirEntryName(file string) (string, bool) {
+	if strings.HasPrefix(file, ".") {
+		return "", false
+	}
+	for _, ext := range []string{dirKeyExt, dirMetaExt} {
+		if name, ok := strings.CutSuffix(file, ext); ok {
+			return name, true
+		}
+	}
+	return "", false
+}
+
+// read parses the files of the named entry. It returns an error naming
+// the file at fault.
+func (d DirRegistry) read(name string) (RegEntry, error) {
+	entry := RegEntry{Name: name}
+	keyFile := d.file(name, dirKeyExt)
+	if !RegistryNamePattern.MatchString(name) {
+		return entry, fmt.Errorf("%s: name does not match %s", keyFile, RegistryNamePattern)
+	}
+	b, err := os.ReadFile(keyFile)
+	switch {
+	case err == nil:
+		entry.KeyPub = string(b)
+		if _, err := ParseVerifyKey(entry.KeyPub); err != nil {
+			return entry, fmt.Errorf("%s: %w", keyFile, err)
+		}
+	case !errors.Is(err, os.ErrNotExist):
+		return entry, fmt.Errorf("%s: %w", keyFile, err)
+	}
+
+	metaFile := d.file(name, dirMetaExt)
+	b, err = os.ReadFile(metaFile)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		return entry, nil
+	case err != nil:
+		return entry, fmt.Errorf("%s: %w", metaFile, err)
+	}
+	var meta dirMeta
+	dec := yaml.NewDecoder(bytes.NewReader(b))
+	if err := dec.Decode(&meta); err != nil && !errors.Is(err, io.EOF) {
+		return entry, fmt.Errorf("%s: %w", metaFile, err)
+	}
+	for _, field := range []string{"name", "keypub"} {
+		if _, ok := meta.Extra[field]; ok {
+			return entry, fmt.Errorf("%s: %s is given by the file names", metaFile, field)
+		}
+	}
+	meta.apply(&entry)
+	if err := validateEntry(entry); err != nil {
+		return entry, fmt.Errorf("%s: %w", metaFile, err)
+	}
+	return entry, nil
+}
+
+// file returns the path of the named entry's file with extension ext.
+func (d DirRegistry) file(name, ext string) string {
+	return filepath.Join(d.Path, name+ext)
+}
+
+// Upsert writes the files of entry, replacing any of the same name. The
+// directory is created if needed.
+func (d DirRegistry) Upsert(entry RegEntry) error {
+	return d.update(func(entries []RegEntry) (RegEntry, error) {
+		return entry, nil
+	})
+}
+
+// Delete removes the files of the named entry.
+func (d DirRegistry) Delete(name string) error {
+	// the name becomes a path, so it must not escape the directory
+	if !RegistryNamePattern.MatchString(name) {
+		return fmt.Errorf("name %q does not match %s", name, RegistryNamePattern)
+	}
+	unlock, err := d.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	for _, ext := range []string{dirKeyExt, dirMetaExt} {
+		err := os.Remove(d.file(name, ext))
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("remove: %w", err)
+		}
+	}
+	return syncDir(d.Path)
+}
+
+// Register generates a new ed25519 signing keypair, writes the public
+// key to <name>.pub as the entry's only key, keeping its metadata, and
+// returns the keypair.
+func (d DirRegistry) Register(name string) (string, string, error) {
+	pub, priv, err := NewPairEd25519()
+	if err != nil {
+		return "", "", fmt.Errorf("generate key pair: %w", err)
+	}
+	err = d.updateEntry(name, true, func(e *RegEntry) error {
+		e.register(pub)
+		return nil
+	})
+	if err != nil {
+		return "", "", fmt.Errorf("upsert: %w", err)
+	}
+	return pub, priv, nil
+}
+
+// AddKey adds a signing key to the named entry, see KeyRotator.
+func (d DirRegistry) AddKey(name string, key RegKey) error {
+	return d.updateEntry(name, true, func(e *RegEntry) error {
+		return e.addKey(key)
+	})
+}
+
+// RetireKey bounds a signing key's validity to before at, see KeyRotator.
+func (d DirRegistry) RetireKey(name, keyID string, at time.Time) error {
+	return d.updateEntry(name, false, func(e *RegEntry) error {
+		return e.retireKey(keyID, at)
+	})
+}
+
+// RemoveKey deletes a signing key from the named entry, see KeyRotator.
+func (d DirRegistry) RemoveKey(name, keyID string) error {
+	return d.updateEntry(name, false, func(e *RegEntry) error {
+		return e.removeKey(keyID)
+	})
+}
+
+// Rotate generates a new ed25519 signing keypair and adds its public key
+// to the named entry alongside the existing keys, returning the keypair.
+func (d DirRegistry) Rotate(name string) (string, string, error) {
+	pub, priv, err := NewPairEd25519()
+	if err != nil {
+		return "", "", fmt.Errorf("generate key pair: %w", err)
+	}
+	err = d.AddKey(name, RegKey{KeyPub: pub})
+	if err != nil {
+		return "", "", fmt.Errorf("add key: %w", err)
+	}
+	return pub, priv, nil
+}
+
+// updateEntry applies fn to the named entry under the registry lock.
+func (d DirRegistry) updateEntry(name string, create bool, fn func(*RegEntry) error) error {
+	return d.update(func(entries []RegEntry) (RegEntry, error) {
+		return modifyEntry(entries, name, create, fn)
+	})
+}
+
+// update runs a read-modify-write cycle of one entry under the registry
+// lock: fn is given the current entries and returns the entry to write,
+// which must not make the registry invalid, see validateChange.
+func (d DirRegistry) update(fn func([]RegEntry) (RegEntry, error)) error {
+	if err := os.MkdirAll(d.Path, 0o755); err != nil {
+		return fmt.Errorf("create dir: %w", err)
+	}
+	unlock, err := d.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	before, fileErrs, err := d.Load()
+	if err != nil {
+		return fmt.Errorf("read existing: %w", err)
+	}
+	for _, err := range fileErrs {
+		log.Warn("skipping registry file", "dir", d.Path, "error", err)
+	}
+	entry, err := fn(before)
+	if err != nil {
+		return err
+	}
+	if err := validateEntry(entry); err != nil {
+		return err
+	}
+	after := upsertEntry(append([]RegEntry(nil), before...), entry)
+	if err := validateChange(before, after); err != nil {
+		return err
+	}
+	return d.write(entry)
+}
+
+// write writes the files of entry, removing any it no longer needs. The
+// caller must hold the registry lock.
+func (d DirRegistry) write(entry RegEntry) error {
+	keyFile, metaFile := d.file(entry.Name, dirKeyExt), d.file(entry.Name, dirMetaExt)
+	if entry.KeyPub != "" {
+		data := entry.KeyPub
+		if !strings.HasSuffix(data, "\n") {
+			data += "\n"
+		}
+		if err := writeFileAtomic(keyFile, []byte(data), 0o644); err != nil {
+			return fmt.Errorf("write %s: %w", keyFile, err)
+		}
+	} else if err := os.Remove(keyFile); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("remove %s: %w", keyFile, err)
+	}
+
+	meta := newDirMeta(entry)
+	if meta.empty() {
+		if err := os.Remove(metaFile); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("remove %s: %w", metaFile, err)
+		}
+		if entry.KeyPub == "" {
+			// keep a keyless entry
+			return writeFileAtomic(metaFile, []byte("{}\n"), 0o644)
+		}
+		return nil
+	}
+	b, err := yaml.Marshal(meta)
+	if err != nil {
+		return fmt.Errorf("marshal: %w", err)
+	}
+	if err := writeFileAtomic(metaFile, b, 0o644); err != nil {
+		return fmt.Errorf("write %s: %w", metaFile, err)
+	}
+	return nil
+}
+
+// lock takes the registry lock.
+func (d DirRegistry) lock() (func(), error) {
+	unlock, err := lockFile(filepath.Join(d.Path, ".lock"))
+	if err != nil {
+		return nil, fmt.Errorf("lock registry: %w", err)
+	}
+	return unlock, nil
+}
@@ -0,0 +1,99 @@
+package locket
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDirRegistryReadWrite(t *testing.T) {
+	reg := DirRegistry{Path: filepath.Join(t.TempDir(), "registry")}
+	for _, item := range testRegistryItems {
+		require.NoError(t, reg.Upsert(item))
+	}
+
+	entries, err := reg.Entries()
+	require.NoError(t, err)
+	// ordered by name
+	require.Equal(t, []RegEntry{testRegistryItems[1], testRegistryItems[0]}, entries)
+	b, err := os.ReadFile(filepath.Join(reg.Path, "foo1.pub"))
+	require.NoError(t, err)
+	require.Equal(t, testPub1, string(b))
+
+	require.Error(t, reg.Upsert(RegEntry{Name: "bad", KeyPub: "asdfasdf"}))
+	require.Error(t, reg.Upsert(RegEntry{Name: "../escape", KeyPub: testPub3}))
+	require.ErrorContains(t, reg.Upsert(RegEntry{Name: "other", KeyPub: testPub1}), "also registered")
+
+	outside := filepath.Join(filepath.Dir(reg.Path), "escape.pub")
+	require.NoError(t, os.WriteFile(outside, []byte(testPub3), 0o600))
+	require.Error(t, reg.Delete("../escape"))
+	require.FileExists(t, outside)
+
+	require.NoError(t, reg.Delete("foo1"))
+	entries, err = reg.Entries()
+	require.NoError(t, err)
+	require.Equal(t, []RegEntry{testRegistryItems[1]}, entries)
+}
+
+func TestDirRegistryMetadata(t *testing.T) {
+	reg := DirRegistry{Path: t.TempDir()}
+	pub, _, err := reg.Register("svc")
+	require.NoError(t, err)
+	newPub, _, err := reg.Rotate("svc")
+	require.NoError(t, err)
+	oldID, err := (RegKey{KeyPub: pub}).ID()
+	require.NoError(t, err)
+	at := time.Now().Add(time.Hour).UTC().Truncate(time.Second)
+	require.NoError(t, reg.RetireKey("svc", oldID, at))
+
+	// the retired key moved into svc.yml, so svc.pub is gone
+	_, err = os.Stat(filepath.Join(reg.Path, "svc.pub"))
+	require.True(t, os.IsNotExist(err))
+	entries, err := reg.Entries()
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	require.Equal(t, []RegKey{{KeyPub: pub, NotAfter: &at}, {KeyPub: newPub}}, entries[0].Keys)
+
+	require.NoError(t, reg.Upsert(RegEntry{Name: "keyless"}))
+	entries, err = reg.Entries()
+	require.NoError(t, err)
+	require.Equal(t, "keyless", entries[0].Name)
+}
+
+func TestDirRegistryFileErrors(t *testing.T) {
+	reg := DirRegistry{Path: t.TempDir()}
+	require.NoError(t, reg.Upsert(RegEntry{Name: "good", KeyPub: testPub1}))
+	write := func(file, data string) {
+		require.NoError(t, os.WriteFile(filepath.Join(reg.Path, file), []byte(data), 0o644))
+	}
+	write("badkey.pub", "asdfasdf\n")
+	write("badmeta.pub", testPub2)
+	write("badmeta.yml", "keys: 5\n")
+	write("bad name.pub", testPub3)
+	write("README.md", "not part of the registry\n")
+	write(".hidden.pub", "ignored\n")
+
+	entries, fileErrs, err := reg.Load()
+	require.NoError(t, err)
+	require.Equal(t, []RegEntry{{Name: "good", KeyPub: testPub1}}, entries)
+	require.Len(t, fileErrs, 3)
+	require.ErrorContains(t, fileErrs[0], "bad name.pub")
+	require.ErrorContains(t, fileErrs[1], "badkey.pub")
+	require.ErrorContains(t, fileErrs[2], "badmeta.yml")
+
+	entries, err = reg.Entries()
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+
+	// an unparseable entry can be fixed by upserting it
+	require.NoError(t, reg.Upsert(RegEntry{Name: "badkey", KeyPub: testPub3}))
+	_, fileErrs, err = reg.Load()
+	require.NoError(t, err)
+	require.Len(t, fileErrs, 2)
+
+	_, err = DirRegistry{Path: filepath.Join(reg.Path, "missing")}.Entries()
+	require.Error(t, err)
+}
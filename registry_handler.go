@@ -0,0 +1,291 @@
+package locket
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+// RegKeyRequest is the JSON body of a PathRegistryKeys request.
+type RegKeyRequest struct {
+	Name     string     `json:"name"`
+	Key      *RegKey    `json:"key,omitempty"`       // POST: the key to add
+	KeyID    string     `json:"key_id,omitempty"`    // PATCH, DELETE: the key to act on
+	NotAfter *time.Time `json:"not_after,omitempty"` // PATCH: retire time, default now
+}
+
+// RegistryHandler serves Registry over HTTP at PathRegistry and
+// PathRegistryKeys, as consumed by RemoteRegistry. Key rotation uses
+// Registry's KeyRotator methods if it has them, or else reads and upserts
+// the entry.
+//
+// If Admins is set, requests must be signed by an admin key whose role
+// permits them, see AdminAuth. Token is the legacy alternative: if set,
+// requests sending it as an X-Auth-Token header are allowed too. With
+// neither set, every request is refused, unless
+// InsecureAllowUnauthenticated, which lets anyone who can reach the
+// handler rewrite the registry.
+type RegistryHandler struct {
+	Registry                     Registry
+	Admins                       *AdminAuth
+	Token                        string
+	InsecureAllowUnauthenticated bool
+}
+
+// ServeHTTP implements http.Handler.
+func (h RegistryHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case h.Admins != nil || h.Token != "":
+		if !h.authorize(w, r) {
+			return
+		}
+	case !h.InsecureAllowUnauthenticated:
+		log.Error("registry request refused, no admins or token configured",
+			"ip", r.RemoteAddr, "method", r.Method, "path", r.URL.Path,
+		)
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	switch r.URL.Path {
+	case PathRegistry:
+		h.serveEntries(w, r)
+	case PathRegistryKeys:
+		h.serveKeys(w, r)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// authorize authenticates r by admin signature or legacy token, and
+// reports whether it is allowed, having refused it if not.
+func (h RegistryHandler) authorize(w http.ResponseWriter, r *http.Request) bool {
+	if h.Admins != nil && r.Header.Get(adminKeyIDHeader) != "" {
+		// the signature covers the body, so read it first
+		body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, 1<<20))
+		if err != nil {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return false
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		admin, err := h.Admins.authenticate(r, body, time.Now())
+		if err != nil {
+			audit("registry admin refused",
+				"event", "registry_admin_refused",
+				"ip", r.RemoteAddr, "method", r.Method, "path", r.URL.Path,
+				"error", err,
+			)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return false
+		}
+		if !admin.Role.allows(r.Method) {
+			audit("registry admin forbidden",
+				"event", "registry_admin_forbidden",
+				"admin", admin.Name, "role", admin.Role,
+				"ip", r.RemoteAddr, "method", r.Method, "path", r.URL.Path,
+			)
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return false
+		}
+		if r.Method != http.MethodGet {
+			audit("registry admin request",
+				"event", "registry_admin_request",
+				"admin", admin.Name,
+				"ip", r.RemoteAddr, "method", r.Method, "path", r.URL.Path,
+			)
+		}
+		return true
+	}
+	if h.Token != "" && subtle.ConstantTimeCompare(
+		[]byte(r.Header.Get("X-Auth-Token")), []byte(h.Token),
+	) == 1 {
+		return true
+	}
+	log.Warn("registry request unauthorized",
+		"ip", r.RemoteAddr, "method", r.Method, "path", r.URL.Path,
+	)
+	http.Error(w, "unauthorized", http.StatusUnauthorized)
+	return false
+}
+
+// serveEntries lists, upserts and deletes entries.
+func (h RegistryHandler) serveEntries(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		body, sigs, etag, err := h.snapshot()
+		if err != nil {
+			log.Error("registry entries", "error", err)
+			http.Error(w, "internal error", http.StatusInternalServerError)
+			return
+		}
+		if match := r.Header.Get("If-None-Match"); match == etag {
+			// long-poll: hold the request until the registry changes
+			wait, _ := time.ParseDuration(r.URL.Query().Get("wait"))
+			body, sigs, etag, err = h.awaitChange(r, match, min(wait, maxLongPoll))
+			if err != nil {
+				log.Error("registry entries", "error", err)
+				http.Error(w, "internal error", http.StatusInternalServerError)
+				return
+			}
+			if etag == match {
+				w.Header().Set("ETag", etag)
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("ETag", etag)
+		for _, sig := range sigs {
+			w.Header().Add(registrySignatureHeader, sig.String())
+		}
+		_, err = w.Write(body)
+		if err != nil {
+			log.Error("write registry entries", "error", err)
+		}
+	case http.MethodPost, http.MethodDelete:
+		var entry RegEntry
+		r.Body = http.MaxBytesReader(w, r.Body, 1<<20)
+		err := json.NewDecoder(r.Body).Decode(&entry)
+		if err != nil || entry.Name == "" {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		if r.Method == http.MethodPost {
+			err = h.Registry.Upsert(entry)
+		} else {
+			err = h.Registry.Delete(entry.Name)
+		}
+		if err != nil {
+			log.Error("registry update",
+				"method", r.Method, "name", entry.Name, "error", err,
+			)
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		log.Info("registry updated", "method", r.Method, "name", entry.Name)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.Header().Set("Allow", "GET, POST, DELETE")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// maxLongPoll caps how long a GET may wait for the registry to change.
+const maxLongPoll = time.Minute
+
+// longPollCheck is how often a waiting GET re-reads the registry.
+var longPollCheck = time.Second
+
+// snapshot returns the JSON encoding of the registry's entries, their
+// signatures if the registry is a SignedRegistry, and its ETag, a hash
+// of both.
+func (h RegistryHandler) snapshot() ([]byte, []RegistrySignature, string, error) {
+	var entries []RegEntry
+	var sigs []RegistrySignature
+	var err error
+	if signed, ok := h.Registry.(SignedRegistry); ok {
+		entries, sigs, err = signed.SignedEntries()
+	} else {
+		entries, err = h.Registry.Entries()
+	}
+	if err != nil {
+		return nil, nil, "", err
+	}
+	if entries == nil {
+		entries = []RegEntry{}
+	}
+	b, err := json.Marshal(entries)
+	if err != nil {
+		return nil, nil, "", fmt.Errorf("marshal: %w", err)
+	}
+	b = append(b, '\n')
+	hash := sha256.New()
+	hash.Write(b)
+	for _, sig := range sigs {
+		hash.Write([]byte(sig.String() + "\n"))
+	}
+	return b, sigs, `"` + hex.EncodeToString(hash.Sum(nil)[:16]) + `"`, nil
+}
+
+// awaitChange re-reads the registry until its ETag differs from etag, wait
+// elapses, or the request ends, returning the last snapshot.
+func (h RegistryHandler) awaitChange(r *http.Request, etag string, wait time.Duration) ([]byte, []RegistrySignature, string, error) {
+	var body []byte
+	var sigs []RegistrySignature
+	current := etag
+	timeout := time.NewTimer(wait)
+	defer timeout.Stop()
+	ticker := time.NewTicker(longPollCheck)
+	defer ticker.Stop()
+	for current == etag {
+		select {
+		case <-r.Context().Done():
+			return body, sigs, current, nil
+		case <-timeout.C:
+			return body, sigs, current, nil
+		case <-ticker.C:
+		}
+		var err error
+		body, sigs, current, err = h.snapshot()
+		if err != nil {
+			return nil, nil, "", err
+		}
+	}
+	return body, sigs, current, nil
+}
+
+// serveKeys adds, retires and removes individual keys of an entry.
+func (h RegistryHandler) serveKeys(w http.ResponseWriter, r *http.Request) {
+	var req RegKeyRequest
+	r.Body = http.MaxBytesReader(w, r.Body, 1<<20)
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil || req.Name == "" {
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+	rotator := h.rotator()
+	switch r.Method {
+	case http.MethodPost:
+		if req.Key == nil {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		err = rotator.AddKey(req.Name, *req.Key)
+	case http.MethodPatch:
+		at := time.Now()
+		if req.NotAfter != nil {
+			at = *req.NotAfter
+		}
+		err = rotator.RetireKey(req.Name, req.KeyID, at)
+	case http.MethodDelete:
+		err = rotator.RemoveKey(req.Name, req.KeyID)
+	default:
+		w.Header().Set("Allow", "POST, PATCH, DELETE")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err != nil {
+		log.Error("registry key update",
+			"method", r.Method, "name", req.Name, "key_id", req.KeyID, "error", err,
+		)
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+	log.Info("registry key updated",
+		"method", r.Method, "name", req.Name, "key_id", req.KeyID,
+	)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// rotator returns the registry's KeyRotator, or a read-and-upsert fallback.
+func (h RegistryHandler) rotator() KeyRotator {
+	if rot, ok := h.Registry.(KeyRotator); ok {
+		return rot
+	}
+	return upsertRotator{reg: h.Registry}
+}
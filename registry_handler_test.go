@@ -0,0 +1,90 @@
+package locket
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// TestRegistryHandlerRemote drives a RegistryHandler through RemoteRegistry,
+// both with a registry implementing KeyRotator and with one that does not.
+func TestRegistryHandlerRemote(t *testing.T) {
+	cases := map[string]func(FileRegistry) Registry{
+		"rotator":  func(f FileRegistry) Registry { return f },
+		"fallback": func(f FileRegistry) Registry { return struct{ Registry }{f} },
+	}
+	for name, wrap := range cases {
+		t.Run(name, func(t *testing.T) {
+			file := FileRegistry{Path: filepath.Join(t.TempDir(), "registry.yml")}
+			srv := httptest.NewServer(RegistryHandler{Registry: wrap(file), Token: "tok"})
+			defer srv.Close()
+			reg := RemoteRegistry{URL: srv.URL, Token: "tok"}
+
+			oldPub, _, err := reg.Register("svc")
+			require.NoError(t, err)
+			oldKey, err := ParseVerifyKey(oldPub)
+			require.NoError(t, err)
+			newPub, _, err := reg.Rotate("svc")
+			require.NoError(t, err)
+			require.Error(t, reg.AddKey("svc", RegKey{KeyPub: newPub}), "duplicate key")
+
+			entries, err := reg.Entries()
+			require.NoError(t, err)
+			require.Len(t, entries, 1)
+			require.Len(t, entries[0].AllKeys(), 2)
+
+			at := time.Now().Add(time.Hour).Truncate(time.Second)
+			require.NoError(t, reg.RetireKey("svc", oldKey.ID(), at))
+			entries, err = file.Entries()
+			require.NoError(t, err)
+			require.Empty(t, entries[0].KeyPub, "retired KeyPub moves into Keys")
+			require.Equal(t, oldPub, entries[0].Keys[0].KeyPub)
+			require.True(t, at.Equal(*entries[0].Keys[0].NotAfter))
+
+			require.NoError(t, reg.RemoveKey("svc", oldKey.ID()))
+			entries, err = reg.Entries()
+			require.NoError(t, err)
+			require.Len(t, entries[0].AllKeys(), 1)
+			require.Equal(t, newPub, entries[0].AllKeys()[0].KeyPub)
+
+			require.NoError(t, reg.Delete("svc"))
+			entries, err = reg.Entries()
+			require.NoError(t, err)
+			require.Empty(t, entries)
+		})
+	}
+}
+
+func TestRegistryHandlerRejectsBadToken(t *testing.T) {
+	file := FileRegistry{Path: filepath.Join(t.TempDir(), "registry.yml")}
+	srv := httptest.NewServer(RegistryHandler{Registry: file, Token: "tok"})
+	defer srv.Close()
+
+	_, err := RemoteRegistry{URL: srv.URL, Token: "wrong"}.Entries()
+	require.ErrorContains(t, err, "401")
+	_, _, err = RemoteRegistry{URL: srv.URL}.Rotate("svc")
+	require.ErrorContains(t, err, "401")
+
+	resp, err := http.Get(srv.URL + "/elsewhere")
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+}
+
+func TestRegistryHandlerFailsClosed(t *testing.T) {
+	file := FileRegistry{Path: filepath.Join(t.TempDir(), "registry.yml")}
+	srv := httptest.NewServer(RegistryHandler{Registry: file})
+	defer srv.Close()
+
+	_, err := RemoteRegistry{URL: srv.URL}.Entries()
+	require.ErrorContains(t, err, "401")
+	require.ErrorContains(t, RemoteRegistry{URL: srv.URL}.Upsert(RegEntry{Name: "svc", KeyPub: testPub1}), "401")
+
+	open := httptest.NewServer(RegistryHandler{Registry: file, InsecureAllowUnauthenticated: true})
+	defer open.Close()
+	require.NoError(t, RemoteRegistry{URL: open.URL}.Upsert(RegEntry{Name: "svc", KeyPub: testPub1}))
+}
@@ -0,0 +1,201 @@
+package locket
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"regexp"
+	"strings"
+)
+
+// LabelPattern is the pattern label keys must match, and label values
+// unless empty.
+var LabelPattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._/-]{0,62}$`)
+
+// regEntryJSON is RegEntry without its JSON methods.
+type regEntryJSON RegEntry
+
+// regEntryFields are the JSON names of the fields of RegEntry.
+var regEntryFields = func() map[string]bool {
+	fields := make(map[string]bool)
+	t := reflect.TypeOf(RegEntry{})
+	for i := 0; i < t.NumField(); i++ {
+		name, _, _ := strings.Cut(t.Field(i).Tag.Get("json"), ",")
+		if name != "" && name != "-" {
+			fields[name] = true
+		}
+	}
+	return fields
+}()
+
+// MarshalJSON encodes the entry with the fields of Extra alongside its own,
+// as they were read.
+func (e RegEntry) MarshalJSON() ([]byte, error) {
+	b, err := json.Marshal(regEntryJSON(e))
+	if err != nil {
+		return nil, err
+	}
+	extra := make(map[string]any, len(e.Extra))
+	for k, v := range e.Extra {
+		if !regEntryFields[strings.ToLower(k)] {
+			extra[k] = v
+		}
+	}
+	if len(extra) == 0 {
+		return b, nil
+	}
+	x, err := json.Marshal(extra)
+	if err != nil {
+		return nil, fmt.Errorf("marshal extra fields: %w", err)
+	}
+	// splice {"name":...} and {"extra":...} into one object
+	return append(append(b[:len(b)-1], ','), x[1:]...), nil
+}
+
+// UnmarshalJSON decodes the entry, keeping unknown fields in Extra.
+func (e *RegEntry) UnmarshalJSON(b []byte) error {
+	var entry regEntryJSON
+	if err := json.Unmarshal(b, &entry); err != nil {
+		return err
+	}
+	var all map[string]any
+	if err := json.Unmarshal(b, &all); err != nil {
+		return err
+	}
+	for k := range all {
+		// encoding/json matches field names case-insensitively
+		if regEntryFields[strings.ToLower(k)] {
+			delete(all, k)
+		}
+	}
+	if len(all) > 0 {
+		entry.Extra = all
+	}
+	*e = RegEntry(entry)
+	return nil
+}
+
+// LabelSelector selects registry entries by their labels. It is parsed
+// from a comma-separated list of requirements, all of which must hold:
+//   - key=value (or key==value): the label is set to value
+//   - key!=value: the label is unset or set to another value
+//   - key: the label is set
+//   - !key: the label is unset
+//
+// The empty selector selects every entry.
+type LabelSelector []labelRequirement
+
+// labelRequirement is one requirement of a LabelSelector.
+type labelRequirement struct {
+	key    string
+	op     string // "=", "!=", "exists" or "!exists"
+	value  string
+	source string // as written
+}
+
+// ParseLabelSelector parses a selector, see LabelSelector.
+func ParseLabelSelector(s string) (LabelSelector, error) {
+	if strings.TrimSpace(s) == "" {
+		return nil, nil
+	}
+	var sel LabelSelector
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		req := labelRequirement{source: part}
+		switch {
+		case strings.HasPrefix(part, "!") && !strings.Contains(part, "="):
+			req.key, req.op = strings.TrimSpace(part[1:]), "!exists"
+		case strings.Contains(part, "!="):
+			req.key, req.value, _ = strings.Cut(part, "!=")
+			req.op = "!="
+		case strings.Contains(part, "="):
+			req.key, req.value, _ = strings.Cut(part, "=")
+			req.value = strings.TrimPrefix(req.value, "=")
+			req.op = "="
+		default:
+			req.key, req.op = part, "exists"
+		}
+		req.key, req.value = strings.TrimSpace(req.key), strings.TrimSpace(req.value)
+		if !LabelPattern.MatchString(req.key) {
+			return nil, fmt.Errorf("selector %q: key %q does not match %s", part, req.key, LabelPattern)
+		}
+		if req.value != "" && !LabelPattern.MatchString(req.value) {
+			return nil, fmt.Errorf("selector %q: value %q does not match %s", part, req.value, LabelPattern)
+		}
+		sel = append(sel, req)
+	}
+	return sel, nil
+}
+
+// Matches reports whether labels satisfy every requirement.
+func (sel LabelSelector) Matches(labels map[string]string) bool {
+	for _, req := range sel {
+		value, ok := labels[req.key]
+		var match bool
+		switch req.op {
+		case "=":
+			match = ok && value == req.value
+		case "!=":
+			match = !ok || value != req.value
+		case "exists":
+			match = ok
+		case "!exists":
+			match = !ok
+		}
+		if !match {
+			return false
+		}
+	}
+	return true
+}
+
+// String returns the selector's requirements as they were written.
+func (sel LabelSelector) String() string {
+	parts := make([]string, len(sel))
+	for i, req := range sel {
+		parts[i] = req.source
+	}
+	return strings.Join(parts, ",")
+}
+
+// FilterEntries returns the entries whose labels match sel.
+func FilterEntries(entries []RegEntry, sel LabelSelector) []RegEntry {
+	if len(sel) == 0 {
+		return entries
+	}
+	var matched []RegEntry
+	for _, e := range entries {
+		if sel.Matches(e.Labels) {
+			matched = append(matched, e)
+		}
+	}
+	return matched
+}
+
+// validateLabels returns a problem with each label that does not match
+// LabelPattern, in key order.
+func validateLabels(labels map[string]string) []string {
+	var problems []string
+	for _, k := range sortedKeys(labels) {
+		if !LabelPattern.MatchString(k) {
+			problems = append(problems, fmt.Sprintf("label key %q does not match %s", k, LabelPattern))
+		}
+		if v := labels[k]; v != "" && !LabelPattern.MatchString(v) {
+			problems = append(problems, fmt.Sprintf("label %q: value %q does not match %s", k, v, LabelPattern))
+		}
+	}
+	return problems
+}
+
+// formatLabels formats labels as "key=value,...", sorted by key, or "-"
+// if there are none.
+func formatLabels(labels map[string]string) string {
+	if len(labels) == 0 {
+		return "-"
+	}
+	keys := sortedKeys(labels)
+	for i, k := range keys {
+		keys[i] = k + "=" + labels[k]
+	}
+	return strings.Join(keys, ",")
+}
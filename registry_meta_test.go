@@ -0,0 +1,164 @@
+package locket
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"gopkg.in/yaml.v3"
+)
+
+func TestRegEntryUnknownFields(t *testing.T) {
+	data := `{"name":"svc","keypub":"k","owner":"payments","labels":{"team":"payments"},"cost_center":"42","tags":["a"]}`
+	var entry RegEntry
+	require.NoError(t, json.Unmarshal([]byte(data), &entry))
+	require.Equal(t, "payments", entry.Owner)
+	require.Equal(t, map[string]any{"cost_center": "42", "tags": []any{"a"}}, entry.Extra)
+	b, err := json.Marshal(entry)
+	require.NoError(t, err)
+	require.JSONEq(t, data, string(b))
+
+	// without metadata the encoding is unchanged, so are registry signatures
+	b, err = json.Marshal(RegEntry{Name: "svc", KeyPub: "k"})
+	require.NoError(t, err)
+	require.Equal(t, `{"name":"svc","keypub":"k"}`, string(b))
+
+	// a FileRegistry rewrite keeps unknown fields
+	reg := FileRegistry{Path: filepath.Join(t.TempDir(), "registry.yml")}
+	yml, err := yaml.Marshal([]RegEntry{{Name: "svc", KeyPub: testPub1}})
+	require.NoError(t, err)
+	yml = append(yml, "  cost_center: \"42\"\n"...)
+	require.NoError(t, os.WriteFile(reg.Path, yml, 0o644))
+	require.NoError(t, reg.Upsert(RegEntry{Name: "other", KeyPub: testPub2}))
+	entries, err := reg.Entries()
+	require.NoError(t, err)
+	require.Equal(t, map[string]any{"cost_center": "42"}, entries[0].Extra)
+	b, err = os.ReadFile(reg.Path)
+	require.NoError(t, err)
+	require.Contains(t, string(b), "cost_center")
+}
+
+func TestRegisterKeepsMetadata(t *testing.T) {
+	registries := map[string]interface {
+		Registry
+		Register(string) (string, string, error)
+	}{
+		"file": FileRegistry{Path: filepath.Join(t.TempDir(), "registry.yml")},
+		"dir":  DirRegistry{Path: t.TempDir()},
+	}
+	for name, reg := range registries {
+		t.Run(name, func(t *testing.T) {
+			_, _, err := reg.Register("svc")
+			require.NoError(t, err)
+			entries, err := reg.Entries()
+			require.NoError(t, err)
+			require.NotNil(t, entries[0].CreatedAt)
+			require.Nil(t, entries[0].RotatedAt)
+
+			entry := entries[0]
+			entry.Owner = "payments"
+			entry.Labels = map[string]string{"team": "payments"}
+			entry.Extra = map[string]any{"ticket": "OPS-1"}
+			require.NoError(t, reg.Upsert(entry))
+
+			pub, _, err := reg.Register("svc")
+			require.NoError(t, err)
+			entries, err = reg.Entries()
+			require.NoError(t, err)
+			got := entries[0]
+			require.Equal(t, pub, got.KeyPub)
+			require.Equal(t, "payments", got.Owner)
+			require.Equal(t, entry.Labels, got.Labels)
+			require.Equal(t, entry.Extra, got.Extra)
+			require.True(t, entry.CreatedAt.Equal(*got.CreatedAt))
+			require.NotNil(t, got.RotatedAt)
+		})
+	}
+}
+
+func TestFileRegistryUpsertKeepsMetadata(t *testing.T) {
+	reg := FileRegistry{Path: filepath.Join(t.TempDir(), "registry.yml")}
+	created := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	entry := RegEntry{
+		Name: "svc", KeyPub: testPub1,
+		Owner: "payments", Description: "billing", CreatedAt: &created,
+		Labels: map[string]string{"team": "payments"},
+		Extra:  map[string]any{"ticket": "OPS-1"},
+	}
+	require.NoError(t, reg.Upsert(entry))
+
+	// as enroll and rotate paths do, with only a name and key
+	require.NoError(t, reg.Upsert(RegEntry{Name: "svc", KeyPub: testPub2}))
+	entries, err := reg.Entries()
+	require.NoError(t, err)
+	want := entry
+	want.KeyPub = testPub2
+	require.Equal(t, []RegEntry{want}, entries)
+
+	// set fields replace the old ones
+	require.NoError(t, reg.Upsert(RegEntry{Name: "svc", KeyPub: testPub2, Owner: "platform"}))
+	entries, err = reg.Entries()
+	require.NoError(t, err)
+	require.Equal(t, "platform", entries[0].Owner)
+	require.Equal(t, entry.Labels, entries[0].Labels)
+
+	// Replace writes the entry as given
+	require.NoError(t, reg.Replace(RegEntry{Name: "svc", KeyPub: testPub2}))
+	entries, err = reg.Entries()
+	require.NoError(t, err)
+	require.Equal(t, []RegEntry{{Name: "svc", KeyPub: testPub2}}, entries)
+}
+
+func TestLabelSelector(t *testing.T) {
+	labels := map[string]string{"team": "payments", "env": "prod"}
+	tests := []struct {
+		selector string
+		match    bool
+	}{
+		{"", true},
+		{"team=payments", true},
+		{"team==payments", true},
+		{"team=search", false},
+		{"team=payments,env!=prod", false},
+		{"env!=staging", true},
+		{"missing!=x", true},
+		{"team", true},
+		{"!team", false},
+		{"!legacy, env", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.selector, func(t *testing.T) {
+			sel, err := ParseLabelSelector(tt.selector)
+			require.NoError(t, err)
+			require.Equal(t, tt.match, sel.Matches(labels))
+		})
+	}
+	for _, bad := range []string{"team=", "=x", "a,,b", "team=two words", "!"} {
+		_, err := ParseLabelSelector(bad)
+		if bad == "team=" {
+			require.NoError(t, err, "empty value")
+			continue
+		}
+		require.Error(t, err, bad)
+	}
+
+	entries := []RegEntry{
+		{Name: "a", Labels: labels},
+		{Name: "b"},
+	}
+	sel, err := ParseLabelSelector("team=payments")
+	require.NoError(t, err)
+	require.Equal(t, entries[:1], FilterEntries(entries, sel))
+	require.Equal(t, entries, FilterEntries(entries, nil))
+}
+
+func TestValidateLabels(t *testing.T) {
+	report := Validate([]RegEntry{{
+		Name: "svc", KeyPub: testPub1,
+		Labels: map[string]string{"team": "two words", "-bad": "x", "ok": ""},
+	}})
+	require.Len(t, report.Issues, 2)
+}
@@ -2,7 +2,9 @@ package locket
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 	"net/url"
@@ -12,11 +14,16 @@ import (
 // RemoteRegistry is a Registry backed by an HTTP API.
 // URL is the base URL (e.g. "http://api:8888") to which
 // PathRegistry is appended for all operations.
-// Token, if set, is sent as an X-Auth-Token header.
+// Signer, if set, signs every request with an admin key, see AdminAuth.
+// Token, if set, is sent as an X-Auth-Token header (legacy).
+// WatchWait is how long each Watch request asks the server to hold it
+// open awaiting a change; Client's timeout, if any, must exceed it.
 type RemoteRegistry struct {
-	URL    string
-	Token  string
-	Client *http.Client
+	URL       string
+	Signer    Signer
+	Token     string
+	Client    *http.Client
+	WatchWait time.Duration
 }
 
 // client returns the configured HTTP client, or a default with timeout.
@@ -31,7 +38,12 @@ func (r RemoteRegistry) client() *http.Client {
 // safely joining the base URL and PathRegistry. It validates
 // that r.URL is an absolute URL with scheme and host.
 func (r RemoteRegistry) endpoint() (string, error) {
-	joined, err := url.JoinPath(r.URL, PathRegistry)
+	return r.endpointFor(PathRegistry)
+}
+
+// endpointFor is endpoint() for any API path.
+func (r RemoteRegistry) endpointFor(path string) (string, error) {
+	joined, err := url.JoinPath(r.URL, path)
 	if err != nil {
 		return "", fmt.Errorf("join url: %w", err)
 	}
@@ -49,35 +61,55 @@ func (r RemoteRegistry) endpoint() (string, error) {
 
 // Entries fetches all authorized clients from the remote API.
 func (r RemoteRegistry) Entries() ([]RegEntry, error) {
+	entries, _, err := r.SignedEntries()
+	return entries, err
+}
+
+// SignedEntries fetches all authorized clients from the remote API, with
+// the operator signatures of the X-Registry-Signature headers.
+func (r RemoteRegistry) SignedEntries() ([]RegEntry, []RegistrySignature, error) {
 	endpoint, err := r.endpoint()
 	if err != nil {
-		return nil, fmt.Errorf("endpoint: %w", err)
+		return nil, nil, fmt.Errorf("endpoint: %w", err)
 	}
 	req, err := http.NewRequest(http.MethodGet, endpoint, nil)
 	if err != nil {
-		return nil, fmt.Errorf("new request: %w", err)
+		return nil, nil, fmt.Errorf("new request: %w", err)
+	}
+	if err := r.setHeaders(req, nil); err != nil {
+		return nil, nil, err
 	}
-	r.setHeaders(req)
 
 	resp, err := r.client().Do(req)
 	if err != nil {
-		return nil, fmt.Errorf("do request: %w", err)
+		return nil, nil, fmt.Errorf("do request: %w", err)
 	}
 	defer resp.Body.Close()
 	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
-		return nil, fmt.Errorf("status %s", resp.Status)
+		return nil, nil, fmt.Errorf("status %s", resp.Status)
 	}
 
 	var entries []RegEntry
 	err = json.NewDecoder(resp.Body).Decode(&entries)
 	if err != nil {
-		return nil, fmt.Errorf("decode: %w", err)
+		return nil, nil, fmt.Errorf("decode: %w", err)
+	}
+	var sigs []RegistrySignature
+	for _, value := range resp.Header.Values(registrySignatureHeader) {
+		sig, err := ParseRegistrySignature(value)
+		if err != nil {
+			return nil, nil, fmt.Errorf("%s header: %w", registrySignatureHeader, err)
+		}
+		sigs = append(sigs, sig)
 	}
-	return entries, nil
+	return entries, sigs, nil
 }
 
 // Upsert creates or updates an authorized client via the remote API.
 func (r RemoteRegistry) Upsert(entry RegEntry) error {
+	if err := validateEntry(entry); err != nil {
+		return err
+	}
 	b, err := json.Marshal(entry)
 	if err != nil {
 		return fmt.Errorf("marshal: %w", err)
@@ -93,7 +125,9 @@ func (r RemoteRegistry) Upsert(entry RegEntry) error {
 	if err != nil {
 		return fmt.Errorf("new request: %w", err)
 	}
-	r.setHeaders(req)
+	if err := r.setHeaders(req, b); err != nil {
+		return err
+	}
 	req.Header.Set("Content-Type", "application/json")
 
 	resp, err := r.client().Do(req)
@@ -124,7 +158,9 @@ func (r RemoteRegistry) Delete(name string) error {
 	if err != nil {
 		return fmt.Errorf("new request: %w", err)
 	}
-	r.setHeaders(req)
+	if err := r.setHeaders(req, b); err != nil {
+		return err
+	}
 	req.Header.Set("Content-Type", "application/json")
 
 	resp, err := r.client().Do(req)
@@ -139,22 +175,216 @@ func (r RemoteRegistry) Delete(name string) error {
 }
 
 // Register generates a new ed25519 signing keypair, upserts the
-// public key via the remote API, and returns the keypair.
+// public key via the remote API, and returns the keypair. The upsert
+// replaces any entry of the same name, metadata included; use Rotate to
+// keep it.
 func (r RemoteRegistry) Register(name string) (string, string, error) {
 	pub, priv, err := NewPairEd25519()
 	if err != nil {
 		return "", "", fmt.Errorf("generate key pair: %w", err)
 	}
-	err = r.Upsert(RegEntry{Name: name, KeyPub: pub})
+	now := time.Now().UTC()
+	err = r.Upsert(RegEntry{Name: name, KeyPub: pub, CreatedAt: &now})
 	if err != nil {
 		return "", "", fmt.Errorf("upsert: %w", err)
 	}
 	return pub, priv, nil
 }
 
-// setHeaders applies auth headers to the request.
-func (r RemoteRegistry) setHeaders(req *http.Request) {
+// AddKey adds a signing key to the named entry via the remote API,
+// see KeyRotator.
+func (r RemoteRegistry) AddKey(name string, key RegKey) error {
+	return r.sendKeyRequest(http.MethodPost, RegKeyRequest{Name: name, Key: &key})
+}
+
+// RetireKey bounds a signing key's validity to before at via the
+// remote API, see KeyRotator.
+func (r RemoteRegistry) RetireKey(name, keyID string, at time.Time) error {
+	return r.sendKeyRequest(http.MethodPatch, RegKeyRequest{
+		Name: name, KeyID: keyID, NotAfter: &at,
+	})
+}
+
+// RemoveKey deletes a signing key from the named entry via the
+// remote API, see KeyRotator.
+func (r RemoteRegistry) RemoveKey(name, keyID string) error {
+	return r.sendKeyRequest(http.MethodDelete, RegKeyRequest{
+		Name: name, KeyID: keyID,
+	})
+}
+
+// Rotate generates a new ed25519 signing keypair and adds its public key
+// to the named entry alongside the existing keys via the remote API,
+// returning the keypair. Retire the old key with RetireKey once the new
+// one is deployed.
+func (r RemoteRegistry) Rotate(name string) (string, string, error) {
+	pub, priv, err := NewPairEd25519()
+	if err != nil {
+		return "", "", fmt.Errorf("generate key pair: %w", err)
+	}
+	err = r.AddKey(name, RegKey{KeyPub: pub})
+	if err != nil {
+		return "", "", fmt.Errorf("add key: %w", err)
+	}
+	return pub, priv, nil
+}
+
+// sendKeyRequest sends body to PathRegistryKeys.
+func (r RemoteRegistry) sendKeyRequest(method string, body RegKeyRequest) error {
+	b, err := json.Marshal(body)
+	if err != nil {
+		return fmt.Errorf("marshal: %w", err)
+	}
+
+	endpoint, err := r.endpointFor(PathRegistryKeys)
+	if err != nil {
+		return fmt.Errorf("endpoint: %w", err)
+	}
+	req, err := http.NewRequest(method, endpoint, bytes.NewReader(b))
+	if err != nil {
+		return fmt.Errorf("new request: %w", err)
+	}
+	if err := r.setHeaders(req, b); err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := r.client().Do(req)
+	if err != nil {
+		return fmt.Errorf("do request: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("status %s", resp.Status)
+	}
+	return nil
+}
+
+// defaultWatchWait is the long-poll duration when WatchWait is unset.
+const defaultWatchWait = 30 * time.Second
+
+// minWatchRequest paces Watch requests to servers that answer without
+// waiting.
+var minWatchRequest = time.Second
+
+// errWatchUnsupported reports a server that does not send ETags.
+var errWatchUnsupported = errors.New("registry server does not support watching (no ETag)")
+
+// Watch reports changes via the remote API by long-polling: each request
+// carries the ETag of the entries last seen, and the server answers when
+// they change, or with 304 Not Modified after WatchWait. Failed requests
+// are retried with backoff. Watch returns errWatchUnsupported if the server
+// sends no ETag.
+func (r RemoteRegistry) Watch(ctx context.Context, onChange func([]RegEntry)) error {
+	wait := r.WatchWait
+	if wait <= 0 {
+		wait = defaultWatchWait
+	}
+	client := r.Client
+	if client == nil {
+		// bounded per request below, by the long-poll wait
+		client = &http.Client{}
+	}
+
+	var etag string
+	backoff := minWatchRequest
+	for {
+		started := time.Now()
+		entries, tag, err := r.fetchChanged(ctx, client, etag, wait)
+		switch {
+		case ctx.Err() != nil:
+			return ctx.Err()
+		case errors.Is(err, errWatchUnsupported):
+			return err
+		case err != nil:
+			log.Warn("registry watch request failed", "error", err, "retry", backoff)
+			if !sleepCtx(ctx, backoff) {
+				return ctx.Err()
+			}
+			backoff = min(2*backoff, wait)
+			continue
+		}
+		backoff = minWatchRequest
+		if tag != etag {
+			etag = tag
+			onChange(entries)
+		}
+		if !sleepCtx(ctx, minWatchRequest-time.Since(started)) {
+			return ctx.Err()
+		}
+	}
+}
+
+// fetchChanged fetches the entries if their ETag differs from etag,
+// waiting up to wait for a change. Unchanged, it returns etag and no
+// entries.
+func (r RemoteRegistry) fetchChanged(ctx context.Context, client *http.Client, etag string, wait time.Duration) ([]RegEntry, string, error) {
+	endpoint, err := r.endpoint()
+	if err != nil {
+		return nil, "", fmt.Errorf("endpoint: %w", err)
+	}
+	ctx, cancel := context.WithTimeout(ctx, wait+10*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet,
+		endpoint+"?"+url.Values{"wait": {wait.String()}}.Encode(), nil,
+	)
+	if err != nil {
+		return nil, "", fmt.Errorf("new request: %w", err)
+	}
+	if err := r.setHeaders(req, nil); err != nil {
+		return nil, "", err
+	}
+	if etag != "" {
+		req.Header.Set("If-None-Match", etag)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, "", fmt.Errorf("do request: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotModified {
+		return nil, etag, nil
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return nil, "", fmt.Errorf("status %s", resp.Status)
+	}
+	tag := resp.Header.Get("ETag")
+	if tag == "" {
+		return nil, "", errWatchUnsupported
+	}
+	var entries []RegEntry
+	err = json.NewDecoder(resp.Body).Decode(&entries)
+	if err != nil {
+		return nil, "", fmt.Errorf("decode: %w", err)
+	}
+	return entries, tag, nil
+}
+
+// sleepCtx sleeps for d, returning false if ctx ends first.
+func sleepCtx(ctx context.Context, d time.Duration) bool {
+	if d <= 0 {
+		return ctx.Err() == nil
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
+
+// setHeaders applies auth headers to the request, whose body is body.
+func (r RemoteRegistry) setHeaders(req *http.Request, body []byte) error {
+	if r.Signer != nil {
+		if err := signAdminRequest(req, body, r.Signer); err != nil {
+			return fmt.Errorf("sign request: %w", err)
+		}
+	}
 	if r.Token != "" {
 		req.Header.Set("X-Auth-Token", r.Token)
 	}
+	return nil
 }
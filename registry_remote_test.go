@@ -35,7 +35,7 @@ func TestRemoteRegistryEntries(t *testing.T) {
 }
 
 func TestRemoteRegistryUpsert(t *testing.T) {
-	want := RegEntry{Name: "svc1", KeyPub: "pub1"}
+	want := RegEntry{Name: "svc1", KeyPub: testPub1}
 
 	srv := httptest.NewServer(http.HandlerFunc(
 		func(w http.ResponseWriter, r *http.Request) {
@@ -0,0 +1,253 @@
+package locket
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+/*
+Registry signing makes the registry tamper-evident: operators sign its
+entries with offline ed25519 keys (any Signer), and a server configured
+WithRegistrySigners verifies the signature each time it loads the registry.
+Write access to the registry file, or answering as a RemoteRegistry's URL,
+is then not enough to grant access to secrets.
+
+Signatures cover the entries, not their encoding, so a registry keeps its
+signature across formats: a FileRegistry stores them in a detached
+Path + ".sig" file, and RegistryHandler serves them as X-Registry-Signature
+headers. Any change to the entries must be signed again.
+*/
+
+// registrySignatureHeader carries a RegistrySignature in an HTTP response.
+const registrySignatureHeader = "X-Registry-Signature"
+
+// registrySigningContext separates registry signatures from any other
+// signature made with the same key.
+const registrySigningContext = "locket-registry-v1\n"
+
+// SignedRegistry is implemented by registries that return the operator
+// signatures over their entries.
+type SignedRegistry interface {
+	// SignedEntries returns the entries and the signatures over them.
+	SignedEntries() ([]RegEntry, []RegistrySignature, error)
+}
+
+var (
+	_ SignedRegistry = FileRegistry{}
+	_ SignedRegistry = RemoteRegistry{}
+	_ SignedRegistry = (*CachedRegistry)(nil)
+)
+
+// RegistrySignature is an operator's signature over registry entries.
+type RegistrySignature struct {
+	KeyID     string `json:"key_id"` // ID of the operator's key, see VerifyKey.ID()
+	Signature []byte `json:"signature"`
+}
+
+// String encodes the signature as "<key ID> <base64 signature>", the
+// format of a signature file line.
+func (s RegistrySignature) String() string {
+	return s.KeyID + " " + base64.StdEncoding.EncodeToString(s.Signature)
+}
+
+// ParseRegistrySignature parses a signature in the format of String.
+func ParseRegistrySignature(s string) (RegistrySignature, error) {
+	keyID, sig, ok := strings.Cut(strings.TrimSpace(s), " ")
+	if !ok {
+		return RegistrySignature{}, errors.New("want \"<key ID> <base64 signature>\"")
+	}
+	if err := validKeyID(keyID); err != nil {
+		return RegistrySignature{}, err
+	}
+	b, err := base64.StdEncoding.DecodeString(strings.TrimSpace(sig))
+	if err != nil {
+		return RegistrySignature{}, fmt.Errorf("decode signature: %w", err)
+	}
+	return RegistrySignature{KeyID: keyID, Signature: b}, nil
+}
+
+// parseRegistrySignatures parses a signature file: one signature per
+// line; blank lines and lines starting with "#" are ignored.
+func parseRegistrySignatures(data string) ([]RegistrySignature, error) {
+	var sigs []RegistrySignature
+	for i, line := range strings.Split(data, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		sig, err := ParseRegistrySignature(line)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", i+1, err)
+		}
+		sigs = append(sigs, sig)
+	}
+	return sigs, nil
+}
+
+// registryMessage returns the message an operator signs for entries: their
+// JSON encoding, sorted by name, so it does not depend on where or in what
+// order the entries are stored.
+func registryMessage(entries []RegEntry) ([]byte, error) {
+	sorted := append([]RegEntry{}, entries...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].Name < sorted[j].Name
+	})
+	b, err := json.Marshal(sorted)
+	if err != nil {
+		return nil, fmt.Errorf("marshal: %w", err)
+	}
+	return append([]byte(registrySigningContext), b...), nil
+}
+
+// SignRegistry signs entries with an operator's signer.
+func SignRegistry(entries []RegEntry, signer Signer) (RegistrySignature, error) {
+	msg, err := registryMessage(entries)
+	if err != nil {
+		return RegistrySignature{}, err
+	}
+	sig, err := signer.Sign(msg)
+	if err != nil {
+		return RegistrySignature{}, fmt.Errorf("sign: %w", err)
+	}
+	return RegistrySignature{KeyID: signer.Public().ID(), Signature: sig}, nil
+}
+
+// VerifyRegistry checks that at least one of sigs is a valid signature of
+// entries by one of signers, and returns its key ID. Signatures by other
+// keys are ignored.
+func VerifyRegistry(entries []RegEntry, sigs []RegistrySignature, signers ...VerifyKey) (string, error) {
+	if len(sigs) == 0 {
+		return "", errors.New("registry not signed")
+	}
+	msg, err := registryMessage(entries)
+	if err != nil {
+		return "", err
+	}
+	for _, sig := range sigs {
+		for _, key := range signers {
+			if key.ID() == sig.KeyID && key.Verify(msg, sig.Signature) {
+				return key.ID(), nil
+			}
+		}
+	}
+	return "", errors.New("no valid signature by a registry signer")
+}
+
+// SignedEntries returns the entries with the signatures of the
+// Path + ".sig" file, if any.
+func (f FileRegistry) SignedEntries() ([]RegEntry, []RegistrySignature, error) {
+	entries, err := f.Entries()
+	if err != nil {
+		return nil, nil, err
+	}
+	sigs, err := f.signatures()
+	if err != nil {
+		return nil, nil, err
+	}
+	return entries, sigs, nil
+}
+
+// signatures reads the signature file, or none if it does not exist.
+func (f FileRegistry) signatures() ([]RegistrySignature, error) {
+	b, err := os.ReadFile(f.Path + ".sig")
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("read signatures: %w", err)
+	}
+	sigs, err := parseRegistrySignatures(string(b))
+	if err != nil {
+		return nil, fmt.Errorf("%s.sig: %w", f.Path, err)
+	}
+	return sigs, nil
+}
+
+// Sign signs the current entries with signer and records the signature in
+// the Path + ".sig" file, replacing any earlier signature by the same key
+// and keeping those of other operators.
+func (f FileRegistry) Sign(signer Signer) error {
+	unlock, err := lockFile(f.Path + ".lock")
+	if err != nil {
+		return fmt.Errorf("lock registry: %w", err)
+	}
+	defer unlock()
+
+	entries, err := f.Entries()
+	if err != nil {
+		return err
+	}
+	sig, err := SignRegistry(entries, signer)
+	if err != nil {
+		return err
+	}
+	sigs, err := f.signatures()
+	if err != nil {
+		return err
+	}
+	var b strings.Builder
+	for _, s := range sigs {
+		if s.KeyID != sig.KeyID {
+			b.WriteString(s.String() + "\n")
+		}
+	}
+	b.WriteString(sig.String() + "\n")
+	return writeFileAtomic(f.Path+".sig", []byte(b.String()), 0o644)
+}
+
+// WithRegistrySigners verifies the registry's signature by one of the
+// operator keys each time it is loaded, see SignedRegistry. A registry
+// that is unsigned or mis-signed is logged, and, with
+// WithRequireSignedRegistry, refused.
+func WithRegistrySigners(keys ...VerifyKey) ServerOption {
+	return func(s *Server) {
+		s.signers = append(s.signers, keys...)
+	}
+}
+
+// WithRequireSignedRegistry refuses to start with, or reload, a registry
+// without a valid signature by one of the WithRegistrySigners keys,
+// keeping the last verified one.
+func WithRequireSignedRegistry() ServerOption {
+	return func(s *Server) {
+		s.requireSigned = true
+	}
+}
+
+// loadEntries returns the registry's entries, verifying their signature
+// if registry signers are configured.
+func (s *Server) loadEntries() ([]RegEntry, error) {
+	if len(s.signers) == 0 {
+		return s.reg.Entries()
+	}
+	signed, ok := s.reg.(SignedRegistry)
+	if !ok {
+		// NewServer refuses this combination when signatures are required
+		log.Warn("registry cannot be signed, not verified", "registry", fmt.Sprintf("%T", s.reg))
+		return s.reg.Entries()
+	}
+	entries, sigs, err := signed.SignedEntries()
+	if err != nil {
+		return nil, err
+	}
+	keyID, err := VerifyRegistry(entries, sigs, s.signers...)
+	if err != nil {
+		audit("registry signature invalid",
+			"event", "registry_signature_invalid",
+			"signatures", len(sigs),
+			"refused", s.requireSigned,
+			"error", err,
+		)
+		if s.requireSigned {
+			return nil, fmt.Errorf("verify registry: %w", err)
+		}
+		return entries, nil
+	}
+	log.Debug("registry signature verified", "key_id", keyID)
+	return entries, nil
+}
@@ -0,0 +1,142 @@
+package locket
+
+import (
+	"context"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// newTestOperator returns a registry signing key.
+func newTestOperator(t *testing.T) *SigningKey {
+	t.Helper()
+	_, priv, err := NewPairEd25519()
+	require.NoError(t, err)
+	key, err := ParseSigningKey(priv)
+	require.NoError(t, err)
+	return key
+}
+
+func TestSignRegistry(t *testing.T) {
+	operator, other := newTestOperator(t), newTestOperator(t)
+	sig, err := SignRegistry(testRegistryItems, operator)
+	require.NoError(t, err)
+
+	reversed := []RegEntry{testRegistryItems[1], testRegistryItems[0]}
+	keyID, err := VerifyRegistry(reversed, []RegistrySignature{sig}, other.Public(), operator.Public())
+	require.NoError(t, err, "order does not matter")
+	require.Equal(t, operator.Public().ID(), keyID)
+
+	parsed, err := ParseRegistrySignature(sig.String())
+	require.NoError(t, err)
+	require.Equal(t, sig, parsed)
+
+	tampered := append([]RegEntry{{Name: "intruder", KeyPub: testPub3}}, testRegistryItems...)
+	_, err = VerifyRegistry(tampered, []RegistrySignature{sig}, operator.Public())
+	require.Error(t, err)
+	_, err = VerifyRegistry(testRegistryItems, []RegistrySignature{sig}, other.Public())
+	require.Error(t, err, "signed by an untrusted key")
+	_, err = VerifyRegistry(testRegistryItems, nil, operator.Public())
+	require.ErrorContains(t, err, "not signed")
+
+	_, err = ParseRegistrySignature("SHA256:abc not-base64!")
+	require.Error(t, err)
+	_, err = ParseRegistrySignature("abc")
+	require.Error(t, err)
+}
+
+func TestFileRegistrySign(t *testing.T) {
+	alice, bob := newTestOperator(t), newTestOperator(t)
+	reg := FileRegistry{Path: filepath.Join(t.TempDir(), "registry.yml")}
+	for _, item := range testRegistryItems {
+		require.NoError(t, reg.Upsert(item))
+	}
+	_, sigs, err := reg.SignedEntries()
+	require.NoError(t, err)
+	require.Empty(t, sigs)
+
+	require.NoError(t, reg.Sign(alice))
+	require.NoError(t, reg.Sign(bob))
+	require.NoError(t, reg.Sign(alice))
+	entries, sigs, err := reg.SignedEntries()
+	require.NoError(t, err)
+	require.Len(t, sigs, 2, "one signature per operator")
+	_, err = VerifyRegistry(entries, sigs, bob.Public())
+	require.NoError(t, err)
+
+	// served over HTTP, the signatures survive the change of format
+	ts := httptest.NewServer(RegistryHandler{Registry: reg, Token: "tok"})
+	defer ts.Close()
+	entries, sigs, err = RemoteRegistry{URL: ts.URL, Token: "tok"}.SignedEntries()
+	require.NoError(t, err)
+	_, err = VerifyRegistry(entries, sigs, alice.Public())
+	require.NoError(t, err)
+
+	// and through a CachedRegistry's snapshot
+	backend := &flakyRegistry{}
+	cached := &CachedRegistry{Registry: RemoteRegistry{URL: ts.URL, Token: "tok"}, Path: filepath.Join(t.TempDir(), "snapshot.json")}
+	_, err = cached.Entries()
+	require.NoError(t, err)
+	backend.setDown(true)
+	cached.Registry = backend
+	entries, sigs, err = cached.SignedEntries()
+	require.NoError(t, err)
+	_, err = VerifyRegistry(entries, sigs, alice.Public())
+	require.NoError(t, err)
+
+	// any change must be signed again
+	require.NoError(t, reg.Upsert(RegEntry{Name: "new", KeyPub: testPub3}))
+	entries, sigs, err = reg.SignedEntries()
+	require.NoError(t, err)
+	_, err = VerifyRegistry(entries, sigs, alice.Public(), bob.Public())
+	require.Error(t, err)
+
+	require.NoError(t, os.WriteFile(reg.Path+".sig", []byte("garbage\n"), 0o644))
+	_, _, err = reg.SignedEntries()
+	require.Error(t, err)
+}
+
+func TestServerSignedRegistry(t *testing.T) {
+	operator := newTestOperator(t)
+	pub, _, err := NewPairEd25519()
+	require.NoError(t, err)
+	key, err := ParseVerifyKey(pub)
+	require.NoError(t, err)
+	reg := FileRegistry{Path: filepath.Join(t.TempDir(), "registry.yml")}
+	require.NoError(t, reg.Upsert(RegEntry{Name: "SERVICE1", KeyPub: testPub1}))
+	source := Dotenv{Path: testEnvFile, ServiceSecrets: testServiceMap}
+	required := []ServerOption{WithRegistrySigners(operator.Public()), WithRequireSignedRegistry()}
+
+	_, err = NewServer(context.Background(), source, reg, 0, nil, required...)
+	require.ErrorContains(t, err, "not signed")
+	_, err = NewServer(context.Background(), source, &countingRegistry{}, 0, nil, required...)
+	require.ErrorContains(t, err, "cannot be signed")
+	_, err = NewServer(context.Background(), source, reg, 0, nil, WithRequireSignedRegistry())
+	require.ErrorContains(t, err, "no registry signers")
+
+	// without WithRequireSignedRegistry an unsigned registry only warns
+	server, err := NewServer(context.Background(), source, reg, 0, nil, WithRegistrySigners(operator.Public()))
+	require.NoError(t, err)
+	server.Close()
+
+	require.NoError(t, reg.Sign(operator))
+	server, err = NewServer(context.Background(), source, reg, 5*time.Millisecond, nil, required...)
+	require.NoError(t, err)
+	defer server.Close()
+
+	// an entry added without signing is never loaded
+	require.NoError(t, reg.Upsert(RegEntry{Name: "SERVICE2", KeyPub: pub}))
+	time.Sleep(50 * time.Millisecond)
+	_, ok := server.lookupKey(key.ID())
+	require.False(t, ok)
+
+	require.NoError(t, reg.Sign(operator))
+	require.Eventually(t, func() bool {
+		_, ok := server.lookupKey(key.ID())
+		return ok
+	}, 5*time.Second, 10*time.Millisecond)
+}
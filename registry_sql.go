@@ -0,0 +1,391 @@
+package locket
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	_ "modernc.org/sqlite" // registers the "sqlite" driver
+)
+
+// SQLDriver is the database/sql driver name OpenSQLRegistry uses. The
+// default, "sqlite", is the pure-Go modernc.org/sqlite, so no cgo is
+// needed; to use another driver, import it and set SQLDriver.
+var SQLDriver = "sqlite"
+
+// ChangeTracker is implemented by registries that number their changes,
+// so a Server polling one fetches only the entries changed since the
+// revision it last applied, rather than the whole registry.
+type ChangeTracker interface {
+	// Changes returns the entries changed after revision since.
+	// Changes(0) returns every entry.
+	Changes(since int64) (RegistryChanges, error)
+}
+
+// RegistryChanges are the changes to a registry after some revision.
+type RegistryChanges struct {
+	Revision int64      // current revision
+	Updated  []RegEntry // entries upserted since
+	Deleted  []string   // names of entries deleted since
+}
+
+// SQLRegistry is a Registry backed by a SQL database (SQLite dialect),
+// storing one row per entry, so a change writes a single row however
+// large the registry is. Every write is a transaction, and increments a
+// revision number recorded on the rows it touched, see ChangeTracker.
+// Deleted entries are kept as tombstones so Changes can report them.
+//
+// Unlike FileRegistry, a key registered to two entries is refused by a
+// unique index rather than by re-validating the whole registry.
+//
+// With SQLite, set a busy timeout in the DSN so concurrent writers wait
+// for each other rather than fail, e.g. with modernc.org/sqlite:
+// "registry.db?_pragma=busy_timeout(5000)&_txlock=immediate".
+type SQLRegistry struct {
+	db *sql.DB
+}
+
+// sqlMigrations are the schema versions, applied in order. Never edit a
+// released migration; append a new one.
+var sqlMigrations = [][]string{
+	{ // 1: entries with revisions, and an index of their keys
+		`CREATE TABLE registry_entries (
+			name     TEXT PRIMARY KEY,
+			entry    TEXT NOT NULL,
+			revision INTEGER NOT NULL,
+			deleted  INTEGER NOT NULL DEFAULT 0
+		)`,
+		`CREATE INDEX registry_entries_revision ON registry_entries (revision)`,
+		`CREATE TABLE registry_keys (
+			key_id TEXT PRIMARY KEY,
+			name   TEXT NOT NULL
+		)`,
+		`CREATE INDEX registry_keys_name ON registry_keys (name)`,
+		`CREATE TABLE registry_revision (
+			id       INTEGER PRIMARY KEY CHECK (id = 1),
+			revision INTEGER NOT NULL
+		)`,
+		`INSERT INTO registry_revision (id, revision) VALUES (1, 0)`,
+	},
+}
+
+var (
+	_ KeyRotator    = (*SQLRegistry)(nil)
+	_ ChangeTracker = (*SQLRegistry)(nil)
+)
+
+// OpenSQLRegistry opens the database at dsn with SQLDriver, see
+// NewSQLRegistry.
+func OpenSQLRegistry(dsn string) (*SQLRegistry, error) {
+	db, err := sql.Open(SQLDriver, dsn)
+	if err != nil {
+		return nil, fmt.Errorf("open %s: %w", SQLDriver, err)
+	}
+	r, err := NewSQLRegistry(db)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return r, nil
+}
+
+// NewSQLRegistry returns a registry stored in db, migrating its schema
+// to the latest version.
+func NewSQLRegistry(db *sql.DB) (*SQLRegistry, error) {
+	r := &SQLRegistry{db: db}
+	if err := r.migrate(); err != nil {
+		return nil, fmt.Errorf("migrate: %w", err)
+	}
+	return r, nil
+}
+
+// Close closes the database.
+func (r *SQLRegistry) Close() error {
+	return r.db.Close()
+}
+
+// migrate applies the migrations the database has not seen, each in its
+// own transaction.
+func (r *SQLRegistry) migrate() error {
+	_, err := r.db.Exec(`CREATE TABLE IF NOT EXISTS locket_schema (version INTEGER NOT NULL)`)
+	if err != nil {
+		return fmt.Errorf("create schema table: %w", err)
+	}
+	for {
+		done, err := r.migrateNext()
+		if err != nil || done {
+			return err
+		}
+	}
+}
+
+// migrateNext applies the next migration, if any, and reports whether the
+// schema is up to date.
+func (r *SQLRegistry) migrateNext() (bool, error) {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return false, fmt.Errorf("begin: %w", err)
+	}
+	defer tx.Rollback()
+	var version int
+	err = tx.QueryRow(`SELECT COALESCE(MAX(version), 0) FROM locket_schema`).Scan(&version)
+	if err != nil {
+		return false, fmt.Errorf("read schema version: %w", err)
+	}
+	switch {
+	case version > len(sqlMigrations):
+		return false, fmt.Errorf("schema version %d is newer than supported %d", version, len(sqlMigrations))
+	case version == len(sqlMigrations):
+		return true, nil
+	}
+	for _, stmt := range sqlMigrations[version] {
+		if _, err := tx.Exec(stmt); err != nil {
+			return false, fmt.Errorf("migration %d: %w", version+1, err)
+		}
+	}
+	if _, err := tx.Exec(`INSERT INTO locket_schema (version) VALUES (?)`, version+1); err != nil {
+		return false, fmt.Errorf("record schema version: %w", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return false, fmt.Errorf("commit migration %d: %w", version+1, err)
+	}
+	log.Info("registry schema migrated", "version", version+1)
+	return false, nil
+}
+
+// Entries returns all entries, ordered by name.
+func (r *SQLRegistry) Entries() ([]RegEntry, error) {
+	rows, err := r.db.Query(`SELECT entry FROM registry_entries WHERE deleted = 0 ORDER BY name`)
+	if err != nil {
+		return nil, fmt.Errorf("query entries: %w", err)
+	}
+	defer rows.Close()
+	var entries []RegEntry
+	for rows.Next() {
+		var data string
+		if err := rows.Scan(&data); err != nil {
+			return nil, fmt.Errorf("scan entry: %w", err)
+		}
+		var entry RegEntry
+		if err := json.Unmarshal([]byte(data), &entry); err != nil {
+			return nil, fmt.Errorf("unmarshal entry: %w", err)
+		}
+		entries = append(entries, entry)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("query entries: %w", err)
+	}
+	return entries, nil
+}
+
+// Changes returns the entries changed after revision since, see
+// ChangeTracker.
+func (r *SQLRegistry) Changes(since int64) (RegistryChanges, error) {
+	var changes RegistryChanges
+	// one transaction, so the revision matches the rows read
+	tx, err := r.db.BeginTx(context.Background(), &sql.TxOptions{ReadOnly: true})
+	if err != nil {
+		return changes, fmt.Errorf("begin: %w", err)
+	}
+	defer tx.Rollback()
+	err = tx.QueryRow(`SELECT revision FROM registry_revision WHERE id = 1`).Scan(&changes.Revision)
+	if err != nil {
+		return changes, fmt.Errorf("read revision: %w", err)
+	}
+	rows, err := tx.Query(`SELECT name, entry, deleted FROM registry_entries
+		WHERE revision > ? ORDER BY revision, name`, since)
+	if err != nil {
+		return changes, fmt.Errorf("query changes: %w", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var name, data string
+		var deleted bool
+		if err := rows.Scan(&name, &data, &deleted); err != nil {
+			return changes, fmt.Errorf("scan entry: %w", err)
+		}
+		if deleted {
+			changes.Deleted = append(changes.Deleted, name)
+			continue
+		}
+		var entry RegEntry
+		if err := json.Unmarshal([]byte(data), &entry); err != nil {
+			return changes, fmt.Errorf("unmarshal entry %q: %w", name, err)
+		}
+		changes.Updated = append(changes.Updated, entry)
+	}
+	if err := rows.Err(); err != nil {
+		return changes, fmt.Errorf("query changes: %w", err)
+	}
+	return changes, nil
+}
+
+// Upsert inserts or replaces the entry of the same name.
+func (r *SQLRegistry) Upsert(entry RegEntry) error {
+	return r.write(func(tx *sql.Tx, revision int64) error {
+		return putEntry(tx, entry, revision)
+	})
+}
+
+// Delete removes the named entry, if present.
+func (r *SQLRegistry) Delete(name string) error {
+	return r.write(func(tx *sql.Tx, revision int64) error {
+		_, err := tx.Exec(`UPDATE registry_entries SET deleted = 1, revision = ?
+			WHERE name = ? AND deleted = 0`, revision, name)
+		if err != nil {
+			return fmt.Errorf("delete entry: %w", err)
+		}
+		_, err = tx.Exec(`DELETE FROM registry_keys WHERE name = ?`, name)
+		if err != nil {
+			return fmt.Errorf("delete keys: %w", err)
+		}
+		return nil
+	})
+}
+
+// Register generates a new ed25519 signing keypair, makes its public key
+// the only key of the named entry, keeping its metadata, and returns the
+// keypair.
+func (r *SQLRegistry) Register(name string) (string, string, error) {
+	pub, priv, err := NewPairEd25519()
+	if err != nil {
+		return "", "", fmt.Errorf("generate key pair: %w", err)
+	}
+	err = r.updateEntry(name, true, func(e *RegEntry) error {
+		e.register(pub)
+		return nil
+	})
+	if err != nil {
+		return "", "", fmt.Errorf("upsert: %w", err)
+	}
+	return pub, priv, nil
+}
+
+// AddKey adds a signing key to the named entry, see KeyRotator.
+func (r *SQLRegistry) AddKey(name string, key RegKey) error {
+	return r.updateEntry(name, true, func(e *RegEntry) error {
+		return e.addKey(key)
+	})
+}
+
+// RetireKey bounds a signing key's validity to before at, see KeyRotator.
+func (r *SQLRegistry) RetireKey(name, keyID string, at time.Time) error {
+	return r.updateEntry(name, false, func(e *RegEntry) error {
+		return e.retireKey(keyID, at)
+	})
+}
+
+// RemoveKey deletes a signing key from the named entry, see KeyRotator.
+func (r *SQLRegistry) RemoveKey(name, keyID string) error {
+	return r.updateEntry(name, false, func(e *RegEntry) error {
+		return e.removeKey(keyID)
+	})
+}
+
+// Rotate generates a new ed25519 signing keypair and adds its public key
+// to the named entry alongside the existing keys, returning the keypair.
+func (r *SQLRegistry) Rotate(name string) (string, string, error) {
+	pub, priv, err := NewPairEd25519()
+	if err != nil {
+		return "", "", fmt.Errorf("generate key pair: %w", err)
+	}
+	err = r.AddKey(name, RegKey{KeyPub: pub})
+	if err != nil {
+		return "", "", fmt.Errorf("add key: %w", err)
+	}
+	return pub, priv, nil
+}
+
+// updateEntry applies fn to the named entry within one transaction.
+func (r *SQLRegistry) updateEntry(name string, create bool, fn func(*RegEntry) error) error {
+	return r.write(func(tx *sql.Tx, revision int64) error {
+		var existing []RegEntry
+		var data string
+		err := tx.QueryRow(`SELECT entry FROM registry_entries
+			WHERE name = ? AND deleted = 0`, name).Scan(&data)
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+		case err != nil:
+			return fmt.Errorf("read entry: %w", err)
+		default:
+			var entry RegEntry
+			if err := json.Unmarshal([]byte(data), &entry); err != nil {
+				return fmt.Errorf("unmarshal entry: %w", err)
+			}
+			existing = append(existing, entry)
+		}
+		entry, err := modifyEntry(existing, name, create, fn)
+		if err != nil {
+			return err
+		}
+		return putEntry(tx, entry, revision)
+	})
+}
+
+// write runs fn in a transaction at the next revision. The revision is
+// taken first, which also takes SQLite's write lock before any reads.
+func (r *SQLRegistry) write(fn func(tx *sql.Tx, revision int64) error) error {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return fmt.Errorf("begin: %w", err)
+	}
+	defer tx.Rollback()
+	_, err = tx.Exec(`UPDATE registry_revision SET revision = revision + 1 WHERE id = 1`)
+	if err != nil {
+		return fmt.Errorf("increment revision: %w", err)
+	}
+	var revision int64
+	err = tx.QueryRow(`SELECT revision FROM registry_revision WHERE id = 1`).Scan(&revision)
+	if err != nil {
+		return fmt.Errorf("read revision: %w", err)
+	}
+	if err := fn(tx, revision); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("commit: %w", err)
+	}
+	return nil
+}
+
+// putEntry validates entry and writes it, and its keys, at revision.
+func putEntry(tx *sql.Tx, entry RegEntry, revision int64) error {
+	if err := validateEntry(entry); err != nil {
+		return err
+	}
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return fmt.Errorf("marshal: %w", err)
+	}
+	_, err = tx.Exec(`DELETE FROM registry_keys WHERE name = ?`, entry.Name)
+	if err != nil {
+		return fmt.Errorf("delete keys: %w", err)
+	}
+	for _, k := range entry.AllKeys() {
+		id, _ := k.ID() // parsed by validateEntry
+		var owner string
+		err := tx.QueryRow(`SELECT name FROM registry_keys WHERE key_id = ?`, id).Scan(&owner)
+		switch {
+		case err == nil:
+			return fmt.Errorf("key %s also registered to %q", id, owner)
+		case !errors.Is(err, sql.ErrNoRows):
+			return fmt.Errorf("read key: %w", err)
+		}
+		_, err = tx.Exec(`INSERT INTO registry_keys (key_id, name) VALUES (?, ?)`, id, entry.Name)
+		if err != nil {
+			return fmt.Errorf("insert key: %w", err)
+		}
+	}
+	_, err = tx.Exec(`INSERT INTO registry_entries (name, entry, revision, deleted)
+		VALUES (?, ?, ?, 0)
+		ON CONFLICT (name) DO UPDATE SET
+			entry = excluded.entry, revision = excluded.revision, deleted = 0`,
+		entry.Name, string(data), revision)
+	if err != nil {
+		return fmt.Errorf("upsert entry: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,188 @@
+package locket
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// newTestSQLRegistry returns a registry in a new SQLite database.
+func newTestSQLRegistry(t *testing.T) *SQLRegistry {
+	t.Helper()
+	dsn := filepath.Join(t.TempDir(), "registry.db") + "?_pragma=busy_timeout(5000)&_txlock=immediate"
+	db, err := sql.Open(SQLDriver, dsn)
+	require.NoError(t, err)
+	reg, err := NewSQLRegistry(db)
+	require.NoError(t, err)
+	t.Cleanup(func() { reg.Close() })
+	return reg
+}
+
+func TestSQLRegistryReadWrite(t *testing.T) {
+	reg := newTestSQLRegistry(t)
+	for _, item := range testRegistryItems {
+		require.NoError(t, reg.Upsert(item))
+	}
+	entries, err := reg.Entries()
+	require.NoError(t, err)
+	require.ElementsMatch(t, testRegistryItems, entries)
+
+	require.Error(t, reg.Upsert(RegEntry{Name: "bad", KeyPub: "asdfasdf"}))
+	require.ErrorContains(t, reg.Upsert(RegEntry{Name: "other", KeyPub: testPub1}), "also registered")
+
+	require.NoError(t, reg.Delete("foo1"))
+	entries, err = reg.Entries()
+	require.NoError(t, err)
+	require.Equal(t, []RegEntry{testRegistryItems[1]}, entries)
+
+	// a deleted entry's key is free again
+	require.NoError(t, reg.Upsert(RegEntry{Name: "other", KeyPub: testPub1}))
+}
+
+func TestSQLRegistryMigrate(t *testing.T) {
+	dsn := filepath.Join(t.TempDir(), "registry.db")
+	reg, err := OpenSQLRegistry(dsn)
+	require.NoError(t, err)
+	require.NoError(t, reg.Upsert(RegEntry{Name: "a", KeyPub: testPub1}))
+	require.NoError(t, reg.Close())
+
+	// reopening migrates nothing and keeps the data
+	db, err := sql.Open(SQLDriver, dsn)
+	require.NoError(t, err)
+	reg, err = NewSQLRegistry(db)
+	require.NoError(t, err)
+	entries, err := reg.Entries()
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+
+	// a schema from a newer version is refused
+	_, err = db.Exec(`INSERT INTO locket_schema (version) VALUES (?)`, len(sqlMigrations)+1)
+	require.NoError(t, err)
+	_, err = NewSQLRegistry(db)
+	require.ErrorContains(t, err, "newer than supported")
+	require.NoError(t, db.Close())
+}
+
+func TestSQLRegistryChanges(t *testing.T) {
+	reg := newTestSQLRegistry(t)
+	changes, err := reg.Changes(0)
+	require.NoError(t, err)
+	require.Zero(t, changes.Revision)
+
+	require.NoError(t, reg.Upsert(RegEntry{Name: "a", KeyPub: testPub1}))
+	require.NoError(t, reg.Upsert(RegEntry{Name: "b", KeyPub: testPub2}))
+	changes, err = reg.Changes(0)
+	require.NoError(t, err)
+	require.Len(t, changes.Updated, 2)
+	since := changes.Revision
+
+	changes, err = reg.Changes(since)
+	require.NoError(t, err)
+	require.Empty(t, changes.Updated)
+	require.Equal(t, since, changes.Revision)
+
+	require.NoError(t, reg.AddKey("b", RegKey{KeyPub: testPub3}))
+	require.NoError(t, reg.Delete("a"))
+	changes, err = reg.Changes(since)
+	require.NoError(t, err)
+	require.Equal(t, since+2, changes.Revision)
+	require.Len(t, changes.Updated, 1)
+	require.Equal(t, "b", changes.Updated[0].Name)
+	require.Len(t, changes.Updated[0].Keys, 1)
+	require.Equal(t, []string{"a"}, changes.Deleted)
+
+	// a refused write changes nothing
+	require.Error(t, reg.RemoveKey("missing", "SHA256:x"))
+	changes, err = reg.Changes(since + 2)
+	require.NoError(t, err)
+	require.Equal(t, since+2, changes.Revision)
+}
+
+func TestSQLRegistryRotate(t *testing.T) {
+	reg := newTestSQLRegistry(t)
+	oldPub, _, err := reg.Register("svc")
+	require.NoError(t, err)
+	newPub, _, err := reg.Rotate("svc")
+	require.NoError(t, err)
+
+	oldID, err := (RegKey{KeyPub: oldPub}).ID()
+	require.NoError(t, err)
+	require.NoError(t, reg.RetireKey("svc", oldID, time.Now()))
+	require.NoError(t, reg.RemoveKey("svc", oldID))
+
+	entries, err := reg.Entries()
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	require.Empty(t, entries[0].KeyPub)
+	require.Equal(t, []RegKey{{KeyPub: newPub}}, entries[0].Keys)
+}
+
+func TestSQLRegistryConcurrentWriters(t *testing.T) {
+	reg := newTestSQLRegistry(t)
+	require.NoError(t, reg.Upsert(RegEntry{Name: "shared"}))
+
+	const writers = 20
+	var wg sync.WaitGroup
+	errs := make(chan error, 2*writers)
+	for i := range writers {
+		pub, _, err := NewPairEd25519()
+		require.NoError(t, err)
+		sharedPub, _, err := NewPairEd25519()
+		require.NoError(t, err)
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			errs <- reg.Upsert(RegEntry{Name: fmt.Sprintf("svc%d", i), KeyPub: pub})
+		}()
+		go func() {
+			defer wg.Done()
+			errs <- reg.AddKey("shared", RegKey{KeyPub: sharedPub})
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		require.NoError(t, err)
+	}
+
+	changes, err := reg.Changes(0)
+	require.NoError(t, err)
+	require.Len(t, changes.Updated, writers+1)
+	require.Equal(t, int64(2*writers+1), changes.Revision)
+	for _, e := range changes.Updated {
+		if e.Name == "shared" {
+			require.Len(t, e.Keys, writers, "no added key was lost")
+		}
+	}
+}
+
+// TestServerSQLRegistry polls a SQLRegistry incrementally.
+func TestServerSQLRegistry(t *testing.T) {
+	reg := newTestSQLRegistry(t)
+	require.NoError(t, reg.Upsert(RegEntry{Name: "a", KeyPub: testPub1}))
+	require.NoError(t, reg.Upsert(RegEntry{Name: "b", KeyPub: testPub2}))
+
+	source := Dotenv{Path: testEnvFile, ServiceSecrets: testServiceMap}
+	server, err := NewServer(context.Background(), source, reg, 5*time.Millisecond, nil)
+	require.NoError(t, err)
+	defer server.Close()
+	hasKey := func(pub string) bool {
+		key, err := ParseVerifyKey(pub)
+		require.NoError(t, err)
+		_, ok := server.lookupKey(key.ID())
+		return ok
+	}
+	require.True(t, hasKey(testPub1))
+
+	require.NoError(t, reg.Delete("a"))
+	require.NoError(t, reg.Upsert(RegEntry{Name: "c", KeyPub: testPub3}))
+	require.Eventually(t, func() bool {
+		return !hasKey(testPub1) && hasKey(testPub2) && hasKey(testPub3)
+	}, time.Second, 5*time.Millisecond)
+}
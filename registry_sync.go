@@ -0,0 +1,393 @@
+package locket
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"maps"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+/*
+Registry sync moves entries between any two Registry implementations, e.g.
+from a FileRegistry to a RemoteRegistry, or from staging to production:
+  - DiffEntries compares two sets of entries by key fingerprint (key ID),
+    so a key re-encoded (see MigrateKeyPEM) is not a change
+  - ImportRegistry applies a diff to a registry through Upsert (or Replace,
+    see EntryReplacer) and Delete, or only reports it, with DryRun
+  - entries missing from the source are deleted only with Prune
+
+A signed registry must be signed again after an import, see SignRegistry.
+*/
+
+// RegistryFormat is an output format for entries and diffs.
+type RegistryFormat string
+
+const (
+	FormatYAML  RegistryFormat = "yaml"
+	FormatJSON  RegistryFormat = "json"
+	FormatTable RegistryFormat = "table" // human-readable, one key per line
+)
+
+// RegistryDiff is the difference between two sets of registry entries:
+// the changes that turn the current entries into the desired ones.
+type RegistryDiff struct {
+	Added   []RegEntry  `yaml:"added,omitempty"   json:"added,omitempty"`
+	Removed []RegEntry  `yaml:"removed,omitempty" json:"removed,omitempty"`
+	Changed []EntryDiff `yaml:"changed,omitempty" json:"changed,omitempty"`
+}
+
+// EntryDiff is the difference between two versions of an entry. Keys are
+// listed by fingerprint, see VerifyKey.ID().
+type EntryDiff struct {
+	Name            string   `yaml:"name"                     json:"name"`
+	AddedKeys       []string `yaml:"added_keys,omitempty"     json:"added_keys,omitempty"`
+	RemovedKeys     []string `yaml:"removed_keys,omitempty"   json:"removed_keys,omitempty"`
+	ChangedKeys     []string `yaml:"changed_keys,omitempty"     json:"changed_keys,omitempty"` // validity bounds changed
+	ExpiryChanged   bool     `yaml:"expiry_changed,omitempty"   json:"expiry_changed,omitempty"`
+	MetadataChanged bool     `yaml:"metadata_changed,omitempty" json:"metadata_changed,omitempty"` // owner, labels, etc.
+	From            RegEntry `yaml:"from"                       json:"from"`
+	To              RegEntry `yaml:"to"                         json:"to"`
+}
+
+// SyncOptions controls ImportRegistry and SyncRegistry.
+type SyncOptions struct {
+	DryRun bool // report the changes without making them
+	Prune  bool // delete entries missing from the source
+}
+
+// Empty reports whether there are no differences.
+func (d RegistryDiff) Empty() bool {
+	return len(d.Added) == 0 && len(d.Removed) == 0 && len(d.Changed) == 0
+}
+
+// DiffEntries returns the changes that turn current into desired. Entries
+// are matched by name, and compared by key fingerprints, key validity
+// bounds, expiry and metadata.
+func DiffEntries(current, desired []RegEntry) RegistryDiff {
+	var diff RegistryDiff
+	byName := make(map[string]RegEntry, len(current))
+	for _, e := range current {
+		byName[e.Name] = e
+	}
+	seen := make(map[string]bool, len(desired))
+	for _, want := range desired {
+		seen[want.Name] = true
+		have, ok := byName[want.Name]
+		if !ok {
+			diff.Added = append(diff.Added, want)
+			continue
+		}
+		if d, changed := diffEntry(have, want); changed {
+			diff.Changed = append(diff.Changed, d)
+		}
+	}
+	for _, have := range current {
+		if !seen[have.Name] {
+			diff.Removed = append(diff.Removed, have)
+		}
+	}
+	sortEntries(diff.Added)
+	sortEntries(diff.Removed)
+	sort.Slice(diff.Changed, func(i, j int) bool {
+		return diff.Changed[i].Name < diff.Changed[j].Name
+	})
+	return diff
+}
+
+// diffEntry compares two versions of an entry, reporting whether they
+// differ.
+func diffEntry(from, to RegEntry) (EntryDiff, bool) {
+	d := EntryDiff{Name: to.Name, From: from, To: to}
+	before, after := keysByFingerprint(from), keysByFingerprint(to)
+	for _, id := range sortedKeys(after) {
+		old, ok := before[id]
+		switch {
+		case !ok:
+			d.AddedKeys = append(d.AddedKeys, id)
+		case !equalTime(old.NotBefore, after[id].NotBefore) || !equalTime(old.NotAfter, after[id].NotAfter):
+			d.ChangedKeys = append(d.ChangedKeys, id)
+		}
+	}
+	for _, id := range sortedKeys(before) {
+		if _, ok := after[id]; !ok {
+			d.RemovedKeys = append(d.RemovedKeys, id)
+		}
+	}
+	d.ExpiryChanged = !equalTime(from.ExpiresAt, to.ExpiresAt)
+	d.MetadataChanged = from.Owner != to.Owner || from.Description != to.Description ||
+		!maps.Equal(from.Labels, to.Labels) ||
+		!equalTime(from.CreatedAt, to.CreatedAt) || !equalTime(from.RotatedAt, to.RotatedAt) ||
+		!equalExtra(from.Extra, to.Extra)
+	changed := len(d.AddedKeys) > 0 || len(d.RemovedKeys) > 0 || len(d.ChangedKeys) > 0 ||
+		d.ExpiryChanged || d.MetadataChanged
+	return d, changed
+}
+
+// keysByFingerprint indexes an entry's keys by fingerprint. A key that
+// does not parse is indexed by its text, so it still compares.
+func keysByFingerprint(e RegEntry) map[string]RegKey {
+	keys := make(map[string]RegKey)
+	for _, k := range e.AllKeys() {
+		keys[keyFingerprint(k)] = k
+	}
+	return keys
+}
+
+// keyFingerprint returns the key's ID, or its trimmed text if it does not
+// parse.
+func keyFingerprint(k RegKey) string {
+	id, err := k.ID()
+	if err != nil {
+		return strings.TrimSpace(k.KeyPub)
+	}
+	return id
+}
+
+// equalExtra reports whether two sets of unknown fields hold the same
+// values. They are compared as JSON, since backends decode them
+// differently: YAML numbers as int, JSON numbers as float64.
+func equalExtra(a, b map[string]any) bool {
+	if len(a) == 0 || len(b) == 0 {
+		return len(a) == len(b)
+	}
+	x, errA := json.Marshal(a)
+	y, errB := json.Marshal(b)
+	if errA != nil || errB != nil {
+		return false
+	}
+	return bytes.Equal(x, y)
+}
+
+// sortedKeys returns the keys of m in order.
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// equalTime reports whether two optional times are both unset or equal.
+func equalTime(a, b *time.Time) bool {
+	if a == nil || b == nil {
+		return a == nil && b == nil
+	}
+	return a.Equal(*b)
+}
+
+// sortEntries sorts entries by name.
+func sortEntries(entries []RegEntry) {
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].Name < entries[j].Name
+	})
+}
+
+// ImportRegistry makes dst hold entries, returning the changes made, or
+// that would be made with DryRun. Entries of dst missing from entries are
+// kept, and left out of the returned diff, unless Prune.
+//
+// entries are validated first, so an invalid import changes nothing.
+// Changes are then applied one entry at a time: removals, then changed
+// entries with only the keys they keep, then changed entries in full, then
+// additions, so a key can move from one entry to any other even where key
+// IDs must be unique. On error, the changes before it remain.
+func ImportRegistry(dst Registry, entries []RegEntry, opts SyncOptions) (RegistryDiff, error) {
+	if err := Validate(entries).Err(); err != nil {
+		return RegistryDiff{}, err
+	}
+	current, err := dst.Entries()
+	if err != nil {
+		return RegistryDiff{}, fmt.Errorf("read destination: %w", err)
+	}
+	diff := DiffEntries(current, entries)
+	if !opts.Prune {
+		if len(diff.Removed) > 0 {
+			log.Info("registry import keeps entries missing from source, see Prune", "entries", len(diff.Removed))
+		}
+		diff.Removed = nil
+	}
+	if opts.DryRun {
+		return diff, nil
+	}
+	put := dst.Upsert
+	if r, ok := dst.(EntryReplacer); ok {
+		put = r.Replace // so metadata the source clears is cleared
+	}
+	for _, e := range diff.Removed {
+		if err := dst.Delete(e.Name); err != nil {
+			return diff, fmt.Errorf("delete %q: %w", e.Name, err)
+		}
+	}
+	// release keys moving to other entries before any entry takes them
+	for _, d := range diff.Changed {
+		if len(d.RemovedKeys) == 0 {
+			continue
+		}
+		if err := put(withoutKeys(d.From, d.RemovedKeys)); err != nil {
+			return diff, fmt.Errorf("update %q: %w", d.Name, err)
+		}
+	}
+	for _, d := range diff.Changed {
+		if err := put(d.To); err != nil {
+			return diff, fmt.Errorf("update %q: %w", d.Name, err)
+		}
+	}
+	for _, e := range diff.Added {
+		if err := put(e); err != nil {
+			return diff, fmt.Errorf("add %q: %w", e.Name, err)
+		}
+	}
+	log.Info("registry imported",
+		"added", len(diff.Added),
+		"changed", len(diff.Changed),
+		"removed", len(diff.Removed),
+	)
+	return diff, nil
+}
+
+// withoutKeys returns a copy of e without the keys of the given
+// fingerprints.
+func withoutKeys(e RegEntry, fingerprints []string) RegEntry {
+	drop := make(map[string]bool, len(fingerprints))
+	for _, id := range fingerprints {
+		drop[id] = true
+	}
+	if e.KeyPub != "" && drop[keyFingerprint(RegKey{KeyPub: e.KeyPub})] {
+		e.KeyPub = ""
+	}
+	var keys []RegKey
+	for _, k := range e.Keys {
+		if !drop[keyFingerprint(k)] {
+			keys = append(keys, k)
+		}
+	}
+	e.Keys = keys
+	return e
+}
+
+// SyncRegistry makes dst hold the entries of src, see ImportRegistry.
+func SyncRegistry(src, dst Registry, opts SyncOptions) (RegistryDiff, error) {
+	entries, err := src.Entries()
+	if err != nil {
+		return RegistryDiff{}, fmt.Errorf("read source: %w", err)
+	}
+	return ImportRegistry(dst, entries, opts)
+}
+
+// ExportRegistry writes the entries of reg matching sel to w, sorted by
+// name. YAML output is a valid FileRegistry file, and JSON output can be
+// read as one.
+func ExportRegistry(w io.Writer, reg Registry, format RegistryFormat, sel LabelSelector) error {
+	entries, err := reg.Entries()
+	if err != nil {
+		return fmt.Errorf("read entries: %w", err)
+	}
+	entries = append([]RegEntry(nil), FilterEntries(entries, sel)...)
+	sortEntries(entries)
+	return WriteEntries(w, entries, format)
+}
+
+// WriteEntries writes entries to w in format; a table lists each key by
+// fingerprint with its validity, and the entry's owner and labels.
+func WriteEntries(w io.Writer, entries []RegEntry, format RegistryFormat) error {
+	if format != FormatTable {
+		return writeFormatted(w, entries, format)
+	}
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "NAME\tKEY\tNOT BEFORE\tNOT AFTER\tEXPIRES\tOWNER\tLABELS")
+	for _, e := range entries {
+		owner := e.Owner
+		if owner == "" {
+			owner = "-"
+		}
+		keys := e.AllKeys()
+		if len(keys) == 0 {
+			fmt.Fprintf(tw, "%s\t-\t\t\t%s\t%s\t%s\n", e.Name, formatTime(e.ExpiresAt), owner, formatLabels(e.Labels))
+		}
+		for _, k := range keys {
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", e.Name, keyFingerprint(k),
+				formatTime(k.NotBefore), formatTime(k.NotAfter), formatTime(e.ExpiresAt),
+				owner, formatLabels(e.Labels),
+			)
+		}
+	}
+	return tw.Flush()
+}
+
+// Write writes the diff to w in format; a table lists one change per line,
+// marked "+" for added, "-" for removed and "~" for changed.
+func (d RegistryDiff) Write(w io.Writer, format RegistryFormat) error {
+	if format != FormatTable {
+		return writeFormatted(w, d, format)
+	}
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "\tNAME\tKEY\tCHANGE")
+	for _, e := range d.Added {
+		fmt.Fprintf(tw, "+\t%s\t\tentry added\n", e.Name)
+		for _, k := range e.AllKeys() {
+			fmt.Fprintf(tw, "+\t%s\t%s\tkey added\n", e.Name, keyFingerprint(k))
+		}
+	}
+	for _, e := range d.Removed {
+		fmt.Fprintf(tw, "-\t%s\t\tentry removed\n", e.Name)
+		for _, k := range e.AllKeys() {
+			fmt.Fprintf(tw, "-\t%s\t%s\tkey removed\n", e.Name, keyFingerprint(k))
+		}
+	}
+	for _, c := range d.Changed {
+		for _, id := range c.AddedKeys {
+			fmt.Fprintf(tw, "~\t%s\t%s\tkey added\n", c.Name, id)
+		}
+		for _, id := range c.RemovedKeys {
+			fmt.Fprintf(tw, "~\t%s\t%s\tkey removed\n", c.Name, id)
+		}
+		for _, id := range c.ChangedKeys {
+			fmt.Fprintf(tw, "~\t%s\t%s\tkey validity changed\n", c.Name, id)
+		}
+		if c.ExpiryChanged {
+			fmt.Fprintf(tw, "~\t%s\t\texpiry %s -> %s\n", c.Name, formatTime(c.From.ExpiresAt), formatTime(c.To.ExpiresAt))
+		}
+		if c.MetadataChanged {
+			fmt.Fprintf(tw, "~\t%s\t\tmetadata changed\n", c.Name)
+		}
+	}
+	return tw.Flush()
+}
+
+// writeFormatted writes v to w as YAML or JSON.
+func writeFormatted(w io.Writer, v any, format RegistryFormat) error {
+	switch format {
+	case FormatYAML:
+		enc := yaml.NewEncoder(w)
+		enc.SetIndent(2)
+		if err := enc.Encode(v); err != nil {
+			return fmt.Errorf("encode yaml: %w", err)
+		}
+		return enc.Close()
+	case FormatJSON:
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(v); err != nil {
+			return fmt.Errorf("encode json: %w", err)
+		}
+		return nil
+	default:
+		return fmt.Errorf("unknown format %q, want %q, %q or %q", format, FormatYAML, FormatJSON, FormatTable)
+	}
+}
+
+// formatTime formats an optional time for a table, "-" if unset.
+func formatTime(t *time.Time) string {
+	if t == nil {
+		return "-"
+	}
+	return t.UTC().Format(time.RFC3339)
+}
@@ -0,0 +1,154 @@
+package locket
+
+import (
+	"bytes"
+	"encoding/json"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"gopkg.in/yaml.v3"
+)
+
+func TestDiffEntries(t *testing.T) {
+	key1, err := ParseVerifyKey(testPub1)
+	require.NoError(t, err)
+	key2, err := ParseVerifyKey(testPub2)
+	require.NoError(t, err)
+	sshKey1, err := key1.AuthorizedKey()
+	require.NoError(t, err)
+	expiry := time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	current := []RegEntry{
+		{Name: "same", KeyPub: testPub1},
+		{Name: "changed", KeyPub: testPub2},
+		{Name: "gone", KeyPub: testPub3},
+	}
+	desired := []RegEntry{
+		{Name: "same", KeyPub: sshKey1}, // re-encoded, same fingerprint
+		{Name: "changed", Keys: []RegKey{{KeyPub: testPub2, NotAfter: &expiry}}, ExpiresAt: &expiry},
+		{Name: "new", KeyPub: testPub3},
+	}
+	diff := DiffEntries(current, desired)
+	require.Equal(t, []RegEntry{desired[2]}, diff.Added)
+	require.Equal(t, []RegEntry{current[2]}, diff.Removed)
+	require.Len(t, diff.Changed, 1)
+	require.Equal(t, "changed", diff.Changed[0].Name)
+	require.Equal(t, []string{key2.ID()}, diff.Changed[0].ChangedKeys)
+	require.True(t, diff.Changed[0].ExpiryChanged)
+	require.Empty(t, diff.Changed[0].AddedKeys)
+
+	require.True(t, DiffEntries(current, current).Empty())
+
+	var table bytes.Buffer
+	require.NoError(t, diff.Write(&table, FormatTable))
+	require.Contains(t, table.String(), "entry added")
+	require.Contains(t, table.String(), key2.ID())
+	var decoded RegistryDiff
+	var js bytes.Buffer
+	require.NoError(t, diff.Write(&js, FormatJSON))
+	require.NoError(t, json.Unmarshal(js.Bytes(), &decoded))
+	require.Len(t, decoded.Changed, 1)
+	require.Error(t, diff.Write(&js, "xml"))
+}
+
+func TestImportRegistry(t *testing.T) {
+	src := FileRegistry{Path: filepath.Join(t.TempDir(), "registry.yml")}
+	dst := DirRegistry{Path: t.TempDir()}
+	for _, e := range testRegistryItems {
+		require.NoError(t, src.Upsert(e))
+	}
+	require.NoError(t, dst.Upsert(RegEntry{Name: "extra", KeyPub: testPub3}))
+
+	diff, err := SyncRegistry(src, dst, SyncOptions{DryRun: true})
+	require.NoError(t, err)
+	require.Len(t, diff.Added, 2)
+	require.Empty(t, diff.Removed, "not pruning")
+	entries, err := dst.Entries()
+	require.NoError(t, err)
+	require.Len(t, entries, 1, "dry run")
+
+	_, err = SyncRegistry(src, dst, SyncOptions{})
+	require.NoError(t, err)
+	entries, err = dst.Entries()
+	require.NoError(t, err)
+	require.Len(t, entries, 3, "extra kept")
+
+	diff, err = SyncRegistry(src, dst, SyncOptions{Prune: true})
+	require.NoError(t, err)
+	require.Equal(t, "extra", diff.Removed[0].Name)
+	entries, err = dst.Entries()
+	require.NoError(t, err)
+	require.True(t, DiffEntries(entries, testRegistryItems).Empty())
+
+	// the entry holding a key is removed before the key moves
+	moved := []RegEntry{{Name: "foo1", KeyPub: testPub2}}
+	_, err = ImportRegistry(dst, moved, SyncOptions{Prune: true})
+	require.NoError(t, err)
+
+	// metadata cleared in the source is cleared in a FileRegistry too
+	file := FileRegistry{Path: filepath.Join(t.TempDir(), "registry.yml")}
+	require.NoError(t, file.Upsert(RegEntry{Name: "svc", KeyPub: testPub1, Owner: "payments"}))
+	plain := []RegEntry{{Name: "svc", KeyPub: testPub1}}
+	_, err = ImportRegistry(file, plain, SyncOptions{})
+	require.NoError(t, err)
+	entries, err = file.Entries()
+	require.NoError(t, err)
+	require.Equal(t, plain, entries)
+
+	// keys released before they are taken, whichever entry sorts first
+	swap := DirRegistry{Path: t.TempDir()}
+	require.NoError(t, swap.Upsert(RegEntry{Name: "a", KeyPub: testPub1}))
+	require.NoError(t, swap.Upsert(RegEntry{Name: "b", KeyPub: testPub2}))
+	want := []RegEntry{{Name: "a", KeyPub: testPub2}, {Name: "b", KeyPub: testPub3}}
+	diff, err = ImportRegistry(swap, want, SyncOptions{})
+	require.NoError(t, err)
+	require.Len(t, diff.Changed, 2)
+	entries, err = swap.Entries()
+	require.NoError(t, err)
+	require.True(t, DiffEntries(entries, want).Empty())
+
+	_, err = ImportRegistry(dst, []RegEntry{{Name: "bad name", KeyPub: testPub1}}, SyncOptions{})
+	require.ErrorContains(t, err, "invalid registry")
+}
+
+func TestSyncRegistryExtra(t *testing.T) {
+	src := FileRegistry{Path: filepath.Join(t.TempDir(), "registry.yml")}
+	require.NoError(t, src.Upsert(RegEntry{Name: "svc", KeyPub: testPub1, Extra: map[string]any{
+		"replicas": 3,
+		"ratio":    0.5,
+		"deploy":   map[string]any{"zones": []any{"a", "b"}, "limits": map[string]any{"cpu": 2}},
+	}}))
+	dst := newTestSQLRegistry(t)
+
+	diff, err := SyncRegistry(src, dst, SyncOptions{})
+	require.NoError(t, err)
+	require.Len(t, diff.Added, 1)
+
+	entries, err := dst.Entries()
+	require.NoError(t, err)
+	require.IsType(t, float64(0), entries[0].Extra["replicas"], "decoded from JSON")
+	diff, err = SyncRegistry(src, dst, SyncOptions{DryRun: true})
+	require.NoError(t, err)
+	require.True(t, diff.Empty(), "synced entry unchanged: %+v", diff.Changed)
+}
+
+func TestExportRegistry(t *testing.T) {
+	reg := FileRegistry{Path: filepath.Join(t.TempDir(), "registry.yml")}
+	for _, e := range testRegistryItems {
+		require.NoError(t, reg.Upsert(e))
+	}
+	for _, format := range []RegistryFormat{FormatYAML, FormatJSON} {
+		var b bytes.Buffer
+		require.NoError(t, ExportRegistry(&b, reg, format, nil))
+		var entries []RegEntry
+		require.NoError(t, yaml.Unmarshal(b.Bytes(), &entries), "readable as a FileRegistry")
+		require.True(t, DiffEntries(entries, testRegistryItems).Empty())
+		require.Equal(t, "bar2", entries[0].Name, "sorted")
+	}
+	var b bytes.Buffer
+	require.NoError(t, ExportRegistry(&b, reg, FormatTable, nil))
+	require.Contains(t, b.String(), "NAME")
+	require.Contains(t, b.String(), "foo1")
+}
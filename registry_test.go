@@ -1,20 +1,35 @@
 package locket
 
 import (
+	"fmt"
+	"os"
 	"path/filepath"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
 )
 
+// test public keys, valid so entries pass Validate
+var testPub1, testPub2, testPub3 = mustTestPub(), mustTestPub(), mustTestPub()
+
+func mustTestPub() string {
+	pub, _, err := NewPairEd25519()
+	if err != nil {
+		panic(err)
+	}
+	return pub
+}
+
 var testRegistryItems = []RegEntry{
 	{
 		Name:   "foo1",
-		KeyPub: "asdfasdf",
+		KeyPub: testPub1,
 	},
 	{
 		Name:   "bar2",
-		KeyPub: "zyx",
+		KeyPub: testPub2,
 	},
 }
 
@@ -71,7 +86,7 @@ func TestFileRegistryUpsertDedup(t *testing.T) {
 func TestFileRegistryRegister(t *testing.T) {
 	reg := FileRegistry{Path: filepath.Join(t.TempDir(), "registry.yml")}
 
-	services := []string{"service A", "service B", "service C"}
+	services := []string{"serviceA", "serviceB", "serviceC"}
 
 	for _, service := range services {
 		pub, priv, err := reg.Register(service)
@@ -87,7 +102,7 @@ func TestFileRegistryRegister(t *testing.T) {
 		}
 	}
 
-	// upsert service A with new key
+	// upsert serviceA with new key
 	pub, priv, err := reg.Register(services[0])
 	require.NoError(t, err)
 	require.NotEmpty(t, pub)
@@ -104,8 +119,8 @@ func TestFileRegistryRegister(t *testing.T) {
 func TestFileRegistryDelete(t *testing.T) {
 	reg := FileRegistry{Path: filepath.Join(t.TempDir(), "registry.yml")}
 
-	require.NoError(t, reg.Upsert(RegEntry{Name: "a", KeyPub: "k1"}))
-	require.NoError(t, reg.Upsert(RegEntry{Name: "b", KeyPub: "k2"}))
+	require.NoError(t, reg.Upsert(RegEntry{Name: "a", KeyPub: testPub1}))
+	require.NoError(t, reg.Upsert(RegEntry{Name: "b", KeyPub: testPub2}))
 
 	entries, err := reg.Entries()
 	require.NoError(t, err)
@@ -118,3 +133,141 @@ func TestFileRegistryDelete(t *testing.T) {
 	require.Len(t, entries, 1)
 	require.Equal(t, "b", entries[0].Name)
 }
+
+func TestFileRegistryRotate(t *testing.T) {
+	reg := FileRegistry{Path: filepath.Join(t.TempDir(), "registry.yml")}
+	oldPub, _, err := reg.Register("svc")
+	require.NoError(t, err)
+	oldKey, err := ParseVerifyKey(oldPub)
+	require.NoError(t, err)
+
+	// add the new key: both are held
+	newPub, newPriv, err := reg.Rotate("svc")
+	require.NoError(t, err)
+	require.NotEmpty(t, newPriv)
+	entries, err := reg.Entries()
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	require.Len(t, entries[0].AllKeys(), 2)
+
+	// adding the same key twice is refused
+	require.Error(t, reg.AddKey("svc", RegKey{KeyPub: newPub}))
+	require.Error(t, reg.AddKey("svc", RegKey{KeyPub: "not a key"}))
+
+	// retire the old key
+	now := time.Now()
+	require.NoError(t, reg.RetireKey("svc", oldKey.ID(), now))
+	entries, err = reg.Entries()
+	require.NoError(t, err)
+	keys := entries[0].AllKeys()
+	require.Len(t, keys, 2)
+	for _, k := range keys {
+		id, err := k.ID()
+		require.NoError(t, err)
+		if id == oldKey.ID() {
+			require.False(t, k.ValidAt(now))
+			require.True(t, k.ValidAt(now.Add(-time.Second)))
+		} else {
+			require.True(t, k.ValidAt(now))
+		}
+	}
+
+	// remove it entirely
+	require.NoError(t, reg.RemoveKey("svc", oldKey.ID()))
+	require.Error(t, reg.RemoveKey("svc", oldKey.ID()))
+	require.Error(t, reg.RetireKey("missing", oldKey.ID(), now))
+	entries, err = reg.Entries()
+	require.NoError(t, err)
+	require.Len(t, entries[0].AllKeys(), 1)
+	require.Equal(t, newPub, entries[0].AllKeys()[0].KeyPub)
+}
+
+func TestRegKeyValidAt(t *testing.T) {
+	now := time.Now()
+	before, after := now.Add(-time.Hour), now.Add(time.Hour)
+	require.True(t, RegKey{}.ValidAt(now))
+	require.True(t, RegKey{NotBefore: &before, NotAfter: &after}.ValidAt(now))
+	require.False(t, RegKey{NotBefore: &after}.ValidAt(now))
+	require.False(t, RegKey{NotAfter: &before}.ValidAt(now))
+	require.False(t, RegKey{NotAfter: &now}.ValidAt(now), "NotAfter is exclusive")
+}
+
+func TestFileRegistryConcurrentWriters(t *testing.T) {
+	reg := FileRegistry{Path: filepath.Join(t.TempDir(), "registry.yml")}
+	require.NoError(t, reg.Upsert(RegEntry{Name: "shared"}))
+
+	const writers = 20
+	var wg sync.WaitGroup
+	errs := make(chan error, 2*writers)
+	for i := range writers {
+		pub, _, err := NewPairEd25519()
+		require.NoError(t, err)
+		sharedPub, _, err := NewPairEd25519()
+		require.NoError(t, err)
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			errs <- reg.Upsert(RegEntry{Name: fmt.Sprintf("svc%d", i), KeyPub: pub})
+		}()
+		go func() {
+			defer wg.Done()
+			// every writer modifies the same entry
+			errs <- reg.AddKey("shared", RegKey{KeyPub: sharedPub})
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		require.NoError(t, err)
+	}
+
+	entries, err := reg.Entries()
+	require.NoError(t, err)
+	require.Len(t, entries, writers+1, "no upsert was lost")
+	for _, e := range entries {
+		if e.Name == "shared" {
+			require.Len(t, e.Keys, writers, "no added key was lost")
+		}
+	}
+
+	// only the registry and its lock file remain: no temp files
+	files, err := os.ReadDir(filepath.Dir(reg.Path))
+	require.NoError(t, err)
+	require.Len(t, files, 2)
+}
+
+func TestFileRegistryBackup(t *testing.T) {
+	reg := FileRegistry{Path: filepath.Join(t.TempDir(), "registry.yml"), Backup: true}
+	require.NoError(t, reg.Upsert(RegEntry{Name: "a", KeyPub: testPub1}))
+	_, err := os.Stat(reg.Path + ".bak")
+	require.True(t, os.IsNotExist(err), "no backup of a file that did not exist")
+	require.NoError(t, os.Chmod(reg.Path, 0o600))
+
+	require.NoError(t, reg.Upsert(RegEntry{Name: "b", KeyPub: testPub2}))
+	require.NoError(t, reg.Delete("a"))
+
+	backup, err := FileRegistry{Path: reg.Path + ".bak"}.Entries()
+	require.NoError(t, err)
+	require.Equal(t, []RegEntry{{Name: "a", KeyPub: testPub1}, {Name: "b", KeyPub: testPub2}}, backup)
+	entries, err := reg.Entries()
+	require.NoError(t, err)
+	require.Equal(t, []RegEntry{{Name: "b", KeyPub: testPub2}}, entries)
+
+	// the file mode survives the rename
+	info, err := os.Stat(reg.Path)
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0o600), info.Mode().Perm())
+}
+
+func TestFileRegistryFailedWriteKeepsFile(t *testing.T) {
+	dir := t.TempDir()
+	reg := FileRegistry{Path: filepath.Join(dir, "registry.yml")}
+	require.NoError(t, reg.Upsert(RegEntry{Name: "a", KeyPub: testPub1}))
+
+	// a failing modification writes nothing
+	err := reg.RemoveKey("missing", "SHA256:x")
+	require.Error(t, err)
+	entries, err := reg.Entries()
+	require.NoError(t, err)
+	require.Equal(t, []RegEntry{{Name: "a", KeyPub: testPub1}}, entries)
+}
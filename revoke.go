@@ -0,0 +1,145 @@
+package locket
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// A revocation list names signing keys the server refuses regardless of the
+// registry, one key ID (see VerifyKey.ID()) per line:
+//
+//	# stolen laptop, 2024-05-01
+//	SHA256:3q2+7w...
+//
+// Blank lines and lines starting with # are ignored. A key that is revoked
+// stays revoked even if it is re-added to the registry.
+
+// LoadRevocations reads the key IDs listed in the revocation list at path.
+func LoadRevocations(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("open revocation list: %w", err)
+	}
+	defer f.Close()
+
+	var ids []string
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if err := validKeyID(line); err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, n, err)
+		}
+		ids = append(ids, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("read revocation list: %w", err)
+	}
+	return ids, nil
+}
+
+// validKeyID reports whether id looks like a key ID.
+func validKeyID(id string) error {
+	if !strings.HasPrefix(id, "SHA256:") || len(id) == len("SHA256:") {
+		return fmt.Errorf("invalid key ID %q, want SHA256:<base64>", id)
+	}
+	return nil
+}
+
+// WithRevoked refuses requests signed by any of the given key IDs.
+func WithRevoked(keyIDs ...string) ServerOption {
+	return func(s *Server) {
+		for _, id := range keyIDs {
+			s.revoked[id] = struct{}{}
+		}
+	}
+}
+
+// WithRevocationList refuses requests signed by any key ID in the
+// revocation list at path, which is re-read whenever the registry is
+// polled. Server.Revoke appends to it, so revocations survive restarts.
+func WithRevocationList(path string) ServerOption {
+	return func(s *Server) {
+		s.revocationList = path
+	}
+}
+
+// loadRevocationList replaces the keys revoked by the revocation list.
+func (s *Server) loadRevocationList() error {
+	ids, err := LoadRevocations(s.revocationList)
+	if err != nil {
+		return err
+	}
+	listed := make(map[string]struct{}, len(ids))
+	for _, id := range ids {
+		listed[id] = struct{}{}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.listed = listed
+	return nil
+}
+
+// Revoke immediately refuses any further request signed by keyID, without
+// waiting for the registry poll. If a revocation list is configured the key
+// ID is appended to it, with reason as a comment, so the revocation
+// survives a restart.
+func (s *Server) Revoke(keyID, reason string) error {
+	if err := validKeyID(keyID); err != nil {
+		return err
+	}
+	// the reason is one line of the list and of the log
+	reason = strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) {
+			return ' '
+		}
+		return r
+	}, reason)
+	s.mu.Lock()
+	s.revoked[keyID] = struct{}{}
+	service := s.keys[keyID].service
+	s.mu.Unlock()
+	audit("key revoked",
+		"event", "key_revoked",
+		"key_id", keyID,
+		"service", service,
+		"reason", reason,
+	)
+
+	if s.revocationList == "" {
+		return nil
+	}
+	f, err := os.OpenFile(s.revocationList, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		return fmt.Errorf("open revocation list: %w", err)
+	}
+	_, err = fmt.Fprintf(f, "# %s %s\n%s\n",
+		time.Now().UTC().Format(time.RFC3339), reason, keyID,
+	)
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("append revocation list: %w", err)
+	}
+	return f.Close()
+}
+
+// isRevoked reports whether keyID has been revoked by any means.
+func (s *Server) isRevoked(keyID string) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	_, revoked := s.revoked[keyID]
+	_, listed := s.listed[keyID]
+	return revoked || listed
+}
+
+// audit logs a security event. Audit events carry "audit"=true so they can
+// be routed or alerted on separately from operational logs.
+func audit(msg string, args ...any) {
+	log.Warn(msg, append([]any{"audit", true}, args...)...)
+}
@@ -0,0 +1,113 @@
+package locket
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadRevocations(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "revoked")
+	require.NoError(t, os.WriteFile(path, []byte(
+		"# comment\n\nSHA256:abc\n  SHA256:def  \n",
+	), 0o600))
+	ids, err := LoadRevocations(path)
+	require.NoError(t, err)
+	require.Equal(t, []string{"SHA256:abc", "SHA256:def"}, ids)
+
+	require.NoError(t, os.WriteFile(path, []byte("SHA256:abc\nnot-a-key\n"), 0o600))
+	_, err = LoadRevocations(path)
+	require.ErrorContains(t, err, ":2:")
+
+	_, err = LoadRevocations(filepath.Join(t.TempDir(), "missing"))
+	require.Error(t, err)
+}
+
+// testRevocationServer registers one key and returns a status func posting
+// a request signed by it.
+func testRevocationServer(t *testing.T, entry RegEntry, options ...ServerOption) (*Server, string, func() int) {
+	t.Helper()
+	pub, priv, err := NewPairEd25519()
+	require.NoError(t, err)
+	entry.Name = "SERVICE1"
+	entry.KeyPub = pub
+	reg := FileRegistry{Path: filepath.Join(t.TempDir(), "registry.yml")}
+	require.NoError(t, reg.Upsert(entry))
+	ts, server := newTestServerWith(t, reg, options...)
+
+	clientPub, _, err := newPairRSA(Defaults.BitsizeRSA)
+	require.NoError(t, err)
+	return server, priv, func() int {
+		req := craftRequest(t, server.key.Public().PEM(), priv, testSecretName, clientPub, time.Now().Unix())
+		resp, _ := postRequest(t, ts.URL, req)
+		return resp.StatusCode
+	}
+}
+
+func TestHandlerRejectsExpiredEntry(t *testing.T) {
+	past := time.Now().Add(-time.Minute)
+	_, _, status := testRevocationServer(t, RegEntry{ExpiresAt: &past})
+	require.Equal(t, http.StatusForbidden, status())
+
+	future := time.Now().Add(time.Hour)
+	_, _, status = testRevocationServer(t, RegEntry{ExpiresAt: &future})
+	require.Equal(t, http.StatusOK, status())
+}
+
+func TestHandlerRejectsRevokedKey(t *testing.T) {
+	pub, priv, err := NewPairEd25519()
+	require.NoError(t, err)
+	key, err := ParseVerifyKey(pub)
+	require.NoError(t, err)
+	reg := FileRegistry{Path: filepath.Join(t.TempDir(), "registry.yml")}
+	require.NoError(t, reg.Upsert(RegEntry{Name: "SERVICE1", KeyPub: pub}))
+	ts, server := newTestServerWith(t, reg, WithRevoked(key.ID()))
+
+	clientPub, _, err := newPairRSA(Defaults.BitsizeRSA)
+	require.NoError(t, err)
+	req := craftRequest(t, server.key.Public().PEM(), priv, testSecretName, clientPub, time.Now().Unix())
+	resp, body := postRequest(t, ts.URL, req)
+	require.Equal(t, http.StatusForbidden, resp.StatusCode)
+	assertSecretNotLeaked(t, body, priv)
+}
+
+func TestServerRevoke(t *testing.T) {
+	list := filepath.Join(t.TempDir(), "revoked")
+	require.NoError(t, os.WriteFile(list, nil, 0o600))
+	server, priv, status := testRevocationServer(t, RegEntry{}, WithRevocationList(list))
+	require.Equal(t, http.StatusOK, status())
+
+	// takes effect immediately, with no registry poll
+	keyID := testKeyID(t, priv)
+	require.Error(t, server.Revoke("bogus", "typo"))
+	require.NoError(t, server.Revoke(keyID, "stolen\r\nlaptop\x00\u0085"))
+	require.Equal(t, http.StatusForbidden, status())
+
+	// and is persisted to the revocation list
+	ids, err := LoadRevocations(list)
+	require.NoError(t, err)
+	require.Equal(t, []string{keyID}, ids)
+	b, err := os.ReadFile(list)
+	require.NoError(t, err)
+	lines := strings.Split(strings.TrimSuffix(string(b), "\n"), "\n")
+	require.Len(t, lines, 2, "reason kept to its comment line")
+	require.True(t, strings.HasSuffix(lines[0], " stolen  laptop  "), lines[0])
+	require.NoError(t, server.loadRevocationList())
+	require.True(t, server.isRevoked(keyID))
+}
+
+func TestNewServerBadRevocationList(t *testing.T) {
+	reg := FileRegistry{Path: filepath.Join(t.TempDir(), "registry.yml")}
+	require.NoError(t, reg.write(nil))
+	source := Dotenv{Path: testEnvFile, ServiceSecrets: testServiceMap}
+	_, err := NewServer(context.Background(), source, reg, 0, nil,
+		WithRevocationList(filepath.Join(t.TempDir(), "missing")),
+	)
+	require.ErrorContains(t, err, "revocation list")
+}
@@ -0,0 +1,134 @@
+package locket
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// SecretDir satisfies the source interface, loading secrets from a tree
+// of files holding one secret each, as container platforms mount them:
+//   - <Path>/<service>/<key>: e.g. a Kubernetes secret volume per service
+//   - <Path>/<key>, if Service is set: e.g. Docker's /run/secrets
+//
+// A file's contents are its value, byte for byte, with no trimming.
+// Dotfiles are ignored, as are files directly in Path if Service is not
+// set, and directories below a service's.
+//
+// A directory holding a "..data" symlink, as Kubernetes mounts volumes,
+// is read through it, so a load sees one generation of the volume even if
+// it is swapped meanwhile. A load failing midway keeps no partial result:
+// with WithSecretReload, the server keeps its secrets until the next try.
+//
+// Files must not be accessible to other users unless AllowOtherRead (not
+// checked on Windows).
+type SecretDir struct {
+	Path    string // root of the secret tree
+	Service string // if set, files in Path are this service's secrets
+	// AllowOtherRead accepts files other users may read, but not write,
+	// as Docker mounts secrets with mode 0444. Kubernetes volumes can
+	// instead be mounted with defaultMode 0400 or 0440.
+	AllowOtherRead bool
+}
+
+// secretDirData is the symlink to the current generation of a Kubernetes
+// volume.
+const secretDirData = "..data"
+
+// Load reads every service's secret files.
+func (d SecretDir) Load() (map[string]Secrets, error) {
+	root, err := resolveDataLink(d.Path)
+	if err != nil {
+		return nil, err
+	}
+	if d.Service != "" {
+		kvs, err := d.readService(root)
+		if err != nil {
+			return nil, err
+		}
+		return map[string]Secrets{strings.ToLower(d.Service): kvs}, nil
+	}
+
+	files, err := os.ReadDir(root)
+	if err != nil {
+		return nil, fmt.Errorf("read dir: %w", err)
+	}
+	secrets := make(map[string]Secrets)
+	for _, f := range files {
+		if strings.HasPrefix(f.Name(), ".") {
+			continue
+		}
+		dir := filepath.Join(root, f.Name())
+		info, err := os.Stat(dir) // following symlinks
+		if err != nil {
+			return nil, fmt.Errorf("stat %q: %w", dir, err)
+		}
+		if !info.IsDir() {
+			log.Warn("skipping secret file outside a service directory", "dir", d.Path, "file", f.Name())
+			continue
+		}
+		dir, err = resolveDataLink(dir)
+		if err != nil {
+			return nil, err
+		}
+		kvs, err := d.readService(dir)
+		if err != nil {
+			return nil, err
+		}
+		pool := strings.ToLower(f.Name())
+		if _, ok := secrets[pool]; ok {
+			return nil, fmt.Errorf("service %q: more than one directory, names differ only in case", pool)
+		}
+		secrets[pool] = kvs
+		log.Debug("loaded secret dir service", "dir", d.Path, "service", pool, "qty", len(kvs))
+	}
+	return secrets, nil
+}
+
+// readService reads the secret files in dir.
+func (d SecretDir) readService(dir string) (Secrets, error) {
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("read dir: %w", err)
+	}
+	kvs := make(Secrets)
+	for _, f := range files {
+		if strings.HasPrefix(f.Name(), ".") {
+			continue
+		}
+		path := filepath.Join(dir, f.Name())
+		info, err := os.Stat(path) // following symlinks
+		if err != nil {
+			return nil, fmt.Errorf("stat %q: %w", path, err)
+		}
+		if info.IsDir() {
+			log.Debug("skipping directory in service secrets", "path", path)
+			continue
+		}
+		data, err := readPrivateFile(path, d.AllowOtherRead)
+		if err != nil {
+			return nil, err
+		}
+		kvs[f.Name()] = string(data)
+	}
+	return kvs, nil
+}
+
+// resolveDataLink returns the directory that dir's "..data" symlink points
+// to, or dir if it has none.
+func resolveDataLink(dir string) (string, error) {
+	data := filepath.Join(dir, secretDirData)
+	if _, err := os.Lstat(data); errors.Is(err, fs.ErrNotExist) {
+		return dir, nil
+	} else if err != nil {
+		return "", fmt.Errorf("stat %q: %w", data, err)
+	}
+	resolved, err := filepath.EvalSymlinks(data)
+	if err != nil {
+		return "", fmt.Errorf("resolve %q: %w", data, err)
+	}
+	return resolved, nil
+}
@@ -0,0 +1,124 @@
+package locket
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// writeSecretFiles writes files, by slash-separated path, under dir with
+// mode 0600.
+func writeSecretFiles(t *testing.T, dir string, files map[string]string) {
+	t.Helper()
+	for name, content := range files {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		require.NoError(t, os.MkdirAll(filepath.Dir(path), 0o700))
+		require.NoError(t, os.WriteFile(path, []byte(content), 0o600))
+	}
+}
+
+// kubeVolume lays out dir as Kubernetes mounts a secret volume: files in
+// a generation directory, reached through the "..data" symlink, with a
+// symlink per key. Calling it again swaps in a new generation.
+func kubeVolume(t *testing.T, dir, generation string, files map[string]string) {
+	t.Helper()
+	writeSecretFiles(t, filepath.Join(dir, generation), files)
+	tmp := filepath.Join(dir, "..data_tmp")
+	require.NoError(t, os.Symlink(generation, tmp))
+	require.NoError(t, os.Rename(tmp, filepath.Join(dir, secretDirData)))
+	for name := range files {
+		link := filepath.Join(dir, name)
+		if _, err := os.Lstat(link); err != nil {
+			require.NoError(t, os.Symlink(filepath.Join(secretDirData, name), link))
+		}
+	}
+}
+
+func TestSecretDir(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("symlinks need privileges on windows")
+	}
+	binary := string([]byte{0, 0xff, '\n', 0xfe, ' '})
+	root := t.TempDir()
+	writeSecretFiles(t, root, map[string]string{
+		"Service1/FOO":        "bar\n",
+		"Service1/CERT":       binary,
+		"Service1/.hidden":    "x",
+		"Service1/nested/KEY": "x",
+		"stray":               "x",
+	})
+	kubeVolume(t, filepath.Join(root, "service2"), "..2024_01_01", map[string]string{"TOKEN": "v1"})
+
+	secrets, err := SecretDir{Path: root}.Load()
+	require.NoError(t, err)
+	require.Equal(t, map[string]Secrets{
+		"service1": {"FOO": "bar\n", "CERT": binary},
+		"service2": {"TOKEN": "v1"},
+	}, secrets)
+
+	// a new generation swapped in is read as a whole
+	kubeVolume(t, filepath.Join(root, "service2"), "..2024_01_02", map[string]string{"TOKEN": "v2", "NEW": "n"})
+	secrets, err = SecretDir{Path: root}.Load()
+	require.NoError(t, err)
+	require.Equal(t, Secrets{"TOKEN": "v2", "NEW": "n"}, secrets["service2"])
+
+	t.Run("single service", func(t *testing.T) {
+		secrets, err := SecretDir{Path: filepath.Join(root, "Service1"), Service: "Service1"}.Load()
+		require.NoError(t, err)
+		require.Equal(t, map[string]Secrets{"service1": {"FOO": "bar\n", "CERT": binary}}, secrets)
+	})
+}
+
+func TestSecretDirPermissions(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("permissions are not checked on windows")
+	}
+	dir := t.TempDir()
+	writeSecretFiles(t, dir, map[string]string{"FOO": "bar"})
+	path := filepath.Join(dir, "FOO")
+
+	require.NoError(t, os.Chmod(path, 0o444))
+	_, err := SecretDir{Path: dir, Service: "service1"}.Load()
+	require.ErrorContains(t, err, "accessible to other users")
+	secrets, err := SecretDir{Path: dir, Service: "service1", AllowOtherRead: true}.Load()
+	require.NoError(t, err)
+	require.Equal(t, Secrets{"FOO": "bar"}, secrets["service1"])
+
+	require.NoError(t, os.Chmod(path, 0o646))
+	_, err = SecretDir{Path: dir, Service: "service1", AllowOtherRead: true}.Load()
+	require.ErrorContains(t, err, "accessible to other users")
+}
+
+func TestSecretReload(t *testing.T) {
+	pub, _, err := NewPairEd25519()
+	require.NoError(t, err)
+	reg := FileRegistry{Path: filepath.Join(t.TempDir(), "registry.yml")}
+	require.NoError(t, reg.Upsert(RegEntry{Name: "service1", KeyPub: pub}))
+	dir := t.TempDir()
+	writeSecretFiles(t, dir, map[string]string{"FOO": "v1"})
+
+	source := SecretDir{Path: dir, Service: "service1"}
+	// no registry polling: secrets reload on their own interval
+	server, err := NewServer(context.Background(), source, reg, 0, nil, WithSecretReload(5*time.Millisecond))
+	require.NoError(t, err)
+	t.Cleanup(server.Close)
+	get := func() string {
+		server.mu.RLock()
+		defer server.mu.RUnlock()
+		return server.secrets["service1"]["FOO"]
+	}
+	require.Equal(t, "v1", get())
+
+	writeSecretFiles(t, dir, map[string]string{"FOO": "v2"})
+	require.Eventually(t, func() bool { return get() == "v2" }, 5*time.Second, 5*time.Millisecond)
+
+	// a failed reload keeps the previous secrets
+	require.NoError(t, os.Chmod(filepath.Join(dir, "FOO"), 0o644))
+	require.Error(t, server.ReloadSecrets())
+	require.Equal(t, "v2", get())
+}
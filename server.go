@@ -2,11 +2,12 @@ package locket
 
 import (
 	"context"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net"
 	"net/http"
-	"strings"
 	"sync"
 	"time"
 
@@ -110,15 +111,40 @@ func (c *nonceCache) close() {
 // It validates client requests against a Registry of authorized
 // signing keys, refreshing the registry on a configurable interval.
 type Server struct {
-	secrets       map[string]Secrets
-	reg           Registry
-	entries       []RegEntry
-	mu            sync.RWMutex
-	allow         AllowRequestFunc
-	keyRsaPublic  string
-	keyRsaPrivate string
-	seen          *nonceCache
-	cancel        context.CancelFunc // stops the registry poll goroutine
+	secrets        map[string]Secrets
+	source         source        // secrets were loaded from, with settings resolved
+	secretReload   time.Duration // interval to reload secrets from source, if any
+	reg            Registry
+	entries        []RegEntry
+	keys           map[string]registeredKey     // signing key ID -> key, rebuilt with entries
+	labels         map[string]map[string]string // service -> labels, rebuilt with entries
+	mu             sync.RWMutex
+	allow          AllowRequestFunc
+	key            *decryptionKey // request encryption key pair, parsed once
+	privateOps     chan struct{}  // bounds concurrent private-key operations
+	seen           *nonceCache
+	policy         *Policy             // nil applies the implicit own-pool rule
+	revoked        map[string]struct{} // key IDs revoked by WithRevoked or Revoke
+	listed         map[string]struct{} // key IDs revoked by the revocation list
+	revocationList string              // path of the revocation list, if any
+	oidc           *OIDC               // if set, requests authenticate by JWT
+	tokens         *tokenVerifier      // verifies JWTs per oidc
+	strictRegistry bool                // refuse registries failing Validate
+	revision       int64               // registry revision applied, see ChangeTracker
+	signers        []VerifyKey         // operator keys the registry is signed by
+	requireSigned  bool                // refuse registries not signed by signers
+	cancel         context.CancelFunc  // stops the registry poll goroutine
+}
+
+// ServerOption configures optional Server behavior in NewServer.
+type ServerOption func(*Server)
+
+// WithPolicy authorizes secret reads with p instead of the implicit rule
+// that a service may only read secrets loaded under its own name.
+func WithPolicy(p *Policy) ServerOption {
+	return func(s *Server) {
+		s.policy = p
+	}
 }
 
 // kvResponse is the server's encrypted secret response.
@@ -128,32 +154,29 @@ type kvResponse struct {
 
 // NewServer creates a Server, loading secrets from the given source
 // and authorized clients from the given Registry. If pollInterval
-// is positive, the server refreshes its registry in the background.
+// is positive, the server refreshes its registry in the background:
+// as it changes if it is a Watcher, otherwise every pollInterval.
 // If allow is nil, AllowCIDR(Defaults.AllowCIDR) is used.
+// Any options are applied before the server starts polling.
 func NewServer(
 	ctx context.Context,
 	opts source,
 	reg Registry,
 	pollInterval time.Duration,
 	allow AllowRequestFunc,
+	options ...ServerOption,
 ) (*Server, error) {
 	if ctx == nil {
 		ctx = context.Background()
 	}
-	if reg == nil {
-		return nil, fmt.Errorf("registry must not be nil")
-	}
-
-	rsaPublic, rsaPrivate, err := newPairRSA(Defaults.BitsizeRSA)
+	key, err := newDecryptionKey(Defaults.BitsizeRSA)
 	if err != nil {
 		return nil, fmt.Errorf("generate key pair: %w", err)
 	}
-
-	entries, err := reg.Entries()
-	if err != nil {
-		return nil, fmt.Errorf("initial registry fetch: %w", err)
+	maxOps := Defaults.MaxPrivateKeyOps
+	if maxOps <= 0 {
+		maxOps = 1
 	}
-	log.Info("registry loaded", "entries", len(entries))
 
 	if allow == nil {
 		// validate up front so a bad Defaults.AllowCIDR fails fast here
@@ -168,27 +191,74 @@ func NewServer(
 	}
 
 	server := &Server{
-		reg:           reg,
-		entries:       entries,
-		allow:         allow,
-		keyRsaPublic:  rsaPublic,
-		keyRsaPrivate: rsaPrivate,
-		seen:          newNonceCache(Defaults.MaxClockSkew),
+		reg:        reg,
+		allow:      allow,
+		key:        key,
+		privateOps: make(chan struct{}, maxOps),
+		seen:       newNonceCache(Defaults.MaxClockSkew),
+		revoked:    make(map[string]struct{}),
+	}
+	for _, option := range options {
+		option(server)
+	}
+	if reg == nil && server.oidc == nil {
+		return nil, fmt.Errorf("registry must not be nil")
+	}
+	if server.requireSigned {
+		if len(server.signers) == 0 {
+			return nil, fmt.Errorf("signed registry required but no registry signers")
+		}
+		if _, ok := reg.(SignedRegistry); !ok {
+			return nil, fmt.Errorf("signed registry required but %T cannot be signed", reg)
+		}
+	}
+	if reg != nil {
+		entries, revision, _, err := server.fetchEntries()
+		if err != nil {
+			return nil, fmt.Errorf("initial registry fetch: %w", err)
+		}
+		log.Info("registry loaded", "entries", len(entries))
+		if err := server.applyEntries(entries); err != nil {
+			return nil, err
+		}
+		server.revision = revision
+	}
+	if server.oidc != nil {
+		server.tokens, err = newTokenVerifier(*server.oidc)
+		if err != nil {
+			return nil, fmt.Errorf("oidc: %w", err)
+		}
+		log.Info("authenticating requests by token", "issuer", server.oidc.Issuer)
+	}
+	if err := server.policy.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid policy: %w", err)
+	}
+	if server.revocationList != "" {
+		if err := server.loadRevocationList(); err != nil {
+			return nil, fmt.Errorf("load revocation list: %w", err)
+		}
 	}
 
 	switch opts := opts.(type) {
 	case Env:
+		if opts.Discover, err = server.withRegistryPrefixes(opts.Discover); err != nil {
+			return nil, fmt.Errorf("env: %w", err)
+		}
 		secrets, err := opts.Load()
 		if err != nil {
 			return nil, fmt.Errorf("load env: %w", err)
 		}
 		server.secrets = secrets
+		server.source = opts
 	case Dotenv:
-		if len(opts.ServiceSecrets) == 0 {
+		if len(opts.ServiceSecrets) == 0 && opts.Discover == nil {
 			return nil, fmt.Errorf(
-				"at least one service required to load *.env file",
+				"at least one service or discovery required to load *.env file",
 			)
 		}
+		if opts.Discover, err = server.withRegistryPrefixes(opts.Discover); err != nil {
+			return nil, fmt.Errorf("dotenv: %w", err)
+		}
 		if opts.Path == "" {
 			return nil, fmt.Errorf(
 				"opts.Path must be set to the .env file path",
@@ -199,22 +269,54 @@ func NewServer(
 			return nil, fmt.Errorf("load .env file: %w", err)
 		}
 		server.secrets = secrets
+		server.source = opts
+	case DotenvDir:
+		if opts.Path == "" {
+			return nil, fmt.Errorf(
+				"opts.Path must be set to the .env directory path",
+			)
+		}
+		secrets, err := opts.Load()
+		if err != nil {
+			return nil, fmt.Errorf("load dotenv dir: %w", err)
+		}
+		server.secrets = secrets
+		server.source = opts
+	case SecretDir:
+		if opts.Path == "" {
+			return nil, fmt.Errorf(
+				"opts.Path must be set to the secret directory path",
+			)
+		}
+		secrets, err := opts.Load()
+		if err != nil {
+			return nil, fmt.Errorf("load secret dir: %w", err)
+		}
+		server.secrets = secrets
+		server.source = opts
 	case Onepass:
 		secrets, err := opts.Load()
 		if err != nil {
 			return nil, fmt.Errorf("load onepass: %w", err)
 		}
 		server.secrets = secrets
+		server.source = opts
 	default:
 		return nil, fmt.Errorf("invalid source")
 	}
 
-	if pollInterval > 0 {
+	polling := pollInterval > 0 && reg != nil
+	if polling || server.secretReload > 0 {
 		// derive a child context so Close can stop polling independently of
 		// the caller's context (which may be context.Background()).
 		pollCtx, cancel := context.WithCancel(ctx)
 		server.cancel = cancel
-		go server.poll(pollCtx, pollInterval)
+		if polling {
+			go server.poll(pollCtx, pollInterval)
+		}
+		if server.secretReload > 0 {
+			go server.pollSecrets(pollCtx, server.secretReload)
+		}
 	}
 
 	return server, nil
@@ -230,35 +332,211 @@ func (s *Server) Close() {
 	s.seen.close()
 }
 
-// poll refreshes the registry on a fixed interval until ctx is cancelled.
+// poll refreshes the registry until ctx is cancelled. If the registry is a
+// Watcher, entries are reloaded as it reports changes; otherwise, or if
+// watching fails, they are fetched on every tick of interval. The
+// revocation list, if any, is reloaded on every tick.
 func (s *Server) poll(ctx context.Context, interval time.Duration) {
+	var watchDone chan struct{} // closed if watching stops; nil if polling
+	if w, ok := s.reg.(Watcher); ok {
+		watchDone = make(chan struct{})
+		go func() {
+			defer close(watchDone)
+			err := w.Watch(ctx, func(entries []RegEntry) {
+				if len(s.signers) > 0 {
+					// reload with the signatures over the change
+					var err error
+					entries, err = s.loadEntries()
+					if err != nil {
+						log.Error("registry change ignored", "error", err)
+						return
+					}
+				}
+				if err := s.applyEntries(entries); err != nil {
+					log.Error("registry change ignored", "error", err)
+					return
+				}
+				log.Debug("registry changed", "entries", len(entries))
+			})
+			if err != nil && ctx.Err() == nil {
+				log.Error("registry watch failed, polling instead", "error", err)
+			}
+		}()
+	}
+
 	ticker := time.NewTicker(interval)
 	defer ticker.Stop()
 	for {
 		select {
 		case <-ctx.Done():
 			return
+		case <-watchDone:
+			watchDone = nil
 		case <-ticker.C:
-			entries, err := s.reg.Entries()
+			if watchDone == nil {
+				entries, revision, changed, err := s.fetchEntries()
+				if errors.Is(err, ErrRegistryStale) {
+					log.Error("registry stale, refusing all keys", "error", err)
+					s.setEntries(nil)
+					continue
+				}
+				if err != nil {
+					log.Error("registry poll failed", "error", err)
+					continue
+				}
+				if !changed {
+					continue
+				}
+				if err := s.applyEntries(entries); err != nil {
+					log.Error("registry refresh ignored", "error", err)
+					continue
+				}
+				s.revision = revision
+				log.Debug("registry refreshed", "entries", len(entries), "revision", revision)
+			}
+			if s.revocationList != "" {
+				// keep the previous list rather than un-revoke on a bad read
+				if err := s.loadRevocationList(); err != nil {
+					log.Error("revocation list reload failed", "error", err)
+				}
+			}
+		}
+	}
+}
+
+// fetchEntries returns the registry's entries and revision, and whether
+// they changed. A ChangeTracker is asked only for the changes since the
+// revision last applied, which are merged into the current entries, unless
+// the registry is signed: a signature covers every entry.
+func (s *Server) fetchEntries() (entries []RegEntry, revision int64, changed bool, err error) {
+	tracker, ok := s.reg.(ChangeTracker)
+	if !ok || len(s.signers) > 0 {
+		entries, err := s.loadEntries()
+		return entries, 0, true, err
+	}
+	changes, err := tracker.Changes(s.revision)
+	if err != nil {
+		return nil, 0, false, err
+	}
+	if len(changes.Updated) == 0 && len(changes.Deleted) == 0 && s.revision != 0 {
+		return nil, changes.Revision, false, nil
+	}
+	deleted := make(map[string]bool, len(changes.Deleted))
+	for _, name := range changes.Deleted {
+		deleted[name] = true
+	}
+	s.mu.RLock()
+	for _, e := range s.entries {
+		if !deleted[e.Name] {
+			entries = append(entries, e)
+		}
+	}
+	s.mu.RUnlock()
+	for _, e := range changes.Updated {
+		entries = upsertEntry(entries, e)
+	}
+	return entries, changes.Revision, true, nil
+}
+
+// registeredKey is a parsed registry signing key, its validity bounds,
+// and the service it authenticates.
+type registeredKey struct {
+	service string
+	key     VerifyKey
+	bounds  RegKey     // NotBefore and NotAfter of the registered key
+	expires *time.Time // ExpiresAt of the registry entry
+}
+
+// indexKeys parses every key of every entry once and indexes it by key ID,
+// so verifying a request costs one map lookup and one signature check
+// however large the registry is. Unparseable keys are skipped with a warning.
+// Keys outside their validity bounds are indexed too, and refused at
+// request time, so a scheduled rotation needs no registry reload.
+func indexKeys(entries []RegEntry) map[string]registeredKey {
+	keys := make(map[string]registeredKey, len(entries))
+	for _, e := range entries {
+		for _, k := range e.AllKeys() {
+			key, err := ParseVerifyKey(k.KeyPub)
 			if err != nil {
-				log.Error("registry poll failed", "error", err)
+				log.Warn("skipping registry entry with invalid key",
+					"service", e.Name, "error", err,
+				)
 				continue
 			}
-			s.mu.Lock()
-			s.entries = entries
-			s.mu.Unlock()
-			log.Debug("registry refreshed", "entries", len(entries))
+			id := key.ID()
+			if prev, ok := keys[id]; ok {
+				log.Warn("registry key registered to more than one service",
+					"key_id", id,
+					"service", prev.service,
+					"ignored", e.Name,
+				)
+				continue
+			}
+			keys[id] = registeredKey{
+				service: e.Name, key: key, bounds: k, expires: e.ExpiresAt,
+			}
+		}
+	}
+	return keys
+}
+
+// setEntries replaces the registry snapshot and its key and label indexes.
+func (s *Server) setEntries(entries []RegEntry) {
+	keys := indexKeys(entries)
+	labels := make(map[string]map[string]string)
+	for _, e := range entries {
+		if len(e.Labels) > 0 {
+			labels[e.Name] = e.Labels
 		}
 	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.entries = entries
+	s.keys = keys
+	s.labels = labels
+}
+
+// serviceLabels returns the labels of the service's registry entry.
+func (s *Server) serviceLabels(service string) map[string]string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.labels[service]
 }
 
-// registrySnapshot returns a point-in-time copy of the registry.
-func (s *Server) registrySnapshot() []RegEntry {
+// lookupKey returns the registered key with the given ID, if any.
+func (s *Server) lookupKey(id string) (registeredKey, bool) {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
-	out := make([]RegEntry, len(s.entries))
-	copy(out, s.entries)
-	return out
+	k, ok := s.keys[id]
+	return k, ok
+}
+
+// errBusy reports that no private-key slot became free in time.
+var errBusy = errors.New("private key operations busy")
+
+// decrypt decrypts ciphertext with the server's private key, holding one of
+// a bounded number of slots so a burst of requests cannot monopolize the CPU.
+// It gives up with errBusy after Defaults.PrivateKeyWait, or when ctx ends.
+func (s *Server) decrypt(ctx context.Context, ciphertext string) (string, error) {
+	b, err := base64.StdEncoding.DecodeString(ciphertext)
+	if err != nil {
+		return "", fmt.Errorf("decode ciphertext: %w", err)
+	}
+	timer := time.NewTimer(Defaults.PrivateKeyWait)
+	defer timer.Stop()
+	select {
+	case s.privateOps <- struct{}{}:
+	case <-timer.C:
+		return "", errBusy
+	case <-ctx.Done():
+		return "", errBusy
+	}
+	defer func() { <-s.privateOps }()
+	plaintext, err := s.key.Decrypt(b)
+	if err != nil {
+		return "", err
+	}
+	return string(plaintext), nil
 }
 
 // Handler is the HTTP handler for the locket secret server.
@@ -281,7 +559,7 @@ func (s *Server) Handler(w http.ResponseWriter, r *http.Request) {
 		return
 	case http.MethodGet:
 		w.Header().Set("Content-Type", "text/plain")
-		w.Write([]byte(s.keyRsaPublic))
+		w.Write([]byte(s.key.Public().PEM()))
 		return
 	case http.MethodPost:
 		s.handlePost(w, r, id)
@@ -332,15 +610,17 @@ func (s *Server) handlePost(
 		"request_id", id,
 	)
 
-	payload, err := decryptRSA(s.keyRsaPrivate, request.Payload)
-	if err != nil {
-		log.Error("decrypt payload",
-			"request_id", id, "error", err,
+	// reject other protocol versions up front: older clients signed the
+	// plaintext, which cannot be checked without decrypting first.
+	if request.Version != protocolVersion {
+		log.Warn("unsupported protocol version",
+			"version", request.Version,
+			"want", protocolVersion,
+			"request_id", id,
 		)
-		http.Error(w, "bad request", http.StatusBadRequest)
+		http.Error(w, "unsupported protocol version", http.StatusBadRequest)
 		return
 	}
-	log.Debug("request payload decrypted", "request_id", id)
 
 	// a nonce is required to detect replays
 	if request.Nonce == "" {
@@ -364,37 +644,29 @@ func (s *Server) handlePost(
 		return
 	}
 
-	// verify signature against registry; the signed message binds the client
-	// pubkey, timestamp, and nonce so a captured request cannot be replayed
-	// with a substituted ClientPubKey to redirect the secret.
-	registry := s.registrySnapshot()
-	var verifiedService string
-	message := requestMessage(
-		payload, request.ClientPubKey, request.Timestamp, request.Nonce,
-	)
-	for _, svc := range registry {
-		match, err := verifyEd25519(
-			svc.KeyPub, message, request.PayloadSignature,
+	// a payload encrypted to another (e.g. pre-restart) server key can never
+	// decrypt; reject it without touching the private key.
+	if request.ServerKeyID != s.key.Public().ID() {
+		log.Warn("request encrypted to unknown server key",
+			"server_key_id", request.ServerKeyID,
+			"request_id", id,
 		)
-		if err != nil {
-			log.Error("verify signature",
-				"request_id", id, "error", err,
-			)
-			continue
-		}
-		if match {
-			verifiedService = svc.Name
-			break
-		}
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
 	}
-	if verifiedService == "" {
-		log.Error("signature mismatch", "request_id", id)
+
+	// authenticate by token in OIDC mode, or else by registry key
+	var verifiedService string
+	var ok bool
+	if s.oidc != nil {
+		verifiedService, ok = s.authenticateToken(request, r, id)
+	} else {
+		verifiedService, ok = s.authenticateKey(request, r, id)
+	}
+	if !ok {
 		http.Error(w, "forbidden", http.StatusForbidden)
 		return
 	}
-	log.Debug("signature verified",
-		"service", verifiedService, "request_id", id,
-	)
 
 	// reject replays: a nonce is valid only until a replay could no longer
 	// pass the freshness check above. Checked after signature verification
@@ -409,10 +681,59 @@ func (s *Server) handlePost(
 		return
 	}
 
-	secrets, ok := s.secrets[strings.ToLower(verifiedService)]
+	clientKey, err := parseEncryptionKey(request.ClientPubKey)
+	if err != nil {
+		log.Warn("parse client pubkey",
+			"request_id", id, "error", err,
+		)
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+
+	payload, err := s.decrypt(r.Context(), request.Payload)
+	if err != nil {
+		if errors.Is(err, errBusy) {
+			log.Warn("private key operations saturated",
+				"service", verifiedService,
+				"request_id", id,
+			)
+			w.Header().Set("Retry-After", "1")
+			http.Error(w, "service unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		log.Error("decrypt payload",
+			"request_id", id, "error", err,
+		)
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+	log.Debug("request payload decrypted", "request_id", id)
+
+	decision := s.policy.ExplainLabels(verifiedService, s.serviceLabels(verifiedService), payload)
+	if !decision.Allowed {
+		log.Warn("secret access denied by policy",
+			"service", verifiedService,
+			"key", payload,
+			"reason", decision.Reason,
+			"request_id", id,
+		)
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+	log.Debug("secret access allowed",
+		"service", verifiedService,
+		"key", payload,
+		"reason", decision.Reason,
+		"request_id", id,
+	)
+
+	s.mu.RLock()
+	secrets, ok := s.secrets[decision.Pool]
+	s.mu.RUnlock()
 	if !ok {
-		log.Warn("service not found, check case (expects lower)",
+		log.Warn("secret pool not found, check case (expects lower)",
 			"service", verifiedService,
+			"pool", decision.Pool,
 			"request_id", id,
 		)
 		http.Error(w, "forbidden", http.StatusForbidden)
@@ -423,6 +744,7 @@ func (s *Server) handlePost(
 	if !ok {
 		log.Warn("secret not found",
 			"service", verifiedService,
+			"pool", decision.Pool,
 			"key", payload,
 			"request_id", id,
 		)
@@ -430,7 +752,7 @@ func (s *Server) handlePost(
 		return
 	}
 
-	encrypted, err := encryptRSA(request.ClientPubKey, value)
+	encrypted, err := clientKey.Encrypt([]byte(value))
 	if err != nil {
 		log.Error("encrypt secret",
 			"request_id", id, "error", err,
@@ -440,7 +762,9 @@ func (s *Server) handlePost(
 	}
 
 	w.Header().Set("Content-Type", "application/json")
-	err = json.NewEncoder(w).Encode(kvResponse{Payload: encrypted})
+	err = json.NewEncoder(w).Encode(kvResponse{
+		Payload: base64.StdEncoding.EncodeToString(encrypted),
+	})
 	if err != nil {
 		log.Error("encode response",
 			"request_id", id, "error", err,
@@ -449,8 +773,79 @@ func (s *Server) handlePost(
 	}
 	log.Info("sending secret",
 		"service", verifiedService,
+		"key_id", request.KeyID,
 		"name", payload,
 		"ip", r.RemoteAddr,
 		"request_id", id,
 	)
 }
+
+// authenticateKey verifies request's signature against the registered key
+// it names, returning the key's service.
+func (s *Server) authenticateKey(request kvRequest, r *http.Request, id string) (string, bool) {
+	// refuse revoked keys before anything else; a valid signature from a
+	// revoked key suggests the key was stolen, so audit it as such.
+	if s.isRevoked(request.KeyID) {
+		key, known := s.lookupKey(request.KeyID)
+		sig, err := base64.StdEncoding.DecodeString(request.PayloadSignature)
+		signed := known && err == nil && key.key.Verify([]byte(requestMessage(
+			request.KeyID, request.ServerKeyID, request.Payload,
+			request.ClientPubKey, request.Timestamp, request.Nonce,
+		)), sig)
+		audit("revoked signing key used",
+			"event", "revoked_key_used",
+			"service", key.service,
+			"key_id", request.KeyID,
+			"signature_valid", signed,
+			"ip", r.RemoteAddr,
+			"request_id", id,
+		)
+		return "", false
+	}
+
+	// verify signature against the registered key it names; the signed
+	// message binds the client pubkey, timestamp, and nonce so a captured
+	// request cannot be replayed with a substituted ClientPubKey to redirect
+	// the secret. It also covers the ciphertext, so only authenticated
+	// requests reach decryption.
+	key, ok := s.lookupKey(request.KeyID)
+	if !ok {
+		log.Warn("unknown signing key",
+			"key_id", request.KeyID, "request_id", id,
+		)
+		return "", false
+	}
+	now := time.Now()
+	if key.expires != nil && !now.Before(*key.expires) {
+		log.Warn("registry entry expired",
+			"service", key.service,
+			"key_id", request.KeyID,
+			"expired_at", key.expires,
+			"request_id", id,
+		)
+		return "", false
+	}
+	if !key.bounds.ValidAt(now) {
+		log.Warn("signing key outside validity period",
+			"service", key.service,
+			"key_id", request.KeyID,
+			"request_id", id,
+		)
+		return "", false
+	}
+	message := requestMessage(
+		request.KeyID, request.ServerKeyID, request.Payload,
+		request.ClientPubKey, request.Timestamp, request.Nonce,
+	)
+	sig, err := base64.StdEncoding.DecodeString(request.PayloadSignature)
+	if err != nil || !key.key.Verify([]byte(message), sig) {
+		log.Error("signature mismatch",
+			"key_id", request.KeyID, "request_id", id, "error", err,
+		)
+		return "", false
+	}
+	log.Debug("signature verified",
+		"service", key.service, "key_id", request.KeyID, "request_id", id,
+	)
+	return key.service, true
+}
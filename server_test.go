@@ -3,7 +3,9 @@ package locket
 import (
 	"bytes"
 	"context"
+	"encoding/base64"
 	"encoding/json"
+	"fmt"
 	"io"
 	"net/http"
 	"net/http/httptest"
@@ -32,31 +34,43 @@ func newTestServer(t *testing.T) (*httptest.Server, *Server, string) {
 	reg := FileRegistry{Path: filepath.Join(t.TempDir(), "registry.yml")}
 	require.NoError(t, reg.Upsert(RegEntry{Name: "SERVICE1", KeyPub: pub}))
 
+	ts, server := newTestServerWith(t, reg)
+	return ts, server, priv
+}
+
+// newTestServerWith starts a test server over reg with the given options.
+func newTestServerWith(t *testing.T, reg Registry, options ...ServerOption) (*httptest.Server, *Server) {
+	t.Helper()
 	source := Dotenv{
 		Path:           testEnvFile,
 		ServiceSecrets: testServiceMap,
 	}
-	server, err := NewServer(context.Background(), source, reg, 0, nil)
+	server, err := NewServer(context.Background(), source, reg, 0, nil, options...)
 	require.NoError(t, err)
 	t.Cleanup(server.Close)
 
 	ts := httptest.NewServer(http.HandlerFunc(server.Handler))
 	t.Cleanup(ts.Close)
-	return ts, server, priv
+	return ts, server
 }
 
-// craftRequest builds a request body for secretName, signed by signingPriv,
-// with the response to be encrypted to clientRSAPub. ts is exposed so tests can
-// forge stale timestamps.
+// craftRequest builds a request body for secretName, encrypted to
+// serverRSAPub and signed by signingPriv, with the response to be encrypted to
+// clientRSAPub. ts is exposed so tests can forge stale timestamps.
 func craftRequest(t *testing.T, serverRSAPub, signingPriv, secretName, clientRSAPub string, ts int64) kvRequest {
 	t.Helper()
 	nonce, err := newNonce()
 	require.NoError(t, err)
-	payload, err := encryptRSA(serverRSAPub, secretName)
-	require.NoError(t, err)
-	sig, err := signEd25519(signingPriv, requestMessage(secretName, clientRSAPub, ts, nonce))
+	serverKey, err := parseEncryptionKey(serverRSAPub)
 	require.NoError(t, err)
+	serverKeyID := serverKey.ID()
+	keyID := testKeyID(t, signingPriv)
+	payload := testEncrypt(t, serverRSAPub, secretName)
+	sig := testSign(t, signingPriv, requestMessage(keyID, serverKeyID, payload, clientRSAPub, ts, nonce))
 	return kvRequest{
+		Version:          protocolVersion,
+		KeyID:            keyID,
+		ServerKeyID:      serverKeyID,
 		Payload:          payload,
 		PayloadSignature: sig,
 		ClientPubKey:     clientRSAPub,
@@ -65,6 +79,14 @@ func craftRequest(t *testing.T, serverRSAPub, signingPriv, secretName, clientRSA
 	}
 }
 
+// testKeyID derives the signing key ID from a private key PEM.
+func testKeyID(t testing.TB, signingPriv string) string {
+	t.Helper()
+	key, err := ParseSigningKey(signingPriv)
+	require.NoError(t, err)
+	return key.Public().ID()
+}
+
 func postRequest(t *testing.T, url string, req kvRequest) (*http.Response, []byte) {
 	t.Helper()
 	body, err := json.Marshal(req)
@@ -91,7 +113,7 @@ func assertSecretNotLeaked(t *testing.T, body []byte, priv string) {
 	if err := json.Unmarshal(body[idx:], &kv); err != nil || kv.Payload == "" {
 		return
 	}
-	got, err := decryptRSA(priv, kv.Payload)
+	got, err := testDecrypt(t, priv, kv.Payload)
 	if err != nil {
 		return
 	}
@@ -105,13 +127,13 @@ func TestHandlerHappyPath(t *testing.T) {
 	clientPub, clientPriv, err := newPairRSA(Defaults.BitsizeRSA)
 	require.NoError(t, err)
 
-	req := craftRequest(t, server.keyRsaPublic, signingPriv, testSecretName, clientPub, time.Now().Unix())
+	req := craftRequest(t, server.key.Public().PEM(), signingPriv, testSecretName, clientPub, time.Now().Unix())
 	resp, body := postRequest(t, ts.URL, req)
 	require.Equal(t, http.StatusOK, resp.StatusCode)
 
 	var kv kvResponse
 	require.NoError(t, json.Unmarshal(body, &kv))
-	got, err := decryptRSA(clientPriv, kv.Payload)
+	got, err := testDecrypt(t, clientPriv, kv.Payload)
 	require.NoError(t, err)
 	require.Equal(t, testSecretValue, got)
 }
@@ -129,7 +151,7 @@ func TestHandlerRejectsPubkeySubstitution(t *testing.T) {
 
 	// legitimate signed request, then swap in the attacker's response key
 	// while keeping the original signature and payload.
-	req := craftRequest(t, server.keyRsaPublic, signingPriv, testSecretName, clientPub, time.Now().Unix())
+	req := craftRequest(t, server.key.Public().PEM(), signingPriv, testSecretName, clientPub, time.Now().Unix())
 	req.ClientPubKey = attackerPub
 
 	resp, body := postRequest(t, ts.URL, req)
@@ -152,7 +174,7 @@ func TestHandlerRejectsOutOfCIDR(t *testing.T) {
 	clientPub, clientPriv, err := newPairRSA(Defaults.BitsizeRSA)
 	require.NoError(t, err)
 
-	req := craftRequest(t, server.keyRsaPublic, signingPriv, testSecretName, clientPub, time.Now().Unix())
+	req := craftRequest(t, server.key.Public().PEM(), signingPriv, testSecretName, clientPub, time.Now().Unix())
 	resp, body := postRequest(t, ts.URL, req)
 	require.Equal(t, http.StatusForbidden, resp.StatusCode)
 	assertSecretNotLeaked(t, body, clientPriv)
@@ -166,7 +188,7 @@ func TestHandlerRejectsReplay(t *testing.T) {
 	clientPub, clientPriv, err := newPairRSA(Defaults.BitsizeRSA)
 	require.NoError(t, err)
 
-	req := craftRequest(t, server.keyRsaPublic, signingPriv, testSecretName, clientPub, time.Now().Unix())
+	req := craftRequest(t, server.key.Public().PEM(), signingPriv, testSecretName, clientPub, time.Now().Unix())
 
 	resp1, _ := postRequest(t, ts.URL, req)
 	require.Equal(t, http.StatusOK, resp1.StatusCode)
@@ -230,8 +252,307 @@ func TestHandlerRejectsStaleTimestamp(t *testing.T) {
 	require.NoError(t, err)
 
 	stale := time.Now().Add(-1 * time.Hour).Unix()
-	req := craftRequest(t, server.keyRsaPublic, signingPriv, testSecretName, clientPub, stale)
+	req := craftRequest(t, server.key.Public().PEM(), signingPriv, testSecretName, clientPub, stale)
 	resp, body := postRequest(t, ts.URL, req)
 	require.Equal(t, http.StatusForbidden, resp.StatusCode)
 	assertSecretNotLeaked(t, body, clientPriv)
 }
+
+// TestHandlerAuthBeforeDecrypt confirms unauthenticated requests are refused
+// before any private-key work: a garbage payload that could never decrypt is
+// rejected as forbidden (signature) rather than bad request (decryption).
+func TestHandlerAuthBeforeDecrypt(t *testing.T) {
+	ts, server, _ := newTestServer(t)
+	_, otherPriv, err := NewPairEd25519()
+	require.NoError(t, err)
+	clientPub, _, err := newPairRSA(Defaults.BitsizeRSA)
+	require.NoError(t, err)
+
+	req := craftRequest(t, server.key.Public().PEM(), otherPriv, testSecretName, clientPub, time.Now().Unix())
+	req.Payload = "not ciphertext"
+	resp, _ := postRequest(t, ts.URL, req)
+	require.Equal(t, http.StatusForbidden, resp.StatusCode)
+
+	// a request for a different server key is rejected on its ID alone
+	req = craftRequest(t, server.key.Public().PEM(), otherPriv, testSecretName, clientPub, time.Now().Unix())
+	req.ServerKeyID = "SHA256:other"
+	resp, _ = postRequest(t, ts.URL, req)
+	require.Equal(t, http.StatusForbidden, resp.StatusCode)
+}
+
+// TestHandlerRejectsOldProtocol confirms requests from clients predating the
+// signed-ciphertext protocol are refused.
+func TestHandlerRejectsOldProtocol(t *testing.T) {
+	ts, server, signingPriv := newTestServer(t)
+	clientPub, _, err := newPairRSA(Defaults.BitsizeRSA)
+	require.NoError(t, err)
+
+	req := craftRequest(t, server.key.Public().PEM(), signingPriv, testSecretName, clientPub, time.Now().Unix())
+	req.Version = 0
+	resp, _ := postRequest(t, ts.URL, req)
+	require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+}
+
+// TestHandlerPrivateKeyBusy confirms that when every private-key slot is
+// held, an authenticated request is shed with 503 instead of queueing.
+func TestHandlerPrivateKeyBusy(t *testing.T) {
+	prev := Defaults.PrivateKeyWait
+	Defaults.PrivateKeyWait = 10 * time.Millisecond
+	t.Cleanup(func() { Defaults.PrivateKeyWait = prev })
+
+	ts, server, signingPriv := newTestServer(t)
+	clientPub, _, err := newPairRSA(Defaults.BitsizeRSA)
+	require.NoError(t, err)
+
+	for i := 0; i < cap(server.privateOps); i++ {
+		server.privateOps <- struct{}{}
+	}
+	req := craftRequest(t, server.key.Public().PEM(), signingPriv, testSecretName, clientPub, time.Now().Unix())
+	resp, _ := postRequest(t, ts.URL, req)
+	require.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+	require.Equal(t, "1", resp.Header.Get("Retry-After"))
+}
+
+// TestHandlerFloodLoad is a load test: legitimate clients keep fetching while
+// a flood of unauthenticated requests hits the server. Because forged requests
+// fail signature verification before decryption, legitimate throughput
+// should stay within the same order of magnitude as without the flood.
+func TestHandlerFloodLoad(t *testing.T) {
+	if testing.Short() {
+		t.Skip("load test")
+	}
+	ts, server, signingPriv := newTestServer(t)
+	clientPub, _, err := newPairRSA(Defaults.BitsizeRSA)
+	require.NoError(t, err)
+	_, attackerPriv, err := NewPairEd25519()
+	require.NoError(t, err)
+
+	const window = 500 * time.Millisecond
+	const legitWorkers = 4
+	httpClient := &http.Client{Transport: &http.Transport{MaxIdleConnsPerHost: 64}}
+
+	// pre-build requests so the client side measures only the server
+	buildLegit := func() [][]kvRequest {
+		batches := make([][]kvRequest, legitWorkers)
+		for w := range batches {
+			batches[w] = make([]kvRequest, 200)
+			for i := range batches[w] {
+				batches[w][i] = craftRequest(t, server.key.Public().PEM(), signingPriv, testSecretName, clientPub, time.Now().Unix())
+			}
+		}
+		return batches
+	}
+	forged := craftRequest(t, server.key.Public().PEM(), attackerPriv, testSecretName, clientPub, time.Now().Unix())
+	forgedBody, err := json.Marshal(forged)
+	require.NoError(t, err)
+
+	post := func(req kvRequest) (int, error) {
+		body, err := json.Marshal(req)
+		if err != nil {
+			return 0, err
+		}
+		resp, err := httpClient.Post(ts.URL, "application/json", bytes.NewReader(body))
+		if err != nil {
+			return 0, err
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		return resp.StatusCode, nil
+	}
+	// measure counts the requests of batches served within window, one
+	// worker per batch; the clock starts once the requests are built.
+	measure := func(batches [][]kvRequest) int {
+		var mu sync.Mutex
+		var ok int
+		var wg sync.WaitGroup
+		errs := make(chan error, len(batches))
+		deadline := time.Now().Add(window)
+		for _, batch := range batches {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for _, req := range batch {
+					if time.Now().After(deadline) {
+						return
+					}
+					status, err := post(req)
+					if err != nil {
+						errs <- err
+						return
+					}
+					if status == http.StatusOK {
+						mu.Lock()
+						ok++
+						mu.Unlock()
+					}
+				}
+			}()
+		}
+		wg.Wait()
+		close(errs)
+		for err := range errs {
+			t.Errorf("legit request: %v", err)
+		}
+		return ok
+	}
+
+	baseline := measure(buildLegit())
+	require.Greater(t, baseline, 0)
+
+	legit := buildLegit()
+	stop := make(chan struct{})
+	var flooders sync.WaitGroup
+	var floodMu sync.Mutex
+	floodStatus := make(map[int]int)
+	for f := 0; f < 4*legitWorkers; f++ {
+		flooders.Add(1)
+		go func() {
+			defer flooders.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				resp, err := httpClient.Post(ts.URL, "application/json", bytes.NewReader(forgedBody))
+				if err != nil {
+					continue
+				}
+				io.Copy(io.Discard, resp.Body)
+				resp.Body.Close()
+				floodMu.Lock()
+				floodStatus[resp.StatusCode]++
+				floodMu.Unlock()
+			}
+		}()
+	}
+	underFlood := measure(legit)
+	close(stop)
+	flooders.Wait()
+
+	t.Logf("legit requests per %s: baseline=%d, under flood=%d; flood responses: %v",
+		window, baseline, underFlood, floodStatus)
+	require.Len(t, floodStatus, 1, "every forged request must be rejected the same way")
+	require.Contains(t, floodStatus, http.StatusForbidden)
+	require.GreaterOrEqual(t, underFlood*10, baseline,
+		"legitimate throughput collapsed under flood")
+}
+
+// TestHandlerRejectsSwappedKeyID confirms a request signed by one registered
+// service cannot claim another service's key ID.
+func TestHandlerRejectsSwappedKeyID(t *testing.T) {
+	ts, server, signingPriv := newTestServer(t)
+	otherPub, _, err := NewPairEd25519()
+	require.NoError(t, err)
+	other, err := ParseVerifyKey(otherPub)
+	require.NoError(t, err)
+	server.setEntries(append(server.entries, RegEntry{Name: "SERVICE2", KeyPub: otherPub}))
+
+	clientPub, _, err := newPairRSA(Defaults.BitsizeRSA)
+	require.NoError(t, err)
+	req := craftRequest(t, server.key.Public().PEM(), signingPriv, testSecretName, clientPub, time.Now().Unix())
+	req.KeyID = other.ID()
+	resp, _ := postRequest(t, ts.URL, req)
+	require.Equal(t, http.StatusForbidden, resp.StatusCode)
+}
+
+// testVerifyPEM parses publicKeyPEM and verifies a base64 signature, as the
+// server did for every registry entry before keys were indexed.
+func testVerifyPEM(publicKeyPEM, message, signature string) (bool, error) {
+	key, err := ParseVerifyKey(publicKeyPEM)
+	if err != nil {
+		return false, err
+	}
+	return testVerify(key, message, signature), nil
+}
+
+// testVerify verifies a base64 signature with an already parsed key.
+func testVerify(key VerifyKey, message, signature string) bool {
+	sig, err := base64.StdEncoding.DecodeString(signature)
+	return err == nil && key.Verify([]byte(message), sig)
+}
+
+// BenchmarkVerifyRegistry compares finding the signer of a request by trying
+// every registry entry (the previous approach, worst case: the signer is last)
+// against a single key ID index lookup.
+func BenchmarkVerifyRegistry(b *testing.B) {
+	for _, size := range []int{10, 10_000} {
+		entries := make([]RegEntry, size)
+		var priv string
+		for i := range entries {
+			pub, p, err := NewPairEd25519()
+			require.NoError(b, err)
+			entries[i] = RegEntry{Name: fmt.Sprintf("svc%d", i), KeyPub: pub}
+			priv = p
+		}
+		message := "benchmark message"
+		sig := testSign(b, priv, message)
+		keyID := testKeyID(b, priv)
+
+		b.Run(fmt.Sprintf("linear/%d", size), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				found := false
+				for _, e := range entries {
+					if ok, _ := testVerifyPEM(e.KeyPub, message, sig); ok {
+						found = true
+						break
+					}
+				}
+				if !found {
+					b.Fatal("no match")
+				}
+			}
+		})
+
+		keys := indexKeys(entries)
+		b.Run(fmt.Sprintf("indexed/%d", size), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				k, ok := keys[keyID]
+				if !ok {
+					b.Fatal("no key")
+				}
+				if !testVerify(k.key, message, sig) {
+					b.Fatal("no match")
+				}
+			}
+		})
+	}
+}
+
+// TestHandlerKeyRotation confirms every currently valid key of a service is
+// accepted during a rotation, and keys outside their validity are refused.
+func TestHandlerKeyRotation(t *testing.T) {
+	oldPub, oldPriv, err := NewPairEd25519()
+	require.NoError(t, err)
+	newPub, newPriv, err := NewPairEd25519()
+	require.NoError(t, err)
+	futurePub, futurePriv, err := NewPairEd25519()
+	require.NoError(t, err)
+
+	reg := FileRegistry{Path: filepath.Join(t.TempDir(), "registry.yml")}
+	require.NoError(t, reg.Upsert(RegEntry{Name: "SERVICE1", KeyPub: oldPub}))
+	require.NoError(t, reg.AddKey("SERVICE1", RegKey{KeyPub: newPub}))
+	notBefore := time.Now().Add(time.Hour)
+	require.NoError(t, reg.AddKey("SERVICE1", RegKey{KeyPub: futurePub, NotBefore: &notBefore}))
+
+	ts, server := newTestServerWith(t, reg)
+
+	clientPub, _, err := newPairRSA(Defaults.BitsizeRSA)
+	require.NoError(t, err)
+	status := func(signingPriv string) int {
+		req := craftRequest(t, server.key.Public().PEM(), signingPriv, testSecretName, clientPub, time.Now().Unix())
+		resp, _ := postRequest(t, ts.URL, req)
+		return resp.StatusCode
+	}
+	require.Equal(t, http.StatusOK, status(oldPriv))
+	require.Equal(t, http.StatusOK, status(newPriv))
+	require.Equal(t, http.StatusForbidden, status(futurePriv), "not yet valid")
+
+	// retire the old key and pick up the change, as a poll would
+	require.NoError(t, reg.RetireKey("SERVICE1", testKeyID(t, oldPriv), time.Now()))
+	entries, err := reg.Entries()
+	require.NoError(t, err)
+	server.setEntries(entries)
+	require.Equal(t, http.StatusForbidden, status(oldPriv))
+	require.Equal(t, http.StatusOK, status(newPriv))
+}
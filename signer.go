@@ -0,0 +1,215 @@
+package locket
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// Signer signs client requests with an ed25519 key whose public half is
+// registered with the server. Implementations may keep the private key
+// out of process memory entirely, e.g. AgentSigner.
+type Signer interface {
+	// Public returns the public key the server verifies against.
+	Public() VerifyKey
+	// Sign returns the raw ed25519 signature of message.
+	Sign(message []byte) ([]byte, error)
+}
+
+// Signer implementations:
+//   - SigningKey: the private key parsed into process memory
+//   - FileSigner: re-reads the private key from a file for each signature
+//   - NewCredentialSigner: a FileSigner over a systemd credential
+//   - AgentSigner: the private key stays in an ssh-agent
+//
+// Other backends (KMS, HSM) need only implement Signer and be passed to
+// NewClientWithSigner.
+var (
+	_ Signer = (*SigningKey)(nil)
+	_ Signer = (*FileSigner)(nil)
+	_ Signer = (*AgentSigner)(nil)
+)
+
+// FileSigner signs with a private key read from a file on demand, so the
+// key is held in memory only while signing. Any encoding ParseSigningKey
+// accepts may be used. The public key is pinned when the signer is made;
+// if the file later holds a different key, Sign fails rather than produce
+// signatures the server would attribute to the wrong key, and a new
+// signer (and client) must be made after rotating the file.
+type FileSigner struct {
+	path   string
+	public VerifyKey
+}
+
+// NewFileSigner returns a Signer reading its private key from path.
+func NewFileSigner(path string) (*FileSigner, error) {
+	key, err := readSigningKey(path)
+	if err != nil {
+		return nil, err
+	}
+	defer clear(key.private)
+	return &FileSigner{path: path, public: key.Public()}, nil
+}
+
+// NewCredentialSigner returns a FileSigner over the systemd credential
+// name, i.e. $CREDENTIALS_DIRECTORY/name, as set up by LoadCredential= or
+// SetCredentialEncrypted= in the service unit.
+func NewCredentialSigner(name string) (*FileSigner, error) {
+	dir := os.Getenv("CREDENTIALS_DIRECTORY")
+	if dir == "" {
+		return nil, errors.New("CREDENTIALS_DIRECTORY not set, not running under systemd with credentials")
+	}
+	if name == "" || name != filepath.Base(name) {
+		return nil, fmt.Errorf("invalid credential name %q", name)
+	}
+	return NewFileSigner(filepath.Join(dir, name))
+}
+
+// Public returns the public key pinned when the signer was made.
+func (s *FileSigner) Public() VerifyKey {
+	return s.public
+}
+
+// Sign reads the private key, signs message, and discards the key.
+func (s *FileSigner) Sign(message []byte) ([]byte, error) {
+	key, err := readSigningKey(s.path)
+	if err != nil {
+		return nil, err
+	}
+	defer clear(key.private)
+	if key.Public().ID() != s.public.ID() {
+		return nil, fmt.Errorf("key file %q changed since signer was created", s.path)
+	}
+	return key.Sign(message)
+}
+
+// readSigningKey reads and parses a private key file, scrubbing the raw
+// file contents once parsed.
+func readSigningKey(path string) (*SigningKey, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read key file: %w", err)
+	}
+	defer clear(b)
+	key, err := ParseSigningKey(string(b))
+	if err != nil {
+		return nil, fmt.Errorf("parse key file %q: %w", path, err)
+	}
+	return key, nil
+}
+
+// AgentSigner signs with an ed25519 key held by an ssh-agent, so the
+// private key never leaves the agent. A connection to the agent socket is
+// made for each signature, so an agent restart is picked up transparently.
+type AgentSigner struct {
+	socket string
+	key    ssh.PublicKey
+	public VerifyKey
+}
+
+// NewAgentSigner returns a Signer backed by the ssh-agent listening on
+// socket, or on $SSH_AUTH_SOCK if socket is empty. publicKey selects the
+// agent key to sign with, in any encoding ParseVerifyKey accepts (e.g. the
+// contents of id_ed25519.pub). If publicKey is empty the agent must hold
+// exactly one ed25519 key.
+func NewAgentSigner(socket, publicKey string) (*AgentSigner, error) {
+	if socket == "" {
+		socket = os.Getenv("SSH_AUTH_SOCK")
+	}
+	if socket == "" {
+		return nil, errors.New("no agent socket: SSH_AUTH_SOCK not set")
+	}
+
+	var want ed25519.PublicKey
+	if publicKey != "" {
+		key, err := ParseVerifyKey(publicKey)
+		if err != nil {
+			return nil, fmt.Errorf("parse public key: %w", err)
+		}
+		want = key.key
+	}
+
+	signer := &AgentSigner{socket: socket}
+	var keys []*agent.Key
+	err := signer.withAgent(func(a agent.ExtendedAgent) error {
+		var err error
+		keys, err = a.List()
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("list agent keys: %w", err)
+	}
+
+	var matches []ed25519.PublicKey
+	for _, k := range keys {
+		if k.Type() != ssh.KeyAlgoED25519 {
+			continue
+		}
+		pub, err := ssh.ParsePublicKey(k.Marshal())
+		if err != nil {
+			continue
+		}
+		edKey, ok := pub.(ssh.CryptoPublicKey).CryptoPublicKey().(ed25519.PublicKey)
+		if !ok {
+			continue
+		}
+		if want != nil && !bytes.Equal(want, edKey) {
+			continue
+		}
+		signer.key = pub
+		matches = append(matches, edKey)
+	}
+	switch {
+	case len(matches) == 0 && want != nil:
+		return nil, fmt.Errorf("key %s not held by agent", signingKeyID(want))
+	case len(matches) == 0:
+		return nil, errors.New("agent holds no ed25519 keys")
+	case len(matches) > 1:
+		return nil, fmt.Errorf(
+			"agent holds %d ed25519 keys, select one by public key", len(matches),
+		)
+	}
+	signer.public = newVerifyKey(matches[0])
+	return signer, nil
+}
+
+// Public returns the agent key's public half.
+func (s *AgentSigner) Public() VerifyKey {
+	return s.public
+}
+
+// Sign asks the agent to sign message. ssh-ed25519 signatures are plain
+// ed25519 signatures over the message, so the server verifies them as any
+// other request signature.
+func (s *AgentSigner) Sign(message []byte) ([]byte, error) {
+	var sig *ssh.Signature
+	err := s.withAgent(func(a agent.ExtendedAgent) error {
+		var err error
+		sig, err = a.Sign(s.key, message)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("agent sign: %w", err)
+	}
+	if sig.Format != ssh.KeyAlgoED25519 {
+		return nil, fmt.Errorf("unexpected signature format %q", sig.Format)
+	}
+	return sig.Blob, nil
+}
+
+// withAgent runs fn against a fresh connection to the agent.
+func (s *AgentSigner) withAgent(fn func(agent.ExtendedAgent) error) error {
+	conn, err := net.Dial("unix", s.socket)
+	if err != nil {
+		return fmt.Errorf("dial agent: %w", err)
+	}
+	defer conn.Close()
+	return fn(agent.NewClient(conn))
+}
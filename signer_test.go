@@ -0,0 +1,161 @@
+package locket
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// startAgent serves an in-memory ssh-agent holding keys on a unix socket,
+// returning the socket path.
+func startAgent(t *testing.T, keys ...ed25519.PrivateKey) string {
+	t.Helper()
+	keyring := agent.NewKeyring()
+	for _, k := range keys {
+		require.NoError(t, keyring.Add(agent.AddedKey{PrivateKey: k}))
+	}
+	socket := filepath.Join(t.TempDir(), "agent.sock")
+	l, err := net.Listen("unix", socket)
+	require.NoError(t, err)
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				agent.ServeAgent(keyring, conn)
+			}()
+		}
+	}()
+	return socket
+}
+
+func newTestEd25519(t *testing.T) ed25519.PrivateKey {
+	t.Helper()
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	return priv
+}
+
+func TestAgentSigner(t *testing.T) {
+	priv := newTestEd25519(t)
+	socket := startAgent(t, priv)
+
+	signer, err := NewAgentSigner(socket, "")
+	require.NoError(t, err)
+	require.Equal(t, signingKeyID(priv.Public().(ed25519.PublicKey)), signer.Public().ID())
+
+	sig, err := signer.Sign(testCypher)
+	require.NoError(t, err)
+	require.True(t, signer.Public().Verify(testCypher, sig))
+}
+
+func TestAgentSignerSelectKey(t *testing.T) {
+	a, b := newTestEd25519(t), newTestEd25519(t)
+	socket := startAgent(t, a, b)
+
+	_, err := NewAgentSigner(socket, "")
+	require.ErrorContains(t, err, "select one")
+
+	authorized, err := newSigningKey(b).Public().AuthorizedKey()
+	require.NoError(t, err)
+	signer, err := NewAgentSigner(socket, authorized)
+	require.NoError(t, err)
+	require.Equal(t, newSigningKey(b).Public().ID(), signer.Public().ID())
+
+	other := newSigningKey(newTestEd25519(t)).Public().PEM()
+	_, err = NewAgentSigner(socket, other)
+	require.ErrorContains(t, err, "not held by agent")
+}
+
+func TestAgentSignerNoSocket(t *testing.T) {
+	t.Setenv("SSH_AUTH_SOCK", "")
+	_, err := NewAgentSigner("", "")
+	require.ErrorContains(t, err, "SSH_AUTH_SOCK")
+}
+
+// TestAgentSignerE2E registers a service by its authorized_keys line and
+// fetches a secret with a client whose key lives only in the agent.
+func TestAgentSignerE2E(t *testing.T) {
+	priv := newTestEd25519(t)
+	t.Setenv("SSH_AUTH_SOCK", startAgent(t, priv))
+	authorized, err := newSigningKey(priv).Public().AuthorizedKey()
+	require.NoError(t, err)
+
+	reg := FileRegistry{Path: filepath.Join(t.TempDir(), "registry.yml")}
+	require.NoError(t, reg.Upsert(RegEntry{Name: "SERVICE1", KeyPub: authorized + " ci@runner"}))
+	source := Dotenv{Path: testEnvFile, ServiceSecrets: testServiceMap}
+	server, err := NewServer(context.Background(), source, reg, 0, nil)
+	require.NoError(t, err)
+	t.Cleanup(server.Close)
+	ts := httptest.NewServer(http.HandlerFunc(server.Handler))
+	t.Cleanup(ts.Close)
+
+	signer, err := NewAgentSigner("", "")
+	require.NoError(t, err)
+	client, err := NewClientWithSigner(ts.URL, signer)
+	require.NoError(t, err)
+	got, err := client.FetchSecret(testSecretName)
+	require.NoError(t, err)
+	require.Equal(t, testSecretValue, got)
+}
+
+func TestFileSigner(t *testing.T) {
+	pub, priv, err := NewPairEd25519()
+	require.NoError(t, err)
+	path := filepath.Join(t.TempDir(), "signing.pem")
+	require.NoError(t, os.WriteFile(path, []byte(priv), 0o600))
+
+	signer, err := NewFileSigner(path)
+	require.NoError(t, err)
+	verifyKey, err := ParseVerifyKey(pub)
+	require.NoError(t, err)
+	require.Equal(t, verifyKey.ID(), signer.Public().ID())
+
+	sig, err := signer.Sign(testCypher)
+	require.NoError(t, err)
+	require.True(t, verifyKey.Verify(testCypher, sig))
+
+	// a swapped key file is refused rather than signed with
+	_, other, err := NewPairEd25519()
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(path, []byte(other), 0o600))
+	_, err = signer.Sign(testCypher)
+	require.ErrorContains(t, err, "changed")
+
+	require.NoError(t, os.Remove(path))
+	_, err = signer.Sign(testCypher)
+	require.Error(t, err)
+}
+
+func TestCredentialSigner(t *testing.T) {
+	dir := t.TempDir()
+	_, priv, err := NewPairEd25519()
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "locket-key"), []byte(priv), 0o400))
+
+	t.Setenv("CREDENTIALS_DIRECTORY", "")
+	_, err = NewCredentialSigner("locket-key")
+	require.ErrorContains(t, err, "CREDENTIALS_DIRECTORY")
+
+	t.Setenv("CREDENTIALS_DIRECTORY", dir)
+	_, err = NewCredentialSigner("../locket-key")
+	require.Error(t, err)
+	signer, err := NewCredentialSigner("locket-key")
+	require.NoError(t, err)
+	sig, err := signer.Sign(testCypher)
+	require.NoError(t, err)
+	require.True(t, signer.Public().Verify(testCypher, sig))
+}
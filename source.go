@@ -1,10 +1,10 @@
 package locket
 
 import (
-	"bufio"
 	"context"
 	"errors"
 	"fmt"
+	"maps"
 	"math/rand/v2"
 	"os"
 	"strings"
@@ -20,9 +20,11 @@ type Secrets map[string]string // all key/value secrets for a single service
 
 // source represents a valid source for secrets.
 // examples include:
-//   - dotenv: service-name.env files
+//   - dotenv: a .env file
+//   - dotenvdir: a directory of service-name.env files
 //   - env: environment variables
 //   - onepass: 1password vault
+//   - secretdir: a tree of files holding one secret each
 type source interface {
 	Load() (map[string]Secrets, error)
 }
@@ -31,6 +33,7 @@ type source interface {
 // loading secrets from the local environment.
 type Env struct {
 	ServiceSecrets map[string][]string // service name mapped to list of service secret names
+	Discover       *Discovery          // if set, also assign variables to services by prefix
 }
 
 // Load k=v pairs from local environment.
@@ -45,6 +48,7 @@ func (e Env) Load() (map[string]Secrets, error) {
 	log.Debug("loaded all environment vars", "qty", len(environment))
 	// parent has all services keyed on name (lowercase) and a secrets object.
 	parent := make(map[string]Secrets)
+	vars := make(map[string]string, len(environment))
 	for _, env := range environment {
 		// secrets := make(Secrets)
 		parts := strings.SplitN(env, "=", 2)
@@ -54,6 +58,7 @@ func (e Env) Load() (map[string]Secrets, error) {
 		}
 		key := strings.TrimSpace(parts[0])
 		value := strings.Trim(parts[1], `"'`)
+		vars[key] = value
 		for serviceName, secretNames := range e.ServiceSecrets {
 			// Is this secret one that's called for by the service?
 			for _, name := range secretNames {
@@ -74,58 +79,32 @@ func (e Env) Load() (map[string]Secrets, error) {
 			}
 		}
 	}
+	discover(e.Discover, vars, parent, "env", false)
 	return parent, nil
 }
 
 // Dotenv satisfies the source interface,
 // loading secrets from a specified path to .env file.
+// See dotenv.go for the file format.
 type Dotenv struct {
 	Path           string              // path to .env file to read
 	ServiceSecrets map[string][]string // service names and a list of their secrets
+	Interpolate    bool                // replace ${VAR} from the file or environment
+	Discover       *Discovery          // if set, also assign variables to services by prefix
 }
 
-// Load k=v pairs from a .env file, ignoring any #comments.
+// Load k=v pairs from a .env file.
 // Service name will be set by the keys in ServiceSecrets map.
 func (d Dotenv) Load() (map[string]Secrets, error) {
 	pwd, _ := os.Getwd()
 	log.Debug("loading file", "path", d.Path, "pwd", pwd)
-	f, err := os.Open(d.Path)
+	vars, err := readDotenv(d.Path, d.Interpolate)
 	if err != nil {
-		return nil, fmt.Errorf("open file %q: %w", d.Path, err)
+		return nil, err
 	}
-	defer f.Close()
 
-	delimiter := "="
 	allSecrets := make(map[string]Secrets)
-	scanner := bufio.NewScanner(f)
-	lineNum := 0
-	for scanner.Scan() {
-		lineNum++
-		line := scanner.Text()
-
-		// skip line comments
-		line = strings.TrimSpace(line)
-		if strings.HasPrefix(line, "#") || line == "" {
-			continue
-		}
-
-		// remove trailing comments
-		if idx := strings.Index(line, " #"); idx != -1 {
-			line = strings.TrimSpace(line[:idx])
-		}
-
-		// separate key and value
-		parts := strings.SplitN(line, delimiter, 2)
-		if len(parts) != 2 {
-			log.Debug("skipping invalid line", "line_num", lineNum)
-			return nil, fmt.Errorf("invalid line: %s", line)
-		}
-		key := parts[0]
-		// strip leading and trailing quotes
-		// value := parts[1]
-		value := strings.ReplaceAll(parts[1], `\n`, "\n")
-		value = strings.Trim(value, `"'`)
-
+	for key, value := range vars {
 		// load only secrets specified by serviceSecrets
 		for serviceName, secretsList := range d.ServiceSecrets {
 			nameLower := strings.ToLower(serviceName)
@@ -144,11 +123,7 @@ func (d Dotenv) Load() (map[string]Secrets, error) {
 			}
 		}
 	}
-
-	if err := scanner.Err(); err != nil {
-		return nil, fmt.Errorf("scan file: %w", err)
-	}
-
+	discover(d.Discover, vars, allSecrets, d.Path, true)
 	return allSecrets, nil
 }
 
@@ -245,3 +220,53 @@ func (o Onepass) Load() (map[string]Secrets, error) {
 	)
 	return allSecrets, nil
 }
+
+// WithSecretReload reloads secrets from the server's source every
+// interval, so changes, such as a rotated secret file, apply without a
+// restart. A failed reload keeps the previous secrets. The interval is
+// independent of registry polling, as a reload may read a whole vault.
+// A non-positive interval disables reloading.
+func WithSecretReload(interval time.Duration) ServerOption {
+	return func(s *Server) {
+		s.secretReload = interval
+	}
+}
+
+// pollSecrets reloads secrets every interval until ctx is cancelled.
+func (s *Server) pollSecrets(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			// keep the previous secrets rather than drop them on a bad read
+			if err := s.ReloadSecrets(); err != nil {
+				log.Error("secret reload failed", "error", err)
+			}
+		}
+	}
+}
+
+// ReloadSecrets replaces the server's secrets with those its source loads
+// now, keeping them if loading fails.
+func (s *Server) ReloadSecrets() error {
+	if s.source == nil {
+		return fmt.Errorf("no secret source")
+	}
+	secrets, err := s.source.Load()
+	if err != nil {
+		return fmt.Errorf("reload secrets: %w", err)
+	}
+	s.mu.Lock()
+	changed := !maps.EqualFunc(s.secrets, secrets, func(a, b Secrets) bool {
+		return maps.Equal(a, b)
+	})
+	s.secrets = secrets
+	s.mu.Unlock()
+	if changed {
+		log.Info("secrets reloaded", "services", len(secrets))
+	}
+	return nil
+}
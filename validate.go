@@ -0,0 +1,143 @@
+package locket
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// RegistryNamePattern is the pattern registry entry names must match.
+var RegistryNamePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]{0,127}$`)
+
+// ValidationIssue is a problem with one registry entry.
+type ValidationIssue struct {
+	Index   int    // position of the entry
+	Name    string // name of the entry
+	Problem string
+}
+
+// String describes the issue.
+func (i ValidationIssue) String() string {
+	return fmt.Sprintf("entry %d (%q): %s", i.Index, i.Name, i.Problem)
+}
+
+// ValidationReport lists every problem Validate found.
+type ValidationReport struct {
+	Issues []ValidationIssue
+}
+
+// OK reports whether no problems were found.
+func (r ValidationReport) OK() bool {
+	return len(r.Issues) == 0
+}
+
+// Err returns the issues as one error, or nil if there are none.
+func (r ValidationReport) Err() error {
+	if r.OK() {
+		return nil
+	}
+	lines := make([]string, len(r.Issues))
+	for i, issue := range r.Issues {
+		lines[i] = issue.String()
+	}
+	return fmt.Errorf("invalid registry: %s", strings.Join(lines, "; "))
+}
+
+// Validate checks registry entries: each name must match
+// RegistryNamePattern and be unique, labels must match LabelPattern,
+// each key must parse as an ed25519 public key with a consistent validity
+// period, and no key may be registered twice, under the same name or
+// another.
+func Validate(entries []RegEntry) ValidationReport {
+	var report ValidationReport
+	add := func(i int, name, format string, args ...any) {
+		report.Issues = append(report.Issues, ValidationIssue{
+			Index: i, Name: name, Problem: fmt.Sprintf(format, args...),
+		})
+	}
+	names := make(map[string]bool, len(entries))
+	keys := make(map[string]string, len(entries)) // key ID -> entry name
+	for i, e := range entries {
+		if !RegistryNamePattern.MatchString(e.Name) {
+			add(i, e.Name, "name does not match %s", RegistryNamePattern)
+		}
+		if _, ok := names[e.Name]; ok {
+			add(i, e.Name, "duplicate name")
+		} else {
+			names[e.Name] = true
+		}
+		for _, problem := range validateLabels(e.Labels) {
+			add(i, e.Name, "%s", problem)
+		}
+		for _, k := range e.AllKeys() {
+			key, err := ParseVerifyKey(k.KeyPub)
+			if err != nil {
+				add(i, e.Name, "invalid key: %v", err)
+				continue
+			}
+			if k.NotBefore != nil && k.NotAfter != nil && !k.NotBefore.Before(*k.NotAfter) {
+				add(i, e.Name, "key %s: not_before is not before not_after", key.ID())
+			}
+			if owner, ok := keys[key.ID()]; ok {
+				add(i, e.Name, "key %s also registered to %q", key.ID(), owner)
+				continue
+			}
+			keys[key.ID()] = e.Name
+		}
+	}
+	return report
+}
+
+// validateChange returns an error if after has problems that before did
+// not, so a write cannot make a registry worse, yet can fix it piecemeal.
+func validateChange(before, after []RegEntry) error {
+	known := make(map[string]bool)
+	for _, issue := range Validate(before).Issues {
+		known[issue.Name+"\x00"+issue.Problem] = true
+	}
+	var report ValidationReport
+	for _, issue := range Validate(after).Issues {
+		if !known[issue.Name+"\x00"+issue.Problem] {
+			report.Issues = append(report.Issues, issue)
+		}
+	}
+	return report.Err()
+}
+
+// validateEntry checks a single entry, as RemoteRegistry does before
+// sending it; the server checks it against the rest of the registry.
+func validateEntry(entry RegEntry) error {
+	return Validate([]RegEntry{entry}).Err()
+}
+
+// errInvalidRegistry is returned by NewServer for an invalid registry when
+// WithStrictRegistry is set.
+var errInvalidRegistry = errors.New("registry failed validation")
+
+// WithStrictRegistry refuses to start with a registry that fails Validate,
+// and ignores refreshed registries that fail it, keeping the last valid
+// one. Without it, problems are logged and the invalid keys skipped.
+func WithStrictRegistry() ServerOption {
+	return func(s *Server) {
+		s.strictRegistry = true
+	}
+}
+
+// applyEntries validates a registry snapshot and, unless it is invalid
+// and the registry strict, makes it current.
+func (s *Server) applyEntries(entries []RegEntry) error {
+	report := Validate(entries)
+	if !report.OK() && s.strictRegistry {
+		return fmt.Errorf("%w: %w", errInvalidRegistry, report.Err())
+	}
+	for _, issue := range report.Issues {
+		log.Warn("registry entry invalid",
+			"index", issue.Index,
+			"service", issue.Name,
+			"problem", issue.Problem,
+		)
+	}
+	s.setEntries(entries)
+	return nil
+}
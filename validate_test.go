@@ -0,0 +1,87 @@
+package locket
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestValidate(t *testing.T) {
+	require.True(t, Validate(testRegistryItems).OK())
+	require.True(t, Validate([]RegEntry{{Name: "keyless"}}).OK())
+
+	notBefore := time.Now()
+	notAfter := notBefore.Add(-time.Hour)
+	cases := map[string][]RegEntry{
+		"bad name":       {{Name: "service A", KeyPub: testPub1}},
+		"empty name":     {{Name: "", KeyPub: testPub1}},
+		"bad key":        {{Name: "svc", KeyPub: "asdfasdf"}},
+		"bad rotated":    {{Name: "svc", KeyPub: testPub1, Keys: []RegKey{{KeyPub: "zyx"}}}},
+		"duplicate name": {{Name: "svc", KeyPub: testPub1}, {Name: "svc", KeyPub: testPub2}},
+		"shared key":     {{Name: "a", KeyPub: testPub1}, {Name: "b", Keys: []RegKey{{KeyPub: testPub1}}}},
+		"repeated key":   {{Name: "svc", KeyPub: testPub1, Keys: []RegKey{{KeyPub: testPub1}}}},
+		"bounds": {{Name: "svc", Keys: []RegKey{
+			{KeyPub: testPub1, NotBefore: &notBefore, NotAfter: &notAfter},
+		}}},
+	}
+	for name, entries := range cases {
+		t.Run(name, func(t *testing.T) {
+			report := Validate(entries)
+			require.Len(t, report.Issues, 1)
+			require.Error(t, report.Err())
+			t.Log(report.Err())
+		})
+	}
+}
+
+func TestFileRegistryValidatesWrites(t *testing.T) {
+	reg := FileRegistry{Path: filepath.Join(t.TempDir(), "registry.yml")}
+	require.NoError(t, reg.Upsert(RegEntry{Name: "a", KeyPub: testPub1}))
+	require.Error(t, reg.Upsert(RegEntry{Name: "b", KeyPub: "asdfasdf"}))
+	require.Error(t, reg.Upsert(RegEntry{Name: "b c", KeyPub: testPub2}))
+	require.Error(t, reg.Upsert(RegEntry{Name: "b", KeyPub: testPub1}), "key registered to a")
+	require.Error(t, reg.AddKey("a", RegKey{KeyPub: "zyx"}))
+
+	// a registry already invalid can still be repaired piecemeal
+	require.NoError(t, reg.write([]RegEntry{
+		{Name: "a", KeyPub: testPub1},
+		{Name: "bad", KeyPub: "asdfasdf"},
+	}))
+	require.NoError(t, reg.Upsert(RegEntry{Name: "b", KeyPub: testPub2}))
+	require.NoError(t, reg.Delete("bad"))
+	entries, err := reg.Entries()
+	require.NoError(t, err)
+	require.True(t, Validate(entries).OK())
+}
+
+func TestRemoteRegistryValidatesUpsert(t *testing.T) {
+	// rejected before any request is made
+	reg := RemoteRegistry{URL: "http://127.0.0.1:0"}
+	require.ErrorContains(t, reg.Upsert(RegEntry{Name: "svc", KeyPub: "pub1"}), "invalid registry")
+}
+
+func TestNewServerInvalidRegistry(t *testing.T) {
+	reg := FileRegistry{Path: filepath.Join(t.TempDir(), "registry.yml")}
+	require.NoError(t, reg.write([]RegEntry{
+		{Name: "SERVICE1", KeyPub: testPub1},
+		{Name: "SERVICE2", KeyPub: testPub1},
+	}))
+	source := Dotenv{Path: testEnvFile, ServiceSecrets: testServiceMap}
+
+	_, err := NewServer(context.Background(), source, reg, 0, nil, WithStrictRegistry())
+	require.ErrorIs(t, err, errInvalidRegistry)
+
+	// without WithStrictRegistry the problems are only logged
+	server, err := NewServer(context.Background(), source, reg, 0, nil)
+	require.NoError(t, err)
+	server.Close()
+}
+
+func TestExampleRegistryValid(t *testing.T) {
+	entries, err := FileRegistry{Path: filepath.Join("example", "registry.yml")}.Entries()
+	require.NoError(t, err)
+	require.NoError(t, Validate(entries).Err())
+}
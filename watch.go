@@ -0,0 +1,75 @@
+package locket
+
+import (
+	"context"
+	"os"
+	"time"
+)
+
+// Watcher is an optional Registry capability: reporting changes as they
+// happen, so a Server need not re-read the whole registry on a timer.
+type Watcher interface {
+	// Watch calls onChange with the current entries, then again each time
+	// they change, until ctx ends. It returns ctx.Err() once ctx ends, or
+	// another error if changes can no longer be watched.
+	Watch(ctx context.Context, onChange func([]RegEntry)) error
+}
+
+var (
+	_ Watcher = FileRegistry{}
+	_ Watcher = RemoteRegistry{}
+)
+
+// defaultFileWatchInterval is how often FileRegistry.Watch checks the file
+// when WatchInterval is unset.
+const defaultFileWatchInterval = time.Second
+
+// Watch reports changes to the registry file, or to its signature file
+// (see FileRegistry.Sign), found by checking their modification time,
+// size and identity (inode) every WatchInterval. A
+// stat is cheap, so the interval can be far shorter than a poll interval.
+// An unreadable or invalid file is logged and skipped, keeping the last
+// good entries, until it is fixed.
+func (f FileRegistry) Watch(ctx context.Context, onChange func([]RegEntry)) error {
+	interval := f.WatchInterval
+	if interval <= 0 {
+		interval = defaultFileWatchInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	var last, lastSig os.FileInfo
+	for {
+		info, err := os.Stat(f.Path)
+		sig, _ := os.Stat(f.Path + ".sig") // nil if unsigned
+		switch {
+		case err != nil:
+			log.Warn("registry watch stat failed", "path", f.Path, "error", err)
+		case last == nil || fileChanged(last, info) ||
+			(sig == nil) != (lastSig == nil) || (sig != nil && fileChanged(lastSig, sig)):
+			entries, err := f.Entries()
+			if err != nil {
+				log.Error("registry watch read failed", "path", f.Path, "error", err)
+				break
+			}
+			last, lastSig = info, sig
+			if ctx.Err() == nil {
+				onChange(entries)
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// fileChanged reports whether a file was modified or replaced between two
+// stats. Atomic writes replace the file, changing its identity.
+func fileChanged(prev, cur os.FileInfo) bool {
+	return !os.SameFile(prev, cur) ||
+		!prev.ModTime().Equal(cur.ModTime()) ||
+		prev.Size() != cur.Size()
+}
@@ -0,0 +1,223 @@
+package locket
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// watchChanges runs w.Watch until the test ends, sending each reported
+// set of entries on the returned channel.
+func watchChanges(t *testing.T, w Watcher) (<-chan []RegEntry, <-chan error) {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	changes := make(chan []RegEntry, 16)
+	done := make(chan error, 1)
+	go func() {
+		done <- w.Watch(ctx, func(entries []RegEntry) { changes <- entries })
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+	return changes, done
+}
+
+func nextChange(t *testing.T, changes <-chan []RegEntry) []RegEntry {
+	t.Helper()
+	select {
+	case entries := <-changes:
+		return entries
+	case <-time.After(5 * time.Second):
+		t.Fatal("no change reported")
+		return nil
+	}
+}
+
+func requireNoChange(t *testing.T, changes <-chan []RegEntry, within time.Duration) {
+	t.Helper()
+	select {
+	case entries := <-changes:
+		t.Fatalf("unexpected change: %v", entries)
+	case <-time.After(within):
+	}
+}
+
+func TestFileRegistryWatch(t *testing.T) {
+	reg := FileRegistry{
+		Path:          filepath.Join(t.TempDir(), "registry.yml"),
+		WatchInterval: 5 * time.Millisecond,
+	}
+	require.NoError(t, reg.Upsert(RegEntry{Name: "a", KeyPub: testPub1}))
+	changes, _ := watchChanges(t, reg)
+
+	require.Len(t, nextChange(t, changes), 1, "current entries first")
+	requireNoChange(t, changes, 50*time.Millisecond)
+
+	require.NoError(t, reg.Upsert(RegEntry{Name: "b", KeyPub: testPub2}))
+	require.Len(t, nextChange(t, changes), 2)
+
+	// an invalid file is skipped until fixed
+	require.NoError(t, os.WriteFile(reg.Path, []byte("{not: [valid"), 0o644))
+	requireNoChange(t, changes, 50*time.Millisecond)
+	require.NoError(t, reg.write([]RegEntry{{Name: "c", KeyPub: testPub3}}))
+	require.Equal(t, "c", nextChange(t, changes)[0].Name)
+}
+
+func TestFileRegistryWatchStops(t *testing.T) {
+	reg := FileRegistry{Path: filepath.Join(t.TempDir(), "registry.yml")}
+	require.NoError(t, reg.Upsert(RegEntry{Name: "a"}))
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err := reg.Watch(ctx, func([]RegEntry) {})
+	require.ErrorIs(t, err, context.Canceled)
+}
+
+func TestRegistryHandlerETag(t *testing.T) {
+	longPollCheck = 5 * time.Millisecond
+	t.Cleanup(func() { longPollCheck = time.Second })
+	file := FileRegistry{Path: filepath.Join(t.TempDir(), "registry.yml")}
+	require.NoError(t, file.Upsert(RegEntry{Name: "a", KeyPub: testPub1}))
+	srv := httptest.NewServer(RegistryHandler{Registry: file, Token: "tok"})
+	defer srv.Close()
+
+	get := func(etag, wait string) *http.Response {
+		req, err := http.NewRequest(http.MethodGet, srv.URL+PathRegistry+"?wait="+wait, nil)
+		require.NoError(t, err)
+		req.Header.Set("X-Auth-Token", "tok")
+		req.Header.Set("If-None-Match", etag)
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		t.Cleanup(func() { resp.Body.Close() })
+		return resp
+	}
+	resp := get("", "")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	etag := resp.Header.Get("ETag")
+	require.NotEmpty(t, etag)
+
+	require.Equal(t, http.StatusNotModified, get(etag, "").StatusCode)
+	start := time.Now()
+	require.Equal(t, http.StatusNotModified, get(etag, "50ms").StatusCode)
+	require.GreaterOrEqual(t, time.Since(start), 50*time.Millisecond)
+
+	// a waiting request returns as soon as the registry changes
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		file.Upsert(RegEntry{Name: "b", KeyPub: testPub2})
+	}()
+	resp = get(etag, "10s")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.NotEqual(t, etag, resp.Header.Get("ETag"))
+	var entries []RegEntry
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&entries))
+	require.Len(t, entries, 2)
+}
+
+func TestRemoteRegistryWatch(t *testing.T) {
+	longPollCheck = 5 * time.Millisecond
+	minWatchRequest = 5 * time.Millisecond
+	t.Cleanup(func() {
+		longPollCheck = time.Second
+		minWatchRequest = time.Second
+	})
+	file := FileRegistry{Path: filepath.Join(t.TempDir(), "registry.yml")}
+	require.NoError(t, file.Upsert(RegEntry{Name: "a", KeyPub: testPub1}))
+	srv := httptest.NewServer(RegistryHandler{Registry: file, Token: "tok"})
+	defer srv.Close()
+
+	reg := RemoteRegistry{URL: srv.URL, Token: "tok", WatchWait: 100 * time.Millisecond}
+	changes, _ := watchChanges(t, reg)
+	require.Len(t, nextChange(t, changes), 1)
+	requireNoChange(t, changes, 250*time.Millisecond) // several long-polls time out
+
+	require.NoError(t, file.Upsert(RegEntry{Name: "b", KeyPub: testPub2}))
+	require.Len(t, nextChange(t, changes), 2)
+}
+
+func TestRemoteRegistryWatchUnsupported(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("[]"))
+	}))
+	defer srv.Close()
+	err := RemoteRegistry{URL: srv.URL}.Watch(context.Background(), func([]RegEntry) {})
+	require.ErrorIs(t, err, errWatchUnsupported)
+}
+
+// watchingRegistry is a countingRegistry that watches by re-reading its
+// entries in a loop, or fails to watch if broken.
+type watchingRegistry struct {
+	countingRegistry
+	broken bool
+}
+
+func (w *watchingRegistry) Watch(ctx context.Context, onChange func([]RegEntry)) error {
+	if w.broken {
+		return os.ErrInvalid
+	}
+	for ctx.Err() == nil {
+		entries, _ := w.Entries()
+		onChange(entries)
+		time.Sleep(time.Millisecond)
+	}
+	return ctx.Err()
+}
+
+func TestServerWatchesRegistry(t *testing.T) {
+	source := Dotenv{Path: testEnvFile, ServiceSecrets: testServiceMap}
+
+	// the ticker does not fire within the test, so reads are the watcher's
+	reg := &watchingRegistry{}
+	server, err := NewServer(context.Background(), source, reg, time.Hour, nil)
+	require.NoError(t, err)
+	time.Sleep(40 * time.Millisecond)
+	require.Greater(t, reg.calls(), 5, "watch should be running")
+
+	server.Close()
+	time.Sleep(20 * time.Millisecond)
+	stopped := reg.calls()
+	time.Sleep(40 * time.Millisecond)
+	require.Equal(t, stopped, reg.calls(), "watch must not run after Close")
+
+	// a registry that cannot be watched is polled instead
+	broken := &watchingRegistry{broken: true}
+	server, err = NewServer(context.Background(), source, broken, 5*time.Millisecond, nil)
+	require.NoError(t, err)
+	defer server.Close()
+	time.Sleep(40 * time.Millisecond)
+	require.Greater(t, broken.calls(), 2, "poll should have run several times")
+}
+
+// TestServerWatchAcceptsNewClient confirms a client registered in a watched
+// FileRegistry is accepted without waiting for a poll interval.
+func TestServerWatchAcceptsNewClient(t *testing.T) {
+	reg := FileRegistry{
+		Path:          filepath.Join(t.TempDir(), "registry.yml"),
+		WatchInterval: 5 * time.Millisecond,
+	}
+	require.NoError(t, reg.Upsert(RegEntry{Name: "other"}))
+	source := Dotenv{Path: testEnvFile, ServiceSecrets: testServiceMap}
+	server, err := NewServer(context.Background(), source, reg, time.Hour, nil)
+	require.NoError(t, err)
+	defer server.Close()
+	ts := httptest.NewServer(http.HandlerFunc(server.Handler))
+	defer ts.Close()
+
+	_, priv, err := reg.Register("SERVICE1")
+	require.NoError(t, err)
+	clientPub, _, err := newPairRSA(Defaults.BitsizeRSA)
+	require.NoError(t, err)
+
+	require.Eventually(t, func() bool {
+		req := craftRequest(t, server.key.Public().PEM(), priv, testSecretName, clientPub, time.Now().Unix())
+		resp, _ := postRequest(t, ts.URL, req)
+		return resp.StatusCode == http.StatusOK
+	}, 2*time.Second, 10*time.Millisecond)
+}